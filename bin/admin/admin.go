@@ -0,0 +1,431 @@
+// Administration executable of the upd daemon.
+// Copyright © 2015 - Rémy MATHIEU
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"server"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: upd-admin [-c server.conf] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  migrate    copies the files to another storage")
+	fmt.Fprintln(os.Stderr, "  fsck       checks the consistency of the metadata and the storage")
+	fmt.Fprintln(os.Stderr, "  backup     writes a backup of the database")
+	fmt.Fprintln(os.Stderr, "  restore    restores a backup")
+	fmt.Fprintln(os.Stderr, "  ready      checks that the running server is ready")
+	fmt.Fprintln(os.Stderr, "  copy-metadata")
+	fmt.Fprintln(os.Stderr, "             copies the metadata of the BoltDB database to the SQL store")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var configFile string
+
+	flag.StringVar(&configFile, "c", "upd.conf", "Configuration file of the server.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	config, err := server.ReadConfigFile(configFile)
+	if err != nil {
+		slog.Error("Can't read the configuration file", "file", configFile, "err", err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "migrate":
+		err = migrate(config, flag.Args()[1:])
+	case "fsck":
+		err = fsck(config, flag.Args()[1:])
+	case "backup":
+		err = backup(config, flag.Args()[1:])
+	case "restore":
+		err = restore(config, flag.Args()[1:])
+	case "ready":
+		err = ready(config, flag.Args()[1:])
+	case "copy-metadata":
+		err = copyMetadata(config, flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		slog.Error("Failed", "command", flag.Arg(0), "err", err)
+		os.Exit(1)
+	}
+}
+
+// migrate copies the files from the storage of the server
+// configuration to the storage of the target configuration.
+func migrate(config server.Config, args []string) error {
+	var targetFile string
+	var concurrency int
+	var dryRun bool
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&targetFile, "to", "", "Configuration file containing the target storage.")
+	flags.IntVar(&concurrency, "concurrency", server.DEFAULT_MIGRATION_CONCURRENCY, "Files copied concurrently.")
+	flags.BoolVar(&dryRun, "dry-run", false, "Lists the files to copy without copying them.")
+	flags.Parse(args)
+
+	if len(targetFile) == 0 {
+		return fmt.Errorf("the configuration of the target storage is required (-to)")
+	}
+
+	target, err := server.ReadConfigFile(targetFile)
+	if err != nil {
+		return err
+	}
+
+	source := server.StorageDescription(config.Storage, config)
+	destination := server.StorageDescription(target.Storage, target)
+	if source == destination {
+		return fmt.Errorf("the target storage is the current storage: %s", source)
+	}
+
+	db, err := server.OpenDatabase(config.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// the files must be read from the storage the server is using
+	var recorded string
+	db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte("Config")); bucket != nil {
+			recorded = string(bucket.Get([]byte("storage")))
+		}
+		return nil
+	})
+	if len(recorded) == 0 {
+		return fmt.Errorf("the database has never been used by the server")
+	}
+	if recorded != config.Storage {
+		return fmt.Errorf("the database has been used with the storage %s, not %s", recorded, config.Storage)
+	}
+
+	metadata, err := server.NewMetadataStore(config, db, slog.Default())
+	if err != nil {
+		return err
+	}
+	defer metadata.Close()
+
+	from, err := server.NewStorage(config.Storage, config)
+	if err != nil {
+		return err
+	}
+	to, err := server.NewStorage(target.Storage, target)
+	if err != nil {
+		return err
+	}
+
+	migration := &server.Migration{
+		Database:    db,
+		Metadata:    metadata,
+		Log:         slog.Default(),
+		From:        from,
+		To:          to,
+		ToStorage:   target.Storage,
+		Target:      destination,
+		Concurrency: concurrency,
+		DryRun:      dryRun,
+	}
+
+	slog.Info("Migrating", "from", source, "to", destination, "dry_run", dryRun)
+
+	report, err := migration.Run()
+	slog.Info("Migration report",
+		"files", report.Files,
+		"copied", report.Copied,
+		"skipped", report.Skipped,
+		"missing_thumbnails", report.Missing,
+		"failed", report.Failed,
+		"bytes", report.Bytes)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dryRun:
+		slog.Info("Dry run, nothing has been copied")
+	case report.Failed > 0:
+		return fmt.Errorf("%d files can't be copied, run the migration again to resume it", report.Failed)
+	default:
+		slog.Info("Migration done, the server must now be started with the target storage configuration", "storage", target.Storage)
+	}
+
+	return nil
+}
+
+// fsck checks the consistency of the metadata and the
+// storage of the server, and repairs it.
+func fsck(config server.Config, args []string) error {
+	var repair, dryRun, hashes bool
+	var grace time.Duration
+
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flags.BoolVar(&repair, "repair", false, "Deletes the orphan files and drops the metadata of the missing files.")
+	flags.BoolVar(&dryRun, "dry-run", false, "With -repair, lists the repairs without doing them.")
+	flags.BoolVar(&hashes, "hashes", true, "Verifies the content of the files, reading all of them.")
+	flags.DurationVar(&grace, "grace", server.DEFAULT_FSCK_GRACE, "With -repair, keeps the orphan files written more recently.")
+	flags.Parse(args)
+
+	if err := server.CheckFsckConfig(config); err != nil {
+		return err
+	}
+
+	db, err := server.OpenDatabase(config.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	metadata, err := server.NewMetadataStore(config, db, slog.Default())
+	if err != nil {
+		return err
+	}
+	defer metadata.Close()
+
+	storage, err := server.NewStorage(config.Storage, config)
+	if err != nil {
+		return err
+	}
+
+	check := &server.Fsck{
+		Metadata: metadata,
+		Storage:  storage,
+		Log:      slog.Default(),
+		Hashes:   hashes,
+		Repair:   repair,
+		DryRun:   dryRun,
+		Grace:    grace,
+	}
+
+	report, err := check.Run(context.Background())
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	if report.Consistent() {
+		slog.Info("No inconsistency found")
+	} else if !repair {
+		slog.Warn("Inconsistencies found, run with -repair to repair them")
+	}
+
+	return nil
+}
+
+// backup writes a backup of the database and, if asked,
+// of the stored files.
+func backup(config server.Config, args []string) error {
+	var output string
+	var files bool
+
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.StringVar(&output, "o", "upd-backup.tar.gz", "File in which the backup is written, - for stdout.")
+	flags.BoolVar(&files, "files", false, "Includes the stored files in the backup.")
+	flags.Parse(args)
+
+	if err := server.CheckBackupConfig(config); err != nil {
+		return err
+	}
+
+	db, err := server.OpenDatabase(config.RuntimeDir)
+	if err != nil {
+		return fmt.Errorf("%v, use the backup route of the running server", err)
+	}
+	defer db.Close()
+
+	metadata, err := server.NewMetadataStore(config, db, slog.Default())
+	if err != nil {
+		return err
+	}
+	defer metadata.Close()
+
+	var storage server.Storage
+	if files {
+		if storage, err = server.NewStorage(config.Storage, config); err != nil {
+			return err
+		}
+	}
+
+	w := os.Stdout
+	if output != "-" {
+		if w, err = os.Create(output); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	if err := server.WriteBackup(w, db, metadata, storage, slog.Default()); err != nil {
+		return err
+	}
+
+	slog.Info("Backup written", "file", output, "files", files)
+	return nil
+}
+
+// restore restores a backup, the server being stopped.
+func restore(config server.Config, args []string) error {
+	var files bool
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.BoolVar(&files, "files", false, "Writes the files of the backup in the storage.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("the backup file is required")
+	}
+
+	if err := server.CheckBackupConfig(config); err != nil {
+		return err
+	}
+
+	// the server must be stopped
+	if _, err := os.Stat(config.RuntimeDir + "/metadata.db"); err == nil {
+		db, err := server.OpenDatabase(config.RuntimeDir)
+		if err != nil {
+			return err
+		}
+		db.Close()
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	restore := &server.Restore{
+		RuntimeDir:  config.RuntimeDir,
+		Log:         slog.Default(),
+		StorageType: config.Storage,
+	}
+	if files {
+		if restore.Storage, err = server.NewStorage(config.Storage, config); err != nil {
+			return err
+		}
+	}
+
+	report, err := restore.Run(file)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Backup restored", "files", report.Files, "restored_files", report.Restored, "previous_database", report.Previous)
+	return nil
+}
+
+// copyMetadata copies the metadata and the collections of the
+// BoltDB database to the SQL store of the configuration.
+func copyMetadata(config server.Config, args []string) error {
+	flags := flag.NewFlagSet("copy-metadata", flag.ExitOnError)
+	flags.Parse(args)
+
+	if config.MetadataStore != server.SQLITE_STORE && config.MetadataStore != server.POSTGRES_STORE {
+		return fmt.Errorf("the configuration doesn't use a SQL metadata store")
+	}
+
+	db, err := server.OpenDatabase(config.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	bolt := server.NewBoltStore(db, slog.Default())
+	entries, err := bolt.Query(nil)
+	if err != nil {
+		return err
+	}
+	collections, err := bolt.QueryCollections(nil)
+	if err != nil {
+		return err
+	}
+
+	store, err := server.NewSQLStore(config.MetadataStore, config.SQLConfig, slog.Default())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, entry := range entries {
+		if err := store.Put(entry); err != nil {
+			return fmt.Errorf("can't copy the metadata of %s: %v", entry.Filename, err)
+		}
+	}
+
+	for _, collection := range collections {
+		if err := store.PutCollection(collection); err != nil {
+			return fmt.Errorf("can't copy the collection %s: %v", collection.Id, err)
+		}
+	}
+
+	slog.Info("Metadata copied", "files", len(entries), "collections", len(collections), "metadata_store", config.MetadataStore)
+	return nil
+}
+
+// ready queries the readiness probe of the running server, on the
+// address and with the scheme of its configuration.
+func ready(config server.Config, args []string) error {
+	var timeout time.Duration
+
+	flags := flag.NewFlagSet("ready", flag.ExitOnError)
+	flags.DurationVar(&timeout, "timeout", 10*time.Second, "Max duration of the check.")
+	flags.Parse(args)
+
+	if config.ClientAuth == server.CLIENT_AUTH_REQUIRE && len(config.HealthAddr) == 0 {
+		return fmt.Errorf("the server requires client certificates, set health_addr to probe it")
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// the certificate is issued for the public name, not localhost
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	url := server.ReadyURL(config)
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
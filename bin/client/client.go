@@ -23,10 +23,13 @@ func parseFlags() (client.Flags, error) {
 
 	// Declare the flags
 	flag.StringVar(&(flags.CA), "ca", "none", "For HTTPS support: none / filename of an accepted CA / unsafe (doesn't check the CA)")
+	flag.StringVar(&(flags.Cert), "cert", "", "For HTTPS support: client certificate to authenticate with (PEM)")
+	flag.StringVar(&(flags.CertKey), "cert-key", "", "For HTTPS support: key of the client certificate (PEM)")
 	flag.StringVar(&(flags.ServerUrl), "url", "http://localhost:9000/upd", "The server to contact")
 	flag.StringVar(&(flags.SecretKey), "key", "", "A shared secret key to identify the client.")
 	flag.StringVar(&(flags.TTL), "ttl", "", `TTL after which the file expires, ex: 30m. Valid time units are "ns", "us" (or "µs"), "ms", "s", "m", "h"`)
 	flag.StringVar(&(flags.SearchTags), "search-tags", "", "Search by tags. If many, must be separated by a comma, an 'or' operator is used. Ex: \"may,screenshot\".")
+	flag.StringVar(&(flags.Strip), "strip-metadata", "", "true / false: whether the EXIF/XMP/... metadata of the images must be removed. Default is decided by the server.")
 	flag.Var(&flags.Tags, "tags", "Tags to attach to the file, separated by a comma. Ex: \"screenshot,may\"")
 
 	// Read them
@@ -5,57 +5,12 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 
 	"server"
-
-	"github.com/BurntSushi/toml"
 )
 
-// readFromFile looks whether a configuration file is provided
-// to read the config into it.
-func readFromFile(filename string) (server.Config, error) {
-	// default hardcoded config when no configuration file is available
-	config := server.Config{
-		Addr:       ":9000",
-		Storage:    "fs",
-		RuntimeDir: "/tmp",
-		FSConfig: server.FSConfig{
-			OutputDirectory: "/tmp",
-		},
-		Route: "/upd",
-	}
-
-	// read the file
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return config, err
-	}
-
-	// decode the file
-	_, err = toml.Decode(string(data), &config)
-	if err != nil {
-		return config, err
-	}
-
-	// Ensure the validity of the config // TODO log
-	if config.Route[0] != '/' {
-		config.Route = "/" + config.Route
-	}
-	if config.Route[len(config.Route)-1] == '/' {
-		config.Route = config.Route[:len(config.Route)-1]
-	}
-
-	if config.Storage != server.FS_STORAGE && config.Storage != server.S3_STORAGE {
-		log.Println("[err] Unknown storage:", config.Storage)
-		os.Exit(1)
-	}
-
-	return config, nil
-}
-
 func parseFlags() server.Flags {
 	var flags server.Flags
 
@@ -71,12 +26,26 @@ func parseFlags() server.Flags {
 func main() {
 	flags := parseFlags()
 
-	config, err := readFromFile(flags.ConfigFile)
+	config, err := server.ReadConfigFile(flags.ConfigFile)
 	if err != nil {
-		log.Println("[warn] Can't read the configuration file")
-		log.Println("[warn] Falling back on default values for configuration.")
+		slog.Warn("Can't read the configuration file, falling back on default values for configuration", "file", flags.ConfigFile, "err", err)
+	}
+
+	if err := server.ValidateConfig(config); err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
 	}
 
 	app := server.NewServer(config)
+
+	// reloaded on SIGHUP
+	app.ConfigLoader = func() (server.Config, error) {
+		config, err := server.ReadConfigFile(flags.ConfigFile)
+		if err != nil {
+			return config, err
+		}
+		return config, server.ValidateConfig(config)
+	}
+
 	app.Start()
 }
@@ -38,11 +38,10 @@ func (c *Client) Send(filename string) error {
 }
 
 func (c *Client) createHttpClient() *http.Client {
+	tlsConfig := &tls.Config{}
+
 	if c.Flags.CA == "unsafe" {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		return &http.Client{Transport: tr}
+		tlsConfig.InsecureSkipVerify = true
 	} else if len(c.Flags.CA) > 0 && c.Flags.CA != "none" {
 		// reads the CA
 		certs := x509.NewCertPool()
@@ -51,14 +50,25 @@ func (c *Client) createHttpClient() *http.Client {
 			log.Println("[err] Can't read the CA.")
 		}
 		certs.AppendCertsFromPEM(pemData)
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{RootCAs: certs},
+		tlsConfig.RootCAs = certs
+	}
+
+	// client certificate to authenticate
+	if len(c.Flags.Cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.Flags.Cert, c.Flags.CertKey)
+		if err != nil {
+			log.Println("[err] Can't read the client certificate:", err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
 		}
-		return &http.Client{Transport: tr}
 	}
 
-	// No HTTPS support
-	return &http.Client{}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
 }
 
 // buildParams adds the GET parameters to the given uri.
@@ -22,7 +22,10 @@ type Flags struct {
 	SecretKey  string // Secret between the client and the server
 	TTL        string // when a ttl is given for a file
 	CA         string // Should we use HTTPS, and in which config "none", file to a CA or "unsafe"
+	Cert       string // client certificate to authenticate with
+	CertKey    string // key of the client certificate
 	SearchTags string // if we wanna look for some files by tags
+	Strip      string // "true" / "false" to override the server default about stripping the images metadata
 
 	Tags Tags // Array of tag to attach to the file
 }
@@ -67,6 +67,9 @@ func (c *Client) SearchTags(tags []string) {
 		fmt.Printf("Link: %s/%s\n", c.Flags.ServerUrl, entry.Filename)
 		fmt.Printf("Deletion link: %s/%s/%s\n", c.Flags.ServerUrl, entry.Filename, entry.DeleteKey)
 		fmt.Printf("Creation time: %s\n", entry.CreationTime)
+		if entry.Size > 0 {
+			fmt.Printf("Size: %d bytes (%s)\n", entry.Size, entry.ContentType)
+		}
 		if !entry.ExpirationTime.IsZero() {
 			fmt.Printf("Expiration time: %s\n", entry.ExpirationTime)
 		}
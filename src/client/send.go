@@ -49,6 +49,7 @@ func (c *Client) sendData(filename string, data []byte) error {
 	params := make(map[string]string)
 	params["ttl"] = c.Flags.TTL
 	params["name"] = filename
+	params["strip_metadata"] = c.Flags.Strip
 
 	uri = c.buildParams(uri, params, c.Flags.Tags)
 
@@ -100,6 +101,9 @@ func (c *Client) sendData(filename string, data []byte) error {
 	} else {
 		fmt.Println("Available until:", sendResponse.ExpirationTime)
 	}
+	if sendResponse.MetadataStripped {
+		fmt.Println("Metadata of the image removed.")
+	}
 	fmt.Println("--")
 
 	return nil
@@ -0,0 +1,78 @@
+// Automatic tls certificates with ACME (Let's Encrypt, ...).
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates the manager obtaining and renewing the certificates
+// of the configured domains, cached in the runtime directory.
+func (s *Server) newACMEManager() (*autocert.Manager, error) {
+	config := s.Config.ACMEConfig
+
+	if len(config.Domains) == 0 {
+		return nil, fmt.Errorf("no domain configured for ACME")
+	}
+
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if len(client.DirectoryURL) == 0 {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	// a custom CA is needed to talk to a test ACME server (Pebble, ...)
+	if len(config.CAFile) > 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+
+		client.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(s.Config.RuntimeDir, "acme")),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     client,
+	}, nil
+}
+
+// startACMEHTTPServer starts the plain http listener answering the
+// HTTP-01 challenges and, if enabled, redirecting to https.
+func (s *Server) startACMEHTTPServer(manager *autocert.Manager, errs chan<- error) {
+	var fallback http.Handler = http.NotFoundHandler()
+	if s.Config.ACMEConfig.Redirect {
+		fallback = nil // autocert redirects to https
+	}
+
+	s.acmeHTTPServer = &http.Server{
+		Addr:              s.Config.ACMEConfig.HTTPAddr,
+		Handler:           manager.HTTPHandler(fallback),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	s.Log.Info("Start listening for the ACME challenges", "addr", s.Config.ACMEConfig.HTTPAddr, "redirect", s.Config.ACMEConfig.Redirect)
+	go func() { errs <- s.acmeHTTPServer.ListenAndServe() }()
+}
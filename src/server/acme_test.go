@@ -0,0 +1,211 @@
+// Tests of the automatic tls certificates with ACME.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestACMEServer returns a server obtaining its certificates
+// with the given ACME configuration.
+func newTestACMEServer(t *testing.T, config ACMEConfig) *Server {
+	config.Enabled = true
+	s := NewServer(Config{RuntimeDir: t.TempDir(), ACMEConfig: config})
+	s.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return s
+}
+
+// writeTestCA writes the certificate of the tls server as a CA file.
+func writeTestCA(t *testing.T, server *httptest.Server) string {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestACMEManagerConfig(t *testing.T) {
+	if _, err := newTestACMEServer(t, ACMEConfig{}).newACMEManager(); err == nil {
+		t.Error("a configuration without domain is accepted")
+	}
+
+	config := ACMEConfig{Domains: []string{"upd.example.com"}, CAFile: "/nonexistent/ca.pem"}
+	if _, err := newTestACMEServer(t, config).newACMEManager(); err == nil {
+		t.Error("a missing CA file is accepted")
+	}
+
+	config.CAFile = filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(config.CAFile, []byte("not a certificate"), 0600)
+	if _, err := newTestACMEServer(t, config).newACMEManager(); err == nil {
+		t.Error("a CA file without certificate is accepted")
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	s := newTestACMEServer(t, ACMEConfig{Domains: []string{"upd.example.com"}})
+	manager, err := s.newACMEManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.HostPolicy(t.Context(), "upd.example.com"); err != nil {
+		t.Errorf("the configured domain is refused: %v", err)
+	}
+	if err := manager.HostPolicy(t.Context(), "other.example.com"); err == nil {
+		t.Error("a domain which isn't configured is accepted")
+	}
+}
+
+// TestACMECAFile checks that the directory of an ACME server
+// using a private CA is only reachable with its CA file.
+func TestACMECAFile(t *testing.T) {
+	directory := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := "https://" + r.Host
+		writeTestJSON(w, map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/account",
+			"newOrder":   base + "/order",
+			"revokeCert": base + "/revoke",
+			"keyChange":  base + "/key-change",
+		})
+	}))
+	defer directory.Close()
+
+	s := newTestACMEServer(t, ACMEConfig{
+		Domains:      []string{"upd.example.com"},
+		DirectoryURL: directory.URL + "/dir",
+		CAFile:       writeTestCA(t, directory),
+	})
+	manager, err := s.newACMEManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Client.Discover(t.Context()); err != nil {
+		t.Fatalf("the directory can't be read with the CA file: %v", err)
+	}
+
+	s = newTestACMEServer(t, ACMEConfig{
+		Domains:      []string{"upd.example.com"},
+		DirectoryURL: directory.URL + "/dir",
+	})
+	if manager, err = s.newACMEManager(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Client.Discover(t.Context()); err == nil {
+		t.Fatal("the directory is trusted without the CA file")
+	}
+}
+
+// pebbleTransport adds the Location header, the url of the order,
+// to the responses of Pebble to the finalization of an order: the
+// ACME client waits for the order at this url, which isn't sent by
+// Pebble, unlike Let's Encrypt.
+type pebbleTransport struct {
+	http.RoundTripper
+}
+
+func (p pebbleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := p.RoundTripper.RoundTrip(r)
+	if err == nil && strings.Contains(r.URL.Path, "/finalize-order/") && len(resp.Header.Get("Location")) == 0 {
+		order := *r.URL
+		order.Path = strings.Replace(order.Path, "/finalize-order/", "/my-order/", 1)
+		resp.Header.Set("Location", order.String())
+	}
+	return resp, err
+}
+
+// TestACMEPebble obtains a certificate from a Pebble server, answering
+// its TLS-ALPN-01 and HTTP-01 challenges. It is only run when
+// UPD_PEBBLE_DIRECTORY is set, see the README.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("UPD_PEBBLE_DIRECTORY")
+	if len(directory) == 0 {
+		t.Skip("UPD_PEBBLE_DIRECTORY isn't set")
+	}
+
+	domain := os.Getenv("UPD_PEBBLE_DOMAIN")
+	if len(domain) == 0 {
+		domain = "upd.example.com"
+	}
+	tlsAddr := os.Getenv("UPD_PEBBLE_TLS_ADDR")
+	if len(tlsAddr) == 0 {
+		tlsAddr = ":5001"
+	}
+	httpAddr := os.Getenv("UPD_PEBBLE_HTTP_ADDR")
+	if len(httpAddr) == 0 {
+		httpAddr = ":5002"
+	}
+
+	s := newTestACMEServer(t, ACMEConfig{
+		Domains:      []string{domain},
+		Email:        "admin@example.com",
+		DirectoryURL: directory,
+		CAFile:       os.Getenv("UPD_PEBBLE_CA"),
+		HTTPAddr:     httpAddr,
+	})
+	manager, err := s.newACMEManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.Client.HTTPClient == nil {
+		manager.Client.HTTPClient = &http.Client{Transport: http.DefaultTransport}
+	}
+	manager.Client.HTTPClient.Transport = pebbleTransport{manager.Client.HTTPClient.Transport}
+
+	errs := make(chan error, 2)
+	s.startACMEHTTPServer(manager, errs)
+	defer s.acmeHTTPServer.Close()
+
+	listener, err := net.Listen("tcp", tlsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }),
+		TLSConfig: manager.TLSConfig(),
+	}
+	go func() { errs <- server.ServeTLS(listener, "", "") }()
+	defer server.Close()
+
+	// the certificate is obtained on the first handshake
+	dialer := &net.Dialer{Timeout: 2 * time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), &tls.Config{
+		ServerName:         domain,
+		InsecureSkipVerify: true, // issued by the random root of Pebble
+	})
+	if err != nil {
+		select {
+		case err := <-errs:
+			t.Fatalf("listener: %v", err)
+		default:
+		}
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		t.Fatal("self-signed certificate")
+	}
+
+	// cached in the runtime directory
+	cached, err := filepath.Glob(filepath.Join(s.Config.RuntimeDir, "acme", domain+"*"))
+	if err != nil || len(cached) == 0 {
+		t.Fatalf("the certificate isn't cached in the runtime directory: %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+// Append-only audit log of the uploads, downloads and deletions.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	AUDIT_BUCKET = "Audit"
+
+	AUDIT_UPLOAD       = "upload"
+	AUDIT_DOWNLOAD     = "download"
+	AUDIT_DELETE       = "delete"
+	AUDIT_EXPIRE       = "expire"
+	AUDIT_AUTH_FAILURE = "auth_failure"
+
+	ADMIN_KEY_HEADER = "X-upd-admin-key"
+
+	DEFAULT_AUDIT_QUERY_LIMIT = 1000
+	DEFAULT_AUDIT_RETENTION   = 90 * 24 * time.Hour
+
+	// AUDIT_AUTH_FAILURES_PER_MINUTE is the max amount of authentication
+	// failures recorded per minute, sent by anyone: the others are only
+	// counted in the next recorded one.
+	AUDIT_AUTH_FAILURES_PER_MINUTE = 60
+
+	// events deleted per transaction by the retention
+	AUDIT_PRUNE_BATCH = 1000
+)
+
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`               // upload, download, delete, expire or auth_failure
+	RemoteIP  string    `json:"remote_ip,omitempty"`  // IP of the client, empty for the jobs
+	Identity  string    `json:"identity,omitempty"`   // authenticated user, if any
+	RequestId string    `json:"request_id,omitempty"` // id of the request, empty for the jobs
+	File      string    `json:"file,omitempty"`       // id of the file
+	Original  string    `json:"original,omitempty"`   // original name of the file
+	Detail    string    `json:"detail,omitempty"`     // more information on the event
+}
+
+// authFailureLimiter limits the amount of authentication
+// failures recorded per minute.
+type authFailureLimiter struct {
+	mu      sync.Mutex
+	minute  time.Time // start of the current minute
+	count   int       // failures recorded during the current minute
+	dropped int       // failures not recorded since the last recorded one
+}
+
+// allow returns whether the failure must be recorded and, if so,
+// the amount of failures not recorded since the last one.
+func (l *authFailureLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if minute := now.Truncate(time.Minute); !minute.Equal(l.minute) {
+		l.minute = minute
+		l.count = 0
+	}
+
+	if l.count >= AUDIT_AUTH_FAILURES_PER_MINUTE {
+		l.dropped++
+		return false, 0
+	}
+
+	l.count++
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
+
+// openAuditLog opens the JSONL file of the audit log, if configured.
+func (s *Server) openAuditLog() error {
+	if len(s.Config.AuditLogFile) == 0 {
+		return nil
+	}
+
+	file, err := os.OpenFile(s.Config.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.auditFile = file
+	return nil
+}
+
+// audit records an event of the given request in the audit log.
+// The entry can be nil if the event isn't about a file.
+func (s *Server) audit(r *http.Request, action string, entry *Metadata, detail string) {
+	if action == AUDIT_AUTH_FAILURE {
+		record, dropped := s.authFailures.allow(time.Now())
+		if !record {
+			return
+		}
+		if dropped > 0 {
+			detail += fmt.Sprintf(" (%d failures not recorded before)", dropped)
+		}
+	}
+
+	event := AuditEvent{
+		Action:   action,
+		RemoteIP: r.RemoteAddr,
+		Detail:   detail,
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.RemoteIP = host
+	}
+	if identity := s.identity(r); identity != nil {
+		event.Identity = identity.Name
+	}
+	event.RequestId, _ = r.Context().Value(requestIdKey).(string)
+
+	if entry != nil {
+		event.File = entry.Filename
+		event.Original = entry.Original
+	}
+
+	s.auditEvent(event)
+}
+
+// auditEvent appends the event to the audit log: in the BoltDB bucket,
+// keyed by time to be queried by time range, and/or in the JSONL file.
+func (s *Server) auditEvent(event AuditEvent) {
+	if !s.Config.AuditLog && s.auditFile == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		s.Log.Error("Can't marshal an audit event", "err", err)
+		return
+	}
+
+	if s.Config.AuditLog {
+		err := s.Database.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(AUDIT_BUCKET))
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			return bucket.Put(auditKey(event.Time, seq), data)
+		})
+		if err != nil {
+			s.Log.Error("Can't store an audit event", "event", string(data), "err", err)
+		}
+	}
+
+	if s.auditFile != nil {
+		s.auditLock.Lock()
+		_, err := s.auditFile.Write(append(data, '\n'))
+		s.auditLock.Unlock()
+		if err != nil {
+			s.Log.Error("Can't write an audit event", "event", string(data), "err", err)
+		}
+	}
+}
+
+// pruneAuditLog deletes the events stored in the database
+// before the retention of the audit log.
+func (s *Server) pruneAuditLog(now time.Time) (int, error) {
+	retention := DEFAULT_AUDIT_RETENTION
+	if len(s.Config.AuditRetention) > 0 {
+		if d, err := time.ParseDuration(s.Config.AuditRetention); err == nil {
+			retention = d
+		}
+	}
+	end := auditKey(now.Add(-retention), 0)
+
+	deleted := 0
+	for {
+		// in small transactions, not to block the writes
+		batch := 0
+		err := s.Database.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(AUDIT_BUCKET))
+
+			var keys [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0 && len(keys) < AUDIT_PRUNE_BATCH; k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			batch = len(keys)
+			return nil
+		})
+		deleted += batch
+		if err != nil || batch < AUDIT_PRUNE_BATCH {
+			return deleted, err
+		}
+	}
+}
+
+// auditKey builds the key of an event: its time in nanoseconds then
+// a sequence, both big endian, for the keys to be sorted by time.
+func auditKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// AuditEvents returns the events recorded in the BoltDB bucket between the
+// given times (zero for no bound), for the given file if not empty, in
+// chronological order.
+func (s *Server) AuditEvents(from, to time.Time, file string, limit int) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+
+	err := s.Database.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(AUDIT_BUCKET)).Cursor()
+
+		var k, v []byte
+		if from.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(auditKey(from, 0))
+		}
+
+		var end []byte
+		if !to.IsZero() {
+			end = auditKey(to, ^uint64(0))
+		}
+
+		for ; k != nil && len(events) < limit; k, v = c.Next() {
+			if end != nil && bytes.Compare(k, end) > 0 {
+				break
+			}
+
+			var event AuditEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				s.Log.Error("Can't read an audit event", "err", err)
+				continue
+			}
+
+			if len(file) > 0 && event.File != file {
+				continue
+			}
+
+			events = append(events, event)
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+// IsAdmin returns whether the request has been sent by an administrator:
+// an identity listed in the admin identities or a client knowing the
+// admin key. The identities sent by a browser on its own must come with
+// the CSRF header, a page of another site can't run a repair or download
+// a backup as the administrator.
+func IsAdmin(s *Server, r *http.Request) bool {
+	config := s.currentConfig()
+
+	if identity := s.identity(r); identity != nil && isIntended(r, identity) {
+		for _, admin := range config.AdminIdentities {
+			if admin == identity.Name {
+				return true
+			}
+		}
+	}
+
+	return len(config.AdminKey) > 0 && r.Header.Get(ADMIN_KEY_HEADER) == config.AdminKey
+}
+
+// AuditHandler lets the administrators query the audit log
+// by time range and file.
+type AuditHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (a *AuditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(a.Server, r) {
+		a.Server.audit(r, AUDIT_AUTH_FAILURE, nil, "audit")
+		w.WriteHeader(403)
+		return
+	}
+
+	var from, to time.Time
+	var err error
+
+	query := r.URL.Query()
+	if len(query.Get("from")) > 0 {
+		if from, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	if len(query.Get("to")) > 0 {
+		if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	limit := DEFAULT_AUDIT_QUERY_LIMIT
+	if len(query.Get("limit")) > 0 {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit <= 0 {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	events, err := a.Server.AuditEvents(from, to, query.Get("file"), limit)
+	if err != nil {
+		a.Server.logger(r).Error("Can't read the audit log", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		a.Server.logger(r).Error("Can't marshal the audit events", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
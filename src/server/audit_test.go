@@ -0,0 +1,82 @@
+// Tests of the audit log.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditAuthFailuresLimit(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "secret"
+		c.AuditLog = true
+	})
+
+	for i := 0; i < AUDIT_AUTH_FAILURES_PER_MINUTE+10; i++ {
+		if w := get(h, "/upd/1.0/auth_check", nil); w.Code != http.StatusForbidden {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	events, err := s.AuditEvents(time.Time{}, time.Time{}, "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unless a new minute started meanwhile
+	if len(events) != AUDIT_AUTH_FAILURES_PER_MINUTE && !strings.Contains(events[len(events)-1].Detail, "not recorded") {
+		t.Fatalf("%d failures recorded", len(events))
+	}
+}
+
+func TestAuthFailureLimiter(t *testing.T) {
+	var limiter authFailureLimiter
+	now := time.Date(2015, 1, 24, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < AUDIT_AUTH_FAILURES_PER_MINUTE; i++ {
+		if record, _ := limiter.allow(now); !record {
+			t.Fatalf("failure %d not recorded", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if record, _ := limiter.allow(now.Add(time.Second)); record {
+			t.Fatal("recorded above the limit")
+		}
+	}
+
+	record, dropped := limiter.allow(now.Add(time.Minute))
+	if !record || dropped != 5 {
+		t.Fatalf("next minute: recorded %v, %d dropped", record, dropped)
+	}
+}
+
+func TestPruneAuditLog(t *testing.T) {
+	s, _ := newTestServer(t, func(c *Config) {
+		c.AuditLog = true
+		c.AuditRetention = "24h"
+	})
+
+	now := time.Now()
+	for i := 0; i < AUDIT_PRUNE_BATCH+5; i++ {
+		s.auditEvent(AuditEvent{Time: now.Add(-48 * time.Hour), Action: AUDIT_UPLOAD})
+	}
+	s.auditEvent(AuditEvent{Time: now.Add(-time.Hour), Action: AUDIT_DELETE})
+
+	deleted, err := s.pruneAuditLog(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != AUDIT_PRUNE_BATCH+5 {
+		t.Errorf("%d events deleted", deleted)
+	}
+
+	events, err := s.AuditEvents(time.Time{}, time.Time{}, "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != AUDIT_DELETE {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
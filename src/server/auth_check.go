@@ -18,9 +18,22 @@ func (a *AuthCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"auth_status":"ok"}`))
 }
 
-// IsAuthValid returns whether the HTTP request contains the expected secret key, if the configuration
-// requires one
+// IsAuthValid returns whether the HTTP request has been sent with an allowed
+// identity or contains the expected secret key. Without a secret key, the
+// anonymous requests are only accepted if no identity is required: neither
+// OIDC nor the client certificates are enabled.
 func IsAuthValid(s *Server, r *http.Request) bool {
-	key := r.Header.Get(SECRET_KEY_HEADER)
-	return s.Config.SecretKey == "" || key == s.Config.SecretKey
+	var valid bool
+	if identity := s.identity(r); identity != nil {
+		valid = s.isAllowedIdentity(identity)
+	} else if secretKey := s.currentConfig().SecretKey; len(secretKey) > 0 {
+		valid = r.Header.Get(SECRET_KEY_HEADER) == secretKey
+	} else {
+		valid = !s.requiresIdentity()
+	}
+
+	if !valid {
+		s.audit(r, AUDIT_AUTH_FAILURE, nil, r.URL.Path)
+	}
+	return valid
 }
@@ -0,0 +1,255 @@
+// Backups of the database and of the stored files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	BACKUP_DATABASE_ENTRY = "metadata.db"
+	BACKUP_FILES_DIR      = "files/"
+	BACKUP_PREFIX         = "upd-backup-"
+	BACKUP_SUFFIX         = ".tar.gz"
+	BACKUP_TIME_FORMAT    = "20060102T150405Z"
+
+	DEFAULT_BACKUP_INTERVAL  = 24 * time.Hour
+	DEFAULT_BACKUP_RETENTION = 7
+)
+
+// WriteBackup writes a gzipped tarball containing a consistent snapshot of
+// the database, taken in a read transaction, and, if a storage is given,
+// the files referenced in the metadata store.
+func WriteBackup(w io.Writer, db *bolt.DB, metadata MetadataStore, storage Storage, log *slog.Logger) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    BACKUP_DATABASE_ENTRY,
+			Mode:    0600,
+			Size:    tx.Size(),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if storage != nil {
+		// the files uploaded since the snapshot are only orphans once restored
+		entries, err := metadata.Query(nil)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Filename)
+			names = append(names, entry.Thumbnails...)
+		}
+	}
+
+	for _, name := range names {
+		data, err := storage.Read(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted since the snapshot
+			log.Warn("File not backed up, missing from the storage", "file", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't read %s: %v", name, err)
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    BACKUP_FILES_DIR + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// CheckBackupConfig refuses to backup or restore a server whose metadata
+// are in a SQL store: the backups only contain the BoltDB database.
+func CheckBackupConfig(config Config) error {
+	switch config.MetadataStore {
+	case SQLITE_STORE, POSTGRES_STORE:
+		return fmt.Errorf("the backups don't contain the %s metadata store, back it up and restore it with its own tools", config.MetadataStore)
+	}
+	return nil
+}
+
+// BackupHandler streams a backup to the administrators, with the
+// stored files if files=true.
+type BackupHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (b *BackupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(b.Server, r) {
+		b.Server.audit(r, AUDIT_AUTH_FAILURE, nil, "backup")
+		w.WriteHeader(403)
+		return
+	}
+
+	logger := b.Server.logger(r)
+	if err := CheckBackupConfig(b.Server.Config); err != nil {
+		logger.Error("Can't write the backup", "err", err)
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var storage Storage
+	if r.URL.Query().Get("files") == "true" {
+		storage = b.Server.backend
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+backupName(time.Now()))
+
+	// the status has been sent, the client sees a truncated archive
+	if err := WriteBackup(w, b.Server.Database, b.Server.Metadata, storage, logger); err != nil {
+		logger.Error("Can't write the backup", "err", err)
+		return
+	}
+	logger.Info("Backup sent", "files", storage != nil)
+}
+
+// backupName returns the name of the backup file made at the given time.
+func backupName(t time.Time) string {
+	return BACKUP_PREFIX + t.UTC().Format(BACKUP_TIME_FORMAT) + BACKUP_SUFFIX
+}
+
+// StartBackupJob regularly writes a backup in the backup
+// directory, if configured.
+func (s *Server) StartBackupJob() {
+	if len(s.Config.BackupConfig.Directory) == 0 {
+		return
+	}
+
+	// validated on startup
+	interval := DEFAULT_BACKUP_INTERVAL
+	if len(s.Config.BackupConfig.Interval) > 0 {
+		interval, _ = time.ParseDuration(s.Config.BackupConfig.Interval)
+	}
+
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if err := s.backup(); err != nil {
+				s.Log.Error("Can't write the backup", "directory", s.Config.BackupConfig.Directory, "err", err)
+				backupsTotal.WithLabelValues("failure").Inc()
+				continue
+			}
+			backupsTotal.WithLabelValues("success").Inc()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// backup writes a backup in the backup directory, then
+// deletes the oldest ones.
+func (s *Server) backup() error {
+	config := s.Config.BackupConfig
+
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return err
+	}
+
+	var storage Storage
+	if config.Files {
+		storage = s.backend
+	}
+
+	// written aside, an interrupted backup isn't taken for a valid one
+	file, err := os.CreateTemp(config.Directory, ".backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := WriteBackup(file, s.Database, s.Metadata, storage, s.Log); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(config.Directory, backupName(time.Now()))
+	if err := os.Rename(file.Name(), name); err != nil {
+		return err
+	}
+	s.Log.Info("Backup written", "file", name)
+
+	retention := config.Retention
+	if retention <= 0 {
+		retention = DEFAULT_BACKUP_RETENTION
+	}
+	return pruneBackups(s.Log, config.Directory, retention)
+}
+
+// pruneBackups deletes the oldest backups of the directory
+// to only keep the given amount.
+func pruneBackups(log *slog.Logger, directory string, retention int) error {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	// the names are sorted by time
+	var backups []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), BACKUP_PREFIX) && strings.HasSuffix(entry.Name(), BACKUP_SUFFIX) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > retention {
+		if err := os.Remove(filepath.Join(directory, backups[0])); err != nil {
+			return err
+		}
+		log.Info("Old backup deleted", "file", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
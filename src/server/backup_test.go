@@ -0,0 +1,228 @@
+// Tests of the backups and of their restoration.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// backupEntry is an entry of a backup built by a test.
+type backupEntry struct {
+	name string
+	data []byte
+}
+
+// testBackup returns a backup containing the entries.
+func testBackup(t *testing.T, entries ...backupEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.data)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// testSnapshot returns a snapshot of a database with the buckets
+// of the server, made with the given storage.
+func testSnapshot(t *testing.T, storage string) []byte {
+	db, _ := newTestBoltStore(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Config")).Put([]byte("storage"), []byte(storage))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestRestore returns a restoration in an empty runtime
+// directory, writing the files in an empty storage.
+func newTestRestore(t *testing.T) (*Restore, *FSStorage) {
+	storage := NewFSStorage(FSConfig{OutputDirectory: filepath.Join(t.TempDir(), "files")})
+	return &Restore{
+		RuntimeDir:  t.TempDir(),
+		Log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		StorageType: FS_STORAGE,
+		Storage:     storage,
+	}, storage
+}
+
+func TestBackupRestore(t *testing.T) {
+	backups := t.TempDir()
+	s, h := newTestServer(t, func(c *Config) {
+		c.BackupConfig = BackupConfig{Directory: backups, Files: true}
+	})
+
+	w, response := upload(t, h, "notes.txt", []byte("some notes"), nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if err := s.backup(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(backups, BACKUP_PREFIX+"*"+BACKUP_SUFFIX))
+	if len(names) != 1 {
+		t.Fatalf("unexpected backups %v", names)
+	}
+	backup, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	restore, storage := newTestRestore(t)
+	report, err := restore.Run(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 1 || report.Restored != 1 || report.Previous != "" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// a server started on the restored database
+	_, h = newTestServer(t, func(c *Config) {
+		c.RuntimeDir = restore.RuntimeDir
+		c.FSConfig = storage.Config
+	})
+	w = get(h, "/upd/"+response.Name, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "some notes" {
+		t.Fatalf("status %d, %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	corrupted := testSnapshot(t, FS_STORAGE)
+	// the pages after the meta ones
+	for i := 2 * os.Getpagesize(); i < len(corrupted); i++ {
+		corrupted[i] = 0xFF
+	}
+
+	tests := map[string][]byte{
+		"not gzipped":        []byte("metadata.db"),
+		"no database":        testBackup(t, backupEntry{BACKUP_FILES_DIR + "abcdefgh", []byte("data")}),
+		"corrupted database": testBackup(t, backupEntry{BACKUP_DATABASE_ENTRY, corrupted}, backupEntry{BACKUP_FILES_DIR + "abcdefgh", []byte("data")}),
+		"other storage":      testBackup(t, backupEntry{BACKUP_DATABASE_ENTRY, testSnapshot(t, S3_STORAGE)}, backupEntry{BACKUP_FILES_DIR + "abcdefgh", []byte("data")}),
+	}
+
+	for name, backup := range tests {
+		restore, storage := newTestRestore(t)
+		path := filepath.Join(restore.RuntimeDir, "metadata.db")
+		if err := os.WriteFile(path, []byte("current"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := restore.Run(bytes.NewReader(backup)); err == nil {
+			t.Errorf("%s: restored", name)
+			continue
+		}
+
+		if data, err := os.ReadFile(path); err != nil || string(data) != "current" {
+			t.Errorf("%s: the current database is modified: %q, %v", name, data, err)
+		}
+		if entries, _ := os.ReadDir(restore.RuntimeDir); len(entries) != 1 {
+			t.Errorf("%s: files left in the runtime directory: %v", name, entries)
+		}
+		if names, _ := storage.List(); len(names) != 0 {
+			t.Errorf("%s: files restored: %v", name, names)
+		}
+	}
+}
+
+func TestRestoreFilesFilter(t *testing.T) {
+	backup := testBackup(t,
+		backupEntry{BACKUP_DATABASE_ENTRY, testSnapshot(t, FS_STORAGE)},
+		backupEntry{BACKUP_FILES_DIR + "abcdefgh", []byte("data")},
+		backupEntry{BACKUP_FILES_DIR + "../escaped", []byte("data")},
+		backupEntry{BACKUP_FILES_DIR + "ab/cd/abcdxxxx", []byte("data")},
+		backupEntry{BACKUP_FILES_DIR + "..", []byte("data")},
+		backupEntry{BACKUP_FILES_DIR + ".tmp", []byte("data")},
+		backupEntry{BACKUP_FILES_DIR, nil},
+		backupEntry{"abcdyyyy", []byte("data")},
+	)
+
+	restore, storage := newTestRestore(t)
+	report, err := restore.Run(bytes.NewReader(backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	var written []string
+	filepath.WalkDir(filepath.Dir(storage.Config.OutputDirectory), func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			written = append(written, strings.TrimPrefix(path, filepath.Dir(storage.Config.OutputDirectory)))
+		}
+		return nil
+	})
+	expected := string(filepath.Separator) + filepath.Join(filepath.Base(storage.Config.OutputDirectory), "ab", "cd", "abcdefgh")
+	if len(written) != 1 || written[0] != expected {
+		t.Errorf("unexpected files written %v", written)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+
+	start := time.Date(2015, 1, 24, 0, 0, 0, 0, time.UTC)
+	var backups []string
+	for i := 0; i < 5; i++ {
+		backups = append(backups, backupName(start.Add(time.Duration(i)*time.Hour)))
+	}
+	for _, name := range append(backups, "notes.txt", ".backup-123", BACKUP_PREFIX+"notes.txt") {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneBackups(slog.New(slog.NewTextHandler(io.Discard, nil)), dir, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	sort.Strings(kept)
+
+	expected := []string{".backup-123", BACKUP_PREFIX + "notes.txt", backups[3], backups[4], "notes.txt"}
+	sort.Strings(expected)
+	if strings.Join(kept, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected files kept %v", kept)
+	}
+}
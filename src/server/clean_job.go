@@ -5,11 +5,7 @@
 package server
 
 import (
-	"encoding/json"
-	"log"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 type CleanJob struct {
@@ -19,37 +15,55 @@ type CleanJob struct {
 // Run deals with cleaning the expired files by
 // checking their TTL.
 func (j CleanJob) Run() {
-	var entries []Metadata
-
-	j.server.Database.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Metadata"))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			// unmarshal
-			var entry Metadata
-			err := json.Unmarshal(v, &entry)
-			if err != nil {
-				log.Println("[err] Can't read a metadata:", err.Error())
-				continue
-			}
-
-			if !entry.ExpirationTime.IsZero() && entry.ExpirationTime.Before(time.Now()) {
-				entries = append(entries, entry)
-			}
-		}
+	cleanJobRunsTotal.Inc()
 
-		return nil
-	})
+	entries, err := j.server.Metadata.ExpireDue(time.Now())
+	if err != nil {
+		j.server.Log.Error("Can't list the expired files", "err", err)
+	}
 
 	for _, entry := range entries {
 		// No longer alive!
 		err := j.server.Expire(entry)
 		if err != nil {
-			log.Println("[warn] While deleting file:", entry.Filename)
-			log.Println(err)
+			j.server.Log.Warn("Can't delete an expired file", "file", entry.Filename, "err", err)
+		} else {
+			j.server.Log.Info("Deleted due to TTL", "file", entry.Filename)
+			j.server.auditEvent(AuditEvent{Action: AUDIT_EXPIRE, File: entry.Filename, Original: entry.Original, Detail: "ttl"})
+			j.server.publish(EVENT_EXPIRE, entry)
+			cleanJobDeletionsTotal.WithLabelValues("file").Inc()
+		}
+	}
+
+	j.cleanCollections()
+
+	if j.server.Config.AuditLog {
+		deleted, err := j.server.pruneAuditLog(time.Now())
+		if err != nil {
+			j.server.Log.Error("Can't delete the old audit events", "err", err)
+		} else if deleted > 0 {
+			j.server.Log.Info("Old audit events deleted", "count", deleted)
+		}
+	}
+}
+
+// cleanCollections deals with cleaning the expired collections.
+func (j CleanJob) cleanCollections() {
+	now := time.Now()
+	collections, err := j.server.Metadata.QueryCollections(func(c Collection) bool {
+		return !c.ExpirationTime.IsZero() && c.ExpirationTime.Before(now)
+	})
+	if err != nil {
+		j.server.Log.Error("Can't list the expired collections", "err", err)
+	}
+
+	for _, collection := range collections {
+		err := j.server.ExpireCollection(collection)
+		if err != nil {
+			j.server.Log.Warn("Can't delete an expired collection", "collection", collection.Id, "err", err)
 		} else {
-			log.Println("[info] Deleted due to TTL:", entry.Filename)
+			j.server.Log.Info("Collection deleted due to TTL", "collection", collection.Id)
+			cleanJobDeletionsTotal.WithLabelValues("collection").Inc()
 		}
 	}
 }
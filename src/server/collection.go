@@ -0,0 +1,77 @@
+// Collections of files sharing a single link.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"time"
+)
+
+const (
+	COLLECTIONS_BUCKET = "Collections"
+)
+
+type Collection struct {
+	Id             string    `json:"id"`              // id of the collection, used in its link.
+	Title          string    `json:"title"`           // title displayed on the index page.
+	Files          []string  `json:"files"`           // ids of the files contained in this collection.
+	TTL            string    `json:"ttl"`             // time.Duration representing the lifetime of the collection.
+	ExpirationTime time.Time `json:"expiration_time"` // at which time this collection should expire.
+	ExpireMembers  bool      `json:"expire_members"`  // whether the files must expire with the collection.
+	DeleteKey      string    `json:"delete_key"`      // The key to delete/modify this collection.
+	CreationTime   time.Time `json:"creation_time"`
+}
+
+// Contains returns whether the given file id is part of the collection.
+func (c Collection) Contains(id string) bool {
+	for _, f := range c.Files {
+		if f == id {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCollection returns the collection if it exists, otherwise, nil is returned.
+func (s *Server) GetCollection(id string) (*Collection, error) {
+	return s.Metadata.GetCollection(id)
+}
+
+// putCollection stores the given collection in the metadata store.
+func (s *Server) putCollection(c Collection) error {
+	return s.Metadata.PutCollection(c)
+}
+
+// ExpireCollection deletes the collection and, if it has been
+// asked at its creation, every file it contains. The files are
+// only expired by the server which deleted the collection.
+func (s *Server) ExpireCollection(c Collection) error {
+	deleted, err := s.Metadata.DeleteCollection(c.Id)
+	if err != nil {
+		return err
+	}
+
+	if !deleted || !c.ExpireMembers {
+		return nil
+	}
+
+	for _, id := range c.Files {
+		entry, err := s.GetEntry(id)
+		if err != nil {
+			s.Log.Error("Can't read a member of the collection", "collection", c.Id, "err", err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		if err := s.Expire(*entry); err != nil {
+			s.Log.Warn("Can't delete a file of the collection", "collection", c.Id, "file", entry.Filename, "err", err)
+			continue
+		}
+
+		s.auditEvent(AuditEvent{Action: AUDIT_EXPIRE, File: entry.Filename, Original: entry.Original, Detail: "collection " + c.Id})
+		s.publish(EVENT_EXPIRE, *entry)
+	}
+
+	return nil
+}
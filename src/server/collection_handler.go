@@ -0,0 +1,389 @@
+// Routes dealing with the collections of files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Json returned to the client
+type CollectionResponse struct {
+	Id             string    `json:"id"`
+	Title          string    `json:"title"`
+	Files          []string  `json:"files"`
+	DeleteKey      string    `json:"delete_key"`
+	ExpirationTime time.Time `json:"expiration_time"`
+}
+
+// CreateCollectionHandler creates a new collection, optionally
+// with some already uploaded files.
+type CreateCollectionHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (c *CreateCollectionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthValid(c.Server, r) {
+		w.WriteHeader(403)
+		return
+	}
+
+	r.ParseForm()
+
+	var id string
+	for {
+		id = randomString(8)
+		// test existence
+		collection, err := c.Server.GetCollection(id)
+		if err != nil {
+			c.Server.logger(r).Error("Can't read the database", "err", err)
+			w.WriteHeader(500)
+			return
+		}
+		if collection == nil {
+			break
+		}
+	}
+
+	now := time.Now()
+	collection := Collection{
+		Id:            id,
+		Title:         r.Form.Get("title"),
+		Files:         make([]string, 0),
+		ExpireMembers: r.Form.Get("expire_members") == "true",
+		DeleteKey:     randomString(16),
+		CreationTime:  now,
+	}
+
+	// reads the TTL
+	if ttl := r.Form.Get("ttl"); len(ttl) > 0 {
+		// check that the value is a correct duration
+		if _, err := time.ParseDuration(ttl); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		collection.TTL = ttl
+		collection.ExpirationTime = c.Server.computeEndOfLife(ttl, now)
+	}
+
+	files, ok := readCollectionFiles(c.Server, w, r, collection.ExpireMembers)
+	if !ok {
+		return
+	}
+	collection.Files = append(collection.Files, files...)
+
+	if err := c.Server.putCollection(collection); err != nil {
+		c.Server.logger(r).Error("Can't store the collection", "collection", collection.Id, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeCollectionResponse(w, collection)
+}
+
+// EditCollectionHandler adds/removes files to/from a collection
+// or deletes it. The delete key of the collection is required.
+type EditCollectionHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (c *EditCollectionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id := vars["collection"]
+	action := vars["action"]
+
+	r.ParseForm()
+
+	collection, err := c.Server.GetCollection(id)
+	if err != nil {
+		c.Server.logger(r).Error("Can't read the collection", "collection", id, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	if collection == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	// checks that the key is correct
+	if collection.DeleteKey != r.Form.Get("key") {
+		w.WriteHeader(403)
+		return
+	}
+
+	var update func(stored *Collection)
+
+	switch action {
+	case "delete":
+		// not deleted by following a link
+		if r.Method != "POST" && r.Method != "DELETE" {
+			w.Header().Set("Allow", "POST, DELETE")
+			w.WriteHeader(405)
+			return
+		}
+		if err := c.Server.ExpireCollection(*collection); err != nil {
+			c.Server.logger(r).Error("Can't delete the collection", "collection", collection.Id, "err", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("Collection deleted."))
+		return
+	case "add":
+		// adding files is an API call
+		if !IsAuthValid(c.Server, r) {
+			w.WriteHeader(403)
+			return
+		}
+		files, ok := readCollectionFiles(c.Server, w, r, collection.ExpireMembers)
+		if !ok {
+			return
+		}
+		update = func(stored *Collection) {
+			for _, f := range files {
+				if !stored.Contains(f) {
+					stored.Files = append(stored.Files, f)
+				}
+			}
+		}
+	case "remove":
+		removed := make(map[string]bool)
+		for _, f := range splitParam(r.Form.Get("files")) {
+			removed[f] = true
+		}
+		update = func(stored *Collection) {
+			files := make([]string, 0)
+			for _, f := range stored.Files {
+				if !removed[f] {
+					files = append(files, f)
+				}
+			}
+			stored.Files = files
+		}
+	default:
+		w.WriteHeader(404)
+		return
+	}
+
+	// applied on the stored collection, which may have
+	// been modified meanwhile by another server
+	err = c.Server.Metadata.UpdateCollection(id, func(stored *Collection) bool {
+		update(stored)
+		collection = stored
+		return true
+	})
+	if err != nil {
+		c.Server.logger(r).Error("Can't store the collection", "collection", collection.Id, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeCollectionResponse(w, *collection)
+}
+
+var collectionTemplate = template.Must(template.New("collection").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+ul { list-style: none; padding: 0; }
+li { display: inline-block; width: 220px; margin: 0 1em 1em 0; vertical-align: top; word-wrap: break-word; }
+img { max-width: 200px; max-height: 200px; display: block; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p><a href="{{.ZipLink}}">Download all ({{len .Files}} files)</a></p>
+<ul>
+{{range .Files}}<li><a href="{{.Link}}">{{if .Image}}<img src="{{.Link}}?w=200&amp;h=200" alt="{{.Original}}">{{end}}{{.Original}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type collectionPage struct {
+	Title   string
+	ZipLink string
+	Files   []collectionPageFile
+}
+
+type collectionPageFile struct {
+	Link     string
+	Original string
+	Image    bool
+}
+
+// CollectionIndexHandler displays an HTML page listing the
+// files of a collection.
+type CollectionIndexHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (c *CollectionIndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	collection, entries, ok := readCollectionEntries(c.Server, w, r)
+	if !ok {
+		return
+	}
+
+	page := collectionPage{
+		Title:   collection.Title,
+		ZipLink: c.Server.Config.Route + "/collection/" + collection.Id + "/zip",
+		Files:   make([]collectionPageFile, 0),
+	}
+	if len(page.Title) == 0 {
+		page.Title = collection.Id
+	}
+
+	for _, entry := range entries {
+		page.Files = append(page.Files, collectionPageFile{
+			Link:     c.Server.Config.Route + "/" + entry.Filename,
+			Original: entry.Original,
+			Image:    isImageFilename(entry.Original),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := collectionTemplate.Execute(w, page); err != nil {
+		c.Server.logger(r).Error("Can't render the collection page", "collection", collection.Id, "err", err)
+	}
+}
+
+// CollectionZipHandler sends a zip archive containing every
+// file of a collection.
+type CollectionZipHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (c *CollectionZipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	collection, entries, ok := readCollectionEntries(c.Server, w, r)
+	if !ok {
+		return
+	}
+
+	setZipHeaders(w, collection.Id+".zip")
+	if err := c.Server.writeZip(w, entries); err != nil {
+		c.Server.logger(r).Error("Can't write the zip archive of the collection", "collection", collection.Id, "err", err)
+	}
+}
+
+// readCollectionEntries reads the collection from the route and
+// the metadata of its files still existing. The response has already
+// been written when false is returned.
+func readCollectionEntries(s *Server, w http.ResponseWriter, r *http.Request) (*Collection, []Metadata, bool) {
+	id := mux.Vars(r)["collection"]
+
+	collection, err := s.GetCollection(id)
+	if err != nil {
+		s.logger(r).Error("Can't read the collection", "collection", id, "err", err)
+		w.WriteHeader(500)
+		return nil, nil, false
+	}
+	if collection == nil {
+		w.WriteHeader(404)
+		return nil, nil, false
+	}
+
+	// expired but not cleaned yet
+	if !collection.ExpirationTime.IsZero() && collection.ExpirationTime.Before(time.Now()) {
+		w.WriteHeader(404)
+		return nil, nil, false
+	}
+
+	entries := make([]Metadata, 0)
+	for _, f := range collection.Files {
+		entry, err := s.GetEntry(f)
+		if err != nil {
+			s.logger(r).Error("Can't read a file of the collection", "collection", id, "file", f, "err", err)
+			continue
+		}
+		// the file may have been deleted since
+		if entry == nil {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+
+	return collection, entries, true
+}
+
+// readCollectionFiles reads the files ids given in the request and
+// checks that they exist. The files of a collection expiring its members
+// are deleted with it: the request must then prove that it could delete
+// each of them, with their delete keys given in the same order in the
+// keys parameter or by being their owner. The response has already been
+// written when false is returned.
+func readCollectionFiles(s *Server, w http.ResponseWriter, r *http.Request, expireMembers bool) ([]string, bool) {
+	files := splitParam(r.Form.Get("files"))
+	keys := strings.Split(r.Form.Get("keys"), ",")
+
+	for i, f := range files {
+		entry, err := s.GetEntry(f)
+		if err != nil {
+			s.logger(r).Error("Can't read the database", "err", err)
+			w.WriteHeader(500)
+			return nil, false
+		}
+		if entry == nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Unknown file: " + f))
+			return nil, false
+		}
+
+		if !expireMembers || s.isOwner(r, *entry) {
+			continue
+		}
+		if i >= len(keys) || len(entry.DeleteKey) == 0 || strings.Trim(keys[i], " ") != entry.DeleteKey {
+			s.audit(r, AUDIT_AUTH_FAILURE, entry, "collection member without its delete key")
+			w.WriteHeader(403)
+			w.Write([]byte("Missing delete key of the file: " + f))
+			return nil, false
+		}
+	}
+
+	return files, true
+}
+
+func writeCollectionResponse(w http.ResponseWriter, c Collection) {
+	resp, _ := json.Marshal(CollectionResponse{
+		Id:             c.Id,
+		Title:          c.Title,
+		Files:          c.Files,
+		DeleteKey:      c.DeleteKey,
+		ExpirationTime: c.ExpirationTime,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// splitParam splits a comma-separated parameter, ignoring
+// the empty values.
+func splitParam(param string) []string {
+	result := make([]string, 0)
+	for _, v := range strings.Split(param, ",") {
+		v = strings.Trim(v, " ")
+		if len(v) > 0 {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// isImageFilename returns whether the given filename looks
+// like an image that can be resized.
+func isImageFilename(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return true
+	}
+	return false
+}
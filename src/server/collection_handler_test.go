@@ -0,0 +1,63 @@
+// Tests of the routes of the collections.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// post sends a POST request to the router.
+func post(h http.Handler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCollectionExpireMembersKeys(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	_, file := upload(t, h, "a.txt", []byte("a"), nil, nil)
+
+	// someone else's file, without its delete key
+	w := post(h, "/upd/1.0/collection?expire_members=true&files="+file.Name, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("a file is added without its delete key: status %d", w.Code)
+	}
+	w = post(h, "/upd/1.0/collection?expire_members=true&files="+file.Name+"&keys=wrong", nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("a file is added with a wrong delete key: status %d", w.Code)
+	}
+
+	// without expiring the members, sharing a file is enough
+	w = post(h, "/upd/1.0/collection?files="+file.Name, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	w = post(h, "/upd/1.0/collection?expire_members=true&files="+file.Name+"&keys="+file.DeleteKey, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var collection CollectionResponse
+	json.Unmarshal(w.Body.Bytes(), &collection)
+
+	// the delete links of the collection can't be followed
+	deleteLink := "/upd/1.0/collection/" + collection.Id + "/delete?key=" + collection.DeleteKey
+	if w := get(h, deleteLink, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("a GET deletes the collection: status %d", w.Code)
+	}
+
+	if w := post(h, deleteLink, nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if entry, _ := s.GetEntry(file.Name); entry != nil {
+		t.Error("the member isn't deleted with the collection")
+	}
+}
@@ -3,14 +3,33 @@
 
 package server
 
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
 // Server flags
 type Flags struct {
 	ConfigFile string // the file configuration to use for the server
 }
 
 const (
-	FS_STORAGE = "fs"
-	S3_STORAGE = "s3"
+	FS_STORAGE         = "fs"
+	S3_STORAGE         = "s3"
+	TIERED_STORAGE     = "tiered"
+	REPLICATED_STORAGE = "replicated"
+
+	BOLT_STORE     = "bolt"
+	SQLITE_STORE   = "sqlite"
+	POSTGRES_STORE = "postgres"
+
+	DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+	DEFAULT_PRESIGNED_TTL    = 5 * time.Minute
+	DEFAULT_TIER_INTERVAL    = time.Hour
+	DEFAULT_REPAIR_INTERVAL  = 10 * time.Minute
 )
 
 // Server configuration
@@ -21,20 +40,298 @@ type Config struct {
 	Route           string `toml:"route"`           // Route served by the webserver
 	CertificateFile string `toml:"certificate"`     // Filepath to an tls certificate
 	CertificateKey  string `toml:"certificate_key"` // Filepath to the key part of a certificate
+	MetricsRoute    string `toml:"metrics_route"`   // Route exposing the Prometheus metrics, empty to disable it
 
-	Storage string `toml:"storage"` // possible values 'fs', 's3'
+	ClientAuth        string   `toml:"client_auth"`        // Client certificates: none, optional or require
+	ClientCAFile      string   `toml:"client_ca_file"`     // CA signing the accepted client certificates
+	AllowedIdentities []string `toml:"allowed_identities"` // Identities of the client certificates allowed to use the API, any if empty
 
-	FSConfig FSConfig `toml:"fsstorage"`
-	S3Config S3Config `toml:"s3storage"`
+	AdminIdentities []string `toml:"admin_identities"` // Identities of the administrators
+	AdminKey        string   `toml:"admin_key"`        // Secret giving access to the administration routes, disabled if empty
+
+	AuditLog       bool   `toml:"audit_log"`       // Whether the audit events are stored in the database
+	AuditLogFile   string `toml:"audit_log_file"`  // JSONL file in which the audit events are appended, disabled if empty
+	AuditRetention string `toml:"audit_retention"` // Lifetime of the events stored in the database, 90 days if empty
+
+	LogFormat     string `toml:"log_format"`      // logfmt or json
+	LogLevel      string `toml:"log_level"`       // debug, info, warn or error
+	AccessLog     string `toml:"access_log"`      // Format of the access log: apache or json, empty to disable it
+	AccessLogFile string `toml:"access_log_file"` // File in which the access log is written, stdout if empty
+
+	ThumbnailMaxSize uint  `toml:"thumbnail_max_size"` // Max width/height of the generated thumbnails
+	StripMetadata    bool  `toml:"strip_metadata"`     // Whether the metadata of the uploaded images are removed by default
+	MaxUploadSize    int64 `toml:"max_upload_size"`    // Max size in bytes of an upload, 0 for no limit
+
+	ShutdownTimeout string `toml:"shutdown_timeout"` // Max duration to wait for the running requests when stopping
+	HealthAddr      string `toml:"health_addr"`      // Address of a plain http listener only serving /healthz and /readyz, disabled if empty
+
+	Storage string `toml:"storage"` // possible values 'fs', 's3', 'tiered', 'replicated'
+
+	MetadataStore string    `toml:"metadata_store"` // possible values 'bolt' (default), 'sqlite', 'postgres'
+	SQLConfig     SQLConfig `toml:"sqlstore"`
+
+	FSConfig     FSConfig     `toml:"fsstorage"`
+	S3Config     S3Config     `toml:"s3storage"`
+	TieredConfig TieredConfig `toml:"tieredstorage"`
+
+	Replicas    []ReplicaConfig   `toml:"replicas"`
+	Replication ReplicationConfig `toml:"replication"`
+
+	Webhooks []WebhookConfig `toml:"webhooks"`
+
+	BackupConfig BackupConfig `toml:"backup"`
+
+	ACMEConfig ACMEConfig `toml:"acme"`
+	OIDCConfig OIDCConfig `toml:"oidc"`
 }
 
 type FSConfig struct {
 	OutputDirectory string `toml:"output_dir"`
+	MinFreeSpace    uint64 `toml:"min_free_space"` // Min free space in bytes in the output directory to be ready, 0 to disable the check
 }
 
 type S3Config struct {
-	AccessKey    string `toml:"access_key"`
+	AccessKey    string `toml:"access_key"` // read from the environment, shared config or IAM role if empty
 	AccessSecret string `toml:"access_secret"`
 	Region       string `toml:"region"`
 	Bucket       string `toml:"bucket"`
+
+	Endpoint             string `toml:"endpoint"`               // URL of an S3-compatible service (MinIO, Ceph, ...), AWS if empty
+	PathStyle            bool   `toml:"path_style"`             // Whether the bucket is in the path instead of the host name
+	Prefix               string `toml:"prefix"`                 // Prefix of the keys of the objects
+	StorageClass         string `toml:"storage_class"`          // Storage class of the objects (STANDARD, STANDARD_IA, ...)
+	ServerSideEncryption string `toml:"server_side_encryption"` // AES256 or aws:kms
+	KMSKeyId             string `toml:"kms_key_id"`             // KMS key used with aws:kms
+
+	PresignedDownloads bool   `toml:"presigned_downloads"` // Whether the downloads are redirected to presigned urls
+	PresignedTTL       string `toml:"presigned_ttl"`       // Lifetime of the presigned urls, 5m if empty
+}
+
+// Tiered storage: the files are uploaded in the hot storage and
+// demoted to the cold one according to the policy.
+type TieredConfig struct {
+	Hot               string `toml:"hot"`                 // storage of the new files: fs or s3
+	Cold              string `toml:"cold"`                // storage of the demoted files: fs or s3
+	DemoteAfter       string `toml:"demote_after"`        // Age after which a file is demoted, disabled if empty
+	DemoteUnusedAfter string `toml:"demote_unused_after"` // Duration without download after which a file is demoted, disabled if empty
+	DemoteMinSize     int64  `toml:"demote_min_size"`     // Min size in bytes of the demoted files, 0 for any size
+	Interval          string `toml:"interval"`            // Interval between the runs of the tier job, 1h if empty
+}
+
+// Storage of the replicated storage.
+type ReplicaConfig struct {
+	Name     string   `toml:"name"`    // name of the replica, in the logs and the database
+	Storage  string   `toml:"storage"` // fs or s3
+	FSConfig FSConfig `toml:"fsstorage"`
+	S3Config S3Config `toml:"s3storage"`
+}
+
+type ReplicationConfig struct {
+	MinWrites      int    `toml:"min_writes"`      // replicas which must be written for an upload to succeed, all if 0
+	RepairInterval string `toml:"repair_interval"` // Interval between the runs of the repair job, 10m if empty
+}
+
+// SQL database storing the metadata.
+type SQLConfig struct {
+	DSN          string `toml:"dsn"`            // Data source name of the database
+	MaxOpenConns int    `toml:"max_open_conns"` // Max open connections to the database, 0 for no limit
+}
+
+// Scheduled backups of the database.
+type BackupConfig struct {
+	Directory string `toml:"directory"` // Directory of the scheduled backups, disabled if empty
+	Interval  string `toml:"interval"`  // Interval between the backups, 24h if empty
+	Retention int    `toml:"retention"` // Backups kept in the directory, 7 if 0
+	Files     bool   `toml:"files"`     // Whether the stored files are included in the backups
+}
+
+// Automatic tls certificates with ACME, replacing
+// CertificateFile/CertificateKey when enabled.
+type ACMEConfig struct {
+	Enabled      bool     `toml:"enabled"`
+	Domains      []string `toml:"domains"`       // domains for which certificates are requested
+	Email        string   `toml:"email"`         // contact email of the ACME account
+	DirectoryURL string   `toml:"directory_url"` // directory of the ACME server, Let's Encrypt if empty
+	CAFile       string   `toml:"ca_file"`       // CA of the ACME server if not publicly trusted (ex: Pebble)
+	HTTPAddr     string   `toml:"http_addr"`     // Address of the http listener for the HTTP-01 challenges, empty to disable it
+	Redirect     bool     `toml:"redirect"`      // Whether the http listener redirects the other requests to https
+}
+
+// Authentication with an OpenID Connect provider, for the browsers
+// (login) and the API calls (bearer tokens).
+type OIDCConfig struct {
+	Enabled       bool     `toml:"enabled"`
+	Issuer        string   `toml:"issuer"`         // URL of the provider, its configuration is discovered from it
+	ClientID      string   `toml:"client_id"`      // client of upd at the provider
+	ClientSecret  string   `toml:"client_secret"`  // secret of the client
+	RedirectURL   string   `toml:"redirect_url"`   // public URL of the callback: https://host/route/oidc/callback
+	Scopes        []string `toml:"scopes"`         // requested scopes, openid, profile and email if empty
+	Audience      string   `toml:"audience"`       // expected audience of the bearer tokens, the client id if empty
+	UserClaim     string   `toml:"user_claim"`     // claim naming the user, email if empty
+	GroupsClaim   string   `toml:"groups_claim"`   // claim listing the groups of the user, groups if empty
+	AllowedGroups []string `toml:"allowed_groups"` // groups allowed to use the API, see also allowed_identities
+	SessionKey    string   `toml:"session_key"`    // key signing the session cookies, random on every start if empty
+	SessionTTL    string   `toml:"session_ttl"`    // lifetime of the sessions, 12h if empty
+}
+
+// Endpoint receiving the events on the files.
+type WebhookConfig struct {
+	URL         string   `toml:"url"`
+	Secret      string   `toml:"secret"`       // key signing the payloads, in the X-upd-Signature header
+	Events      []string `toml:"events"`       // upload, first_download, delete and/or expire, all if empty
+	MaxAttempts int      `toml:"max_attempts"` // attempts before abandoning a delivery, 10 if 0
+}
+
+// ReadConfigFile reads the configuration file, the missing values
+// being set to their default. The default configuration is returned
+// with the error if the file can't be read.
+func ReadConfigFile(filename string) (Config, error) {
+	// default hardcoded config when no configuration file is available
+	config := Config{
+		Addr:       ":9000",
+		Storage:    "fs",
+		RuntimeDir: "/tmp",
+		FSConfig: FSConfig{
+			OutputDirectory: "/tmp",
+		},
+		Route:            "/upd",
+		MetricsRoute:     "/metrics",
+		ThumbnailMaxSize: DEFAULT_THUMBNAIL_MAX_SIZE,
+		ACMEConfig: ACMEConfig{
+			HTTPAddr: ":80",
+			Redirect: true,
+		},
+	}
+
+	// read the file
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+
+	// decode the file
+	_, err = toml.Decode(string(data), &config)
+	if err != nil {
+		return config, err
+	}
+
+	// Ensure the validity of the config
+	if len(config.Route) == 0 || config.Route[0] != '/' {
+		config.Route = "/" + config.Route
+	}
+	if config.Route[len(config.Route)-1] == '/' {
+		config.Route = config.Route[:len(config.Route)-1]
+	}
+
+	return config, nil
+}
+
+// ValidateConfig checks that the configuration can be used.
+func ValidateConfig(config Config) error {
+	if len(config.AuditRetention) > 0 {
+		if d, err := time.ParseDuration(config.AuditRetention); err != nil {
+			return fmt.Errorf("invalid retention of the audit log: %v", err)
+		} else if d <= 0 {
+			return fmt.Errorf("the retention of the audit log must be positive")
+		}
+	}
+	if len(config.BackupConfig.Interval) > 0 {
+		if d, err := time.ParseDuration(config.BackupConfig.Interval); err != nil {
+			return fmt.Errorf("invalid interval of the backups: %v", err)
+		} else if d <= 0 {
+			return fmt.Errorf("the interval of the backups must be positive")
+		}
+	}
+	if len(config.BackupConfig.Directory) > 0 {
+		if err := CheckBackupConfig(config); err != nil {
+			return err
+		}
+	}
+
+	switch config.MetadataStore {
+	case "", BOLT_STORE:
+	case SQLITE_STORE, POSTGRES_STORE:
+		if len(config.SQLConfig.DSN) == 0 {
+			return fmt.Errorf("the %s metadata store requires a dsn", config.MetadataStore)
+		}
+	default:
+		return fmt.Errorf("unknown metadata store: %s", config.MetadataStore)
+	}
+
+	switch config.Storage {
+	case FS_STORAGE, S3_STORAGE:
+	case TIERED_STORAGE:
+		return validateTieredConfig(config.TieredConfig)
+	case REPLICATED_STORAGE:
+		return validateReplicasConfig(config)
+	default:
+		return fmt.Errorf("unknown storage: %s", config.Storage)
+	}
+	return nil
+}
+
+// validateTieredConfig checks the storages and the policy
+// of the tiered storage.
+func validateTieredConfig(config TieredConfig) error {
+	for _, storage := range []string{config.Hot, config.Cold} {
+		if storage != FS_STORAGE && storage != S3_STORAGE {
+			return fmt.Errorf("unknown storage for the tiered storage: %s", storage)
+		}
+	}
+	if config.Hot == config.Cold {
+		return fmt.Errorf("the hot and cold storages must be different")
+	}
+
+	policy, err := config.policy()
+	if err != nil {
+		return err
+	}
+	if policy.demoteAfter == 0 && policy.demoteUnusedAfter == 0 {
+		return fmt.Errorf("the tiered storage requires demote_after and/or demote_unused_after")
+	}
+
+	if len(config.Interval) > 0 {
+		if d, err := time.ParseDuration(config.Interval); err != nil {
+			return fmt.Errorf("invalid interval of the tier job: %v", err)
+		} else if d <= 0 {
+			return fmt.Errorf("the interval of the tier job must be positive")
+		}
+	}
+	return nil
+}
+
+// validateReplicasConfig checks the replicas of the
+// replicated storage.
+func validateReplicasConfig(config Config) error {
+	if len(config.Replicas) < 2 {
+		return fmt.Errorf("the replicated storage requires at least 2 replicas")
+	}
+
+	names := make(map[string]bool)
+	for _, replica := range config.Replicas {
+		if len(replica.Name) == 0 {
+			return fmt.Errorf("the replicas must be named")
+		}
+		if names[replica.Name] {
+			return fmt.Errorf("many replicas named %s", replica.Name)
+		}
+		names[replica.Name] = true
+
+		if replica.Storage != FS_STORAGE && replica.Storage != S3_STORAGE {
+			return fmt.Errorf("unknown storage for the replica %s: %s", replica.Name, replica.Storage)
+		}
+	}
+
+	if config.Replication.MinWrites < 0 || config.Replication.MinWrites > len(config.Replicas) {
+		return fmt.Errorf("min_writes must be between 1 and the number of replicas")
+	}
+
+	if len(config.Replication.RepairInterval) > 0 {
+		if d, err := time.ParseDuration(config.Replication.RepairInterval); err != nil {
+			return fmt.Errorf("invalid interval of the repair job: %v", err)
+		} else if d <= 0 {
+			return fmt.Errorf("the interval of the repair job must be positive")
+		}
+	}
+	return nil
 }
@@ -10,9 +10,10 @@ type CorsHandler struct {
 
 func (c *CorsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	headers := w.Header()
-	headers.Set("Allow", "GET, POST, OPTIONS")
+	headers.Set("Allow", "GET, POST, DELETE, OPTIONS")
+	// the CSRF header must never be allowed
 	headers.Set("Access-Control-Allow-Headers", "Content-Type, Accept, X-upd-key")
-	headers.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	headers.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 	headers.Set("Access-Control-Allow-Origin", "*")
 
 	if r.Method == "OPTIONS" {
@@ -4,7 +4,6 @@
 package server
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -29,7 +28,7 @@ func (s *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Existing file ?
 	entry, err := s.Server.GetEntry(id)
 	if err != nil {
-		log.Println("Can't use the database:", err.Error())
+		s.Server.logger(r).Error("Can't use the database", "err", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -38,46 +37,32 @@ func (s *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// checks that the key is correct
+	// the delete key is enough, as in the delete links. The owner of
+	// the file doesn't need it but must send a POST or a DELETE.
 	if entry.DeleteKey != key {
-		w.WriteHeader(403)
-		return
+		if !s.Server.isOwner(r, *entry) {
+			s.Server.audit(r, AUDIT_AUTH_FAILURE, entry, "invalid delete key")
+			w.WriteHeader(403)
+			return
+		}
+		if r.Method != "POST" && r.Method != "DELETE" {
+			w.Header().Set("Allow", "POST, DELETE")
+			w.WriteHeader(405)
+			return
+		}
 	}
 
 	// deletes the file
 	err = s.Server.Expire(*entry)
 	if err != nil {
-		log.Println("[err] While deleting the entry:", entry.Filename)
-		log.Println(err)
-		w.WriteHeader(500)
-		return
-	}
-
-	// we must remove the line from the LastUploaded
-	lastUploaded, err := s.Server.GetLastUploaded()
-	if err != nil {
-		log.Println("[err] Can't retrieve the last uploaded when deleting.")
+		s.Server.logger(r).Error("Can't delete the file", "file", entry.Filename, "err", err)
 		w.WriteHeader(500)
 		return
 	}
 
-	lastUploaded = s.removeFromLastUploaded(lastUploaded, id)
-
-	s.Server.SetLastUploaded(lastUploaded)
+	s.Server.audit(r, AUDIT_DELETE, entry, "")
+	s.Server.publish(EVENT_DELETE, *entry)
 
 	w.WriteHeader(200)
 	w.Write([]byte("File deleted."))
 }
-
-func (s *DeleteHandler) removeFromLastUploaded(lastUploaded []string, id string) []string {
-	result := make([]string, 0)
-
-	for _, lu := range lastUploaded {
-		if lu == id {
-			continue
-		}
-		result = append(result, lu)
-	}
-
-	return result
-}
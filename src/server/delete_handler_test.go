@@ -0,0 +1,66 @@
+// Tests of the route deleting the files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteWithKey(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	_, file := upload(t, h, "a.txt", []byte("a"), nil, nil)
+
+	if w := get(h, "/upd/"+file.Name+"/wrongkey", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("deleted with a wrong key: status %d", w.Code)
+	}
+
+	// the delete links
+	if w := get(h, "/upd/"+file.Name+"/"+file.DeleteKey, nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if entry, _ := s.GetEntry(file.Name); entry != nil {
+		t.Fatal("the file isn't deleted")
+	}
+}
+
+func TestDeleteAsOwner(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "secret"
+	})
+
+	_, file := upload(t, h, "a.txt", []byte("a"), nil, map[string]string{SECRET_KEY_HEADER: "secret"})
+	err := s.Metadata.Update(file.Name, func(m *Metadata) bool {
+		m.Owner = "alice@example.com"
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// identified as the owner by a session
+	s.oidc = &oidcAuth{sessionKey: []byte("key")}
+	cookie, err := s.oidc.encode(oidcSession{Name: "alice@example.com", Expiration: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := func(csrf bool) map[string]string {
+		headers := map[string]string{"Cookie": SESSION_COOKIE + "=" + cookie}
+		if csrf {
+			headers[CSRF_HEADER] = "1"
+		}
+		return headers
+	}
+
+	if w := get(h, "/upd/"+file.Name+"/owner", session(true)); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("deleted by the owner with a GET: status %d", w.Code)
+	}
+	if w := post(h, "/upd/"+file.Name+"/owner", session(false)); w.Code != http.StatusForbidden {
+		t.Fatalf("deleted by the owner without the CSRF header: status %d", w.Code)
+	}
+	if w := post(h, "/upd/"+file.Name+"/owner", session(true)); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+// Free space of a directory, unsupported on this platform.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
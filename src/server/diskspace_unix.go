@@ -0,0 +1,19 @@
+//go:build unix
+
+// Free space of a directory on Unix systems.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the amount of bytes available to
+// the server in the filesystem containing the directory.
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,125 @@
+// Events on the hosted files, notified to the webhooks and
+// to the subscribers of the in-process event bus.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_UPLOAD         = "upload"
+	EVENT_FIRST_DOWNLOAD = "first_download"
+	EVENT_DELETE         = "delete"
+	EVENT_EXPIRE         = "expire"
+
+	EVENT_BUS_BUFFER = 64
+)
+
+// Event on a hosted file.
+type Event struct {
+	Id   string    `json:"id"`
+	Type string    `json:"type"` // upload, first_download, delete or expire
+	Time time.Time `json:"time"`
+	File EventFile `json:"file"`
+}
+
+// EventFile describes the file of an event.
+type EventFile struct {
+	Filename       string    `json:"filename"`
+	Original       string    `json:"original"`
+	Tags           []string  `json:"tags"`
+	Size           int64     `json:"size"`
+	ContentType    string    `json:"content_type"`
+	SHA256         string    `json:"sha256"`
+	Owner          string    `json:"owner,omitempty"`
+	CreationTime   time.Time `json:"creation_time"`
+	ExpirationTime time.Time `json:"expiration_time"`
+}
+
+// publish notifies an event on the given file.
+func (s *Server) publish(eventType string, entry Metadata) {
+	event := Event{
+		Id:   randomToken(),
+		Type: eventType,
+		Time: time.Now(),
+		File: EventFile{
+			Filename:       entry.Filename,
+			Original:       entry.Original,
+			Tags:           entry.Tags,
+			Size:           entry.Size,
+			ContentType:    entry.ContentType,
+			SHA256:         entry.SHA256,
+			Owner:          entry.Owner,
+			CreationTime:   entry.CreationTime,
+			ExpirationTime: entry.ExpirationTime,
+		},
+	}
+
+	s.enqueueWebhooks(event)
+	s.events.Publish(event)
+}
+
+// EventBus dispatches the events to the subscribers of the process.
+type EventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]bool)}
+}
+
+// Subscribe returns a channel receiving the events, closed when the bus
+// is closed. A subscriber too slow to read its events loses them.
+func (b *EventBus) Subscribe() chan Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := make(chan Event, EVENT_BUS_BUFFER)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+
+	b.subscribers[ch] = true
+	return ch
+}
+
+// Unsubscribe stops sending the events to the channel.
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends the event to every subscriber, without blocking.
+func (b *EventBus) Publish(event Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of every subscriber.
+func (b *EventBus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = make(map[chan Event]bool)
+	b.closed = true
+}
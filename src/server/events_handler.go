@@ -0,0 +1,90 @@
+// Route streaming the events with Server-Sent Events.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SSE_HEARTBEAT = 30 * time.Second
+)
+
+// EventsHandler streams the events on the files as they happen,
+// optionally filtered by tags and types.
+type EventsHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (e *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthValid(e.Server, r) {
+		w.WriteHeader(403)
+		return
+	}
+
+	tags := readTagsParam(r)
+
+	var types []string
+	if len(r.Form.Get("types")) > 0 {
+		types = strings.Split(r.Form.Get("types"), ",")
+	}
+
+	controller := http.NewResponseController(w)
+
+	events := e.Server.events.Subscribe()
+	defer e.Server.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	w.WriteHeader(200)
+	if err := controller.Flush(); err != nil {
+		e.Server.logger(r).Error("Can't stream the events", "err", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// keeps the connection opened through the proxies
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// the server is stopping
+				return
+			}
+
+			if len(tags) > 0 && !stringArrayContainsOne(event.File.Tags, tags) {
+				continue
+			}
+			if len(types) > 0 && !stringArrayContainsOne([]string{event.Type}, types) {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				e.Server.logger(r).Error("Can't marshal an event", "err", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data); err != nil {
+				return
+			}
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Tests of the stream of the events.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventsStream(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "secret"
+	})
+	headers := map[string]string{SECRET_KEY_HEADER: "secret"}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	if w := get(h, "/upd/1.0/events", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("without the key: status %d", w.Code)
+	}
+
+	r, _ := http.NewRequest("GET", server.URL+"/upd/1.0/events?tags=work&types=upload,delete", nil)
+	r.Header.Set(SECRET_KEY_HEADER, "secret")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// filtered out by the tags, then by the type of the first download
+	upload(t, h, "other.txt", []byte("other"), map[string]string{"tags": "home"}, headers)
+	w, response := upload(t, h, "notes.txt", []byte("some notes"), map[string]string{"tags": "work"}, headers)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	get(h, "/upd/"+response.Name, nil)
+
+	// ends the stream
+	s.events.Close()
+
+	var events []Event
+	var event Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			event = Event{}
+			event.Id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatal(err)
+			}
+			if data.Id != event.Id || data.Type != event.Type {
+				t.Errorf("the fields don't match the data: %+v, %+v", event, data)
+			}
+			events = append(events, data)
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if events[0].Type != EVENT_UPLOAD || events[0].File.Filename != response.Name || events[0].File.Original != "notes.txt" {
+		t.Errorf("unexpected event %+v", events[0])
+	}
+}
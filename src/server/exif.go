@@ -0,0 +1,157 @@
+// Reading of the EXIF orientation of the images.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+const (
+	EXIF_ORIENTATION_TAG = 0x0112
+)
+
+// jpegOrientation reads the EXIF orientation (from 1 to 8) of the
+// given JPEG image. 1, the normal orientation, is returned when
+// the image doesn't contain any orientation information.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+
+		// fill byte
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		// markers without any payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			i += 2
+			continue
+		}
+
+		// start of scan or end of image: no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag in the first IFD
+// of the given TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) != EXIF_ORIENTATION_TAG {
+			continue
+		}
+
+		// SHORT value stored in the first bytes of the value field
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+
+	return 1
+}
+
+// orientationSwapsSides returns whether applying the given orientation
+// swaps the width and the height of the image.
+func orientationSwapsSides(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// applyOrientation transforms the image so it is displayed
+// as described by the given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if orientationSwapsSides(orientation) {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2: // mirror horizontal
+				dx = w - 1 - x
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dy = h - 1 - y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 CW
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 CW
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return dst
+}
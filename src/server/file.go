@@ -4,183 +4,50 @@
 package server
 
 import (
-	"bytes"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"io"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-func (s *Server) createS3Config(creds *credentials.Credentials, region string) *aws.Config {
-	return &aws.Config{
-		Credentials: creds,
-		Region:      &region,
-	}
+// WriteFile writes the file in the storage.
+func (s *Server) WriteFile(filename string, data []byte) (err error) {
+	defer func() { s.countStorageError("write", err) }()
+	return s.recordReplicas(filename, "write", s.backend.Write(filename, data))
 }
 
-// writeFile deals with writing the file, using the flags
-// to know where and the filename / data to store it.
-func (s *Server) WriteFile(filename string, data []byte) error {
-	if s.Config.Storage == FS_STORAGE {
-		fi, err := os.Stat(s.Config.FSConfig.OutputDirectory)
-		if err != nil && !os.IsNotExist(err) {
-			log.Println("[err] Error while stat'ing the output directory ", s.Config.FSConfig.OutputDirectory)
-			return err
-		}
-
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(s.Config.FSConfig.OutputDirectory, 0755)
-			if err != nil {
-				log.Println("[err] Error while creating the output directory", s.Config.FSConfig.OutputDirectory)
-				return err
-			}
-		}
-
-		if fi != nil && !fi.IsDir() {
-			return fmt.Errorf("%s is not a directory", s.Config.FSConfig.OutputDirectory)
-		}
-
-		file, err := os.Create(s.Config.FSConfig.OutputDirectory + "/" + filename)
-		if err != nil {
-			log.Println("[err] Can't create the file to write: ", filename)
-			return err
-		}
-
-		_, err = file.Write(data)
-		if err != nil {
-			log.Println("[err] Can't write the file to write: ", filename)
-			return err
-		}
-
-		err = file.Close()
-		if err != nil {
-			log.Println("[err] Can't close the file to write: ", filename)
-			return err
-		}
-		return nil
-	} else if s.Config.Storage == S3_STORAGE {
-		// S3 connection
-		creds := credentials.NewStaticCredentials(s.Config.S3Config.AccessKey, s.Config.S3Config.AccessSecret, "")
-		sess := session.New(&aws.Config{
-			Credentials: creds,
-			Region:      aws.String(s.Config.S3Config.Region),
-		})
-		client := s3.New(sess)
-		body := bytes.NewReader(data)
-
-		contentLength := int64(len(data))
-
-		// Creates the S3 put request
-		por := &s3.PutObjectInput{
-			Body:          body,
-			Key:           aws.String(filename),
-			ContentLength: &contentLength,
-			Bucket:        aws.String(s.Config.S3Config.Bucket),
-		}
-
-		// Sends the S3 put request
-		_, err := client.PutObject(por)
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-
-	return fmt.Errorf("[err] Unsupported storage: %s", s.Config.Storage)
+// ReadFile reads the whole file from the storage.
+func (s *Server) ReadFile(filename string) (data []byte, err error) {
+	defer func() { s.countStorageError("read", err) }()
+	return s.backend.Read(filename)
 }
 
-// readFile is the method to read the file from wherever it
-// is stored. The serverFlags are used to know where to read,
-// the filename is used to know what to read.
-func (s *Server) ReadFile(filename string) ([]byte, error) {
-	if s.Config.Storage == FS_STORAGE {
-		file, err := os.Open(s.Config.FSConfig.OutputDirectory + "/" + filename)
-		if err != nil {
-			return nil, err
-		}
-
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			return nil, err
-		}
-
-		return data, nil
-	} else if s.Config.Storage == S3_STORAGE {
-		// S3 connection
-		creds := credentials.NewStaticCredentials(s.Config.S3Config.AccessKey, s.Config.S3Config.AccessSecret, "")
-		sess := session.New(&aws.Config{
-			Credentials: creds,
-			Region:      aws.String(s.Config.S3Config.Region),
-		})
-		client := s3.New(sess)
-
-		// The get request
-		gor := &s3.GetObjectInput{
-			Key:    aws.String(filename),
-			Bucket: aws.String(s.Config.S3Config.Bucket),
-		}
-
-		// Sends the request
-		resp, err := client.GetObject(gor)
-		if err != nil {
-			return nil, err
-		}
-
-		// Reads the result
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("[err] Can't read the body of a GetObjectOutput from AWS")
-			log.Println(err)
-			return nil, err
-		}
-
-		return data, nil
-	}
-
-	return nil, fmt.Errorf("[err] Unsupported storage: %s", s.Config.Storage)
+// OpenFile opens the file from the storage to read it without
+// loading it entirely in memory. The caller must close it.
+func (s *Server) OpenFile(filename string) (file io.ReadCloser, err error) {
+	defer func() { s.countStorageError("read", err) }()
+	return s.backend.Open(filename)
 }
 
 // Expire expires a file : delete it from the metadata
-// and from the FS.
+// and from the FS, with its thumbnails.
 func (s *Server) Expire(m Metadata) error {
 	filename := m.Filename
 
 	// delete from the datbase
 	s.deleteMetadata(filename)
 
-	if s.Config.Storage == FS_STORAGE {
-		return os.Remove(filepath.Join(s.Config.FSConfig.OutputDirectory, filename))
-	} else if s.Config.Storage == S3_STORAGE {
-		// S3 connection
-		creds := credentials.NewStaticCredentials(s.Config.S3Config.AccessKey, s.Config.S3Config.AccessSecret, "")
-		sess := session.New(&aws.Config{
-			Credentials: creds,
-			Region:      aws.String(s.Config.S3Config.Region),
-		})
-		client := s3.New(sess)
-
-		// The get request
-		dor := &s3.DeleteObjectInput{
-			Key:    aws.String(filename),
-			Bucket: aws.String(s.Config.S3Config.Bucket),
+	for _, thumbnail := range m.Thumbnails {
+		if err := s.deleteFile(thumbnail); err != nil {
+			s.Log.Warn("Can't delete the thumbnail", "file", filename, "thumbnail", thumbnail, "err", err)
 		}
-
-		_, err := client.DeleteObject(dor)
-		if err != nil {
-			return err
-		}
-
-		return nil
 	}
 
-	return fmt.Errorf("[err] Unsupported storage: %s", s.Config.Storage)
+	return s.deleteFile(filename)
+}
+
+// deleteFile deletes the file from the storage.
+func (s *Server) deleteFile(filename string) (err error) {
+	defer func() { s.countStorageError("delete", err) }()
+	return s.recordReplicas(filename, "delete", s.backend.Delete(filename))
 }
 
 // computeEndOfLife return as a string the end of life of the new file.
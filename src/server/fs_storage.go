@@ -0,0 +1,303 @@
+// Storage of the files in a directory of the filesystem.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// FS_TEMP_DIR is the directory, in the output directory, in which the
+	// files are written before being moved to their place. It is on the same
+	// filesystem for the move to be atomic, and emptied on startup.
+	FS_TEMP_DIR = ".tmp"
+)
+
+// errFreeSpaceUnsupported is returned when the free space
+// can't be read on this platform.
+var errFreeSpaceUnsupported = errors.New("free space not supported on this platform")
+
+// FSStorage stores the files in a directory, sharded by the first characters
+// of their name (abcdef12 in ab/cd/abcdef12). The files stored before the
+// sharding, at the root of the directory, are still read from there.
+type FSStorage struct {
+	Config FSConfig
+}
+
+func NewFSStorage(config FSConfig) *FSStorage {
+	return &FSStorage{Config: config}
+}
+
+// path returns the path of the file in the sharded layout.
+func (f *FSStorage) path(name string) string {
+	if len(name) < 4 {
+		return f.flatPath(name)
+	}
+	return filepath.Join(f.Config.OutputDirectory, name[0:2], name[2:4], name)
+}
+
+// flatPath returns the path of the file stored before the sharding.
+func (f *FSStorage) flatPath(name string) string {
+	return filepath.Join(f.Config.OutputDirectory, name)
+}
+
+func (f *FSStorage) Write(name string, data []byte) error {
+	dir := f.Config.OutputDirectory
+
+	fi, err := os.Stat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't stat the output directory: %v", err)
+	}
+
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("can't create the output directory: %v", err)
+		}
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	path := f.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("can't create the shard directory: %v", err)
+	}
+
+	// written aside then moved, the file is never
+	// read partially written
+	tempDir := filepath.Join(dir, FS_TEMP_DIR)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("can't create the temporary directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(tempDir, name+"-*")
+	if err != nil {
+		return err
+	}
+
+	if err := writeSync(file, data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if os.IsNotExist(err) {
+		// the shard directory, emptied, has been removed by a deletion
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = os.Rename(file.Name(), path)
+		}
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// the rename itself must be persisted, not
+	// supported on every platform
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	// a file of the same name stored before the sharding
+	// is replaced, it would otherwise be listed twice
+	if flat := f.flatPath(name); flat != path {
+		os.Remove(flat)
+	}
+
+	return nil
+}
+
+// writeSync writes the data in the file and flushes it to the disk.
+func writeSync(file *os.File, data []byte) error {
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *FSStorage) Read(name string) ([]byte, error) {
+	data, err := os.ReadFile(f.path(name))
+	if os.IsNotExist(err) {
+		return os.ReadFile(f.flatPath(name))
+	}
+	return data, err
+}
+
+func (f *FSStorage) Open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(name))
+	if os.IsNotExist(err) {
+		return os.Open(f.flatPath(name))
+	}
+	return file, err
+}
+
+// Delete deletes the file from the shards and from the root of the
+// output directory, where it may have been stored before the sharding.
+func (f *FSStorage) Delete(name string) error {
+	path := f.path(name)
+	err := os.Remove(path)
+	if err == nil {
+		f.removeEmptyShards(path)
+	}
+
+	flat := f.flatPath(name)
+	if flat == path {
+		return err
+	}
+
+	flatErr := os.Remove(flat)
+	switch {
+	case err == nil && os.IsNotExist(flatErr):
+		return nil
+	case os.IsNotExist(err):
+		return flatErr
+	case err != nil:
+		return err
+	}
+	return flatErr
+}
+
+// removeEmptyShards removes the shard directories of the
+// path, the ones which are empty.
+func (f *FSStorage) removeEmptyShards(path string) {
+	dir := filepath.Dir(path)
+	for i := 0; i < 2; i++ {
+		// fails if the directory isn't empty
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// ModTime returns the modification time of the file.
+func (f *FSStorage) ModTime(name string) (time.Time, error) {
+	fi, err := os.Stat(f.path(name))
+	if os.IsNotExist(err) {
+		fi, err = os.Stat(f.flatPath(name))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// List lists the files of the shards and the ones stored before the
+// sharding. Only the files named like the ones stored by upd are
+// listed, the output directory may contain other files.
+func (f *FSStorage) List() ([]string, error) {
+	var names []string
+
+	root := filepath.Clean(f.Config.OutputDirectory)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if strings.HasPrefix(entry.Name(), ".") && path != root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// the shards are two levels deep
+		depth := 0
+		if path != root {
+			depth = strings.Count(strings.TrimPrefix(path, root), string(filepath.Separator))
+		}
+		if entry.IsDir() {
+			if depth > 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := entry.Name()
+		switch {
+		case !isStoredName(name):
+		case depth == 1, depth == 3 && path == f.path(name):
+			names = append(names, name)
+		}
+		return nil
+	})
+
+	return names, err
+}
+
+// Clean deletes the temporary files left by an interrupted write.
+func (f *FSStorage) Clean() error {
+	tempDir := filepath.Join(f.Config.OutputDirectory, FS_TEMP_DIR)
+
+	entries, err := os.ReadDir(tempDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(tempDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check checks that the output directory is writable
+// and has enough free space.
+func (f *FSStorage) Check(ctx context.Context) error {
+	dir := f.Config.OutputDirectory
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".upd-healthcheck-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+
+	if f.Config.MinFreeSpace == 0 {
+		return nil
+	}
+
+	free, err := freeSpace(dir)
+	if err == errFreeSpaceUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if free < f.Config.MinFreeSpace {
+		return fmt.Errorf("%d bytes free in %s, at least %d expected", free, dir, f.Config.MinFreeSpace)
+	}
+
+	return nil
+}
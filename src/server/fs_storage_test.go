@@ -0,0 +1,71 @@
+// Tests of the storage of the files in a directory.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFSStorageFlatFile(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewFSStorage(FSConfig{OutputDirectory: dir})
+
+	// stored before the sharding
+	if err := os.WriteFile(filepath.Join(dir, "abcdefgh"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.Read("abcdefgh"); err != nil || string(data) != "old" {
+		t.Fatalf("the flat file can't be read: %q, %v", data, err)
+	}
+
+	if err := storage.Write("abcdefgh", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "abcdefgh")); !os.IsNotExist(err) {
+		t.Fatalf("the flat file isn't replaced: %v", err)
+	}
+	if names, err := storage.List(); err != nil || len(names) != 1 {
+		t.Fatalf("unexpected list %v, %v", names, err)
+	}
+	if data, err := storage.Read("abcdefgh"); err != nil || string(data) != "new" {
+		t.Fatalf("unexpected content %q, %v", data, err)
+	}
+}
+
+func TestFSStorageDelete(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewFSStorage(FSConfig{OutputDirectory: dir})
+
+	for _, name := range []string{"abcdefgh", "abcdxxxx"} {
+		if err := storage.Write(name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same file in both layouts, left by an older version
+	if err := os.WriteFile(filepath.Join(dir, "abcdefgh"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Delete("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Read("abcdefgh"); !os.IsNotExist(err) {
+		t.Fatalf("the file is still stored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ab", "cd")); err != nil {
+		t.Fatalf("a shard directory still used is removed: %v", err)
+	}
+
+	if err := storage.Delete("abcdxxxx"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ab")); !os.IsNotExist(err) {
+		t.Fatalf("the empty shard directories aren't removed: %v", err)
+	}
+
+	if err := storage.Delete("abcdxxxx"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
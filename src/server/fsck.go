@@ -0,0 +1,443 @@
+// Consistency check of the metadata and the stored files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_FSCK_GRACE is the default grace window of the repair: the
+	// orphans written more recently may be uploads whose metadata isn't
+	// stored yet, they aren't deleted.
+	DEFAULT_FSCK_GRACE = time.Hour
+)
+
+type FsckReport struct {
+	Blobs                int      `json:"blobs"`                  // files in the storage, thumbnails included
+	Files                int      `json:"files"`                  // files in the metadata
+	Orphans              []string `json:"orphans"`                // files in the storage without metadata
+	RecentOrphans        []string `json:"recent_orphans"`         // orphans written during the grace window, not deleted
+	Missing              []string `json:"missing"`                // files of the metadata missing from the storage
+	MissingThumbnails    []string `json:"missing_thumbnails"`     // thumbnails of the metadata missing from the storage
+	HashMismatches       []string `json:"hash_mismatches"`        // files whose content doesn't match their size/hash
+	DanglingLastUploaded []string `json:"dangling_last_uploaded"` // ids of the last uploaded list without metadata
+	Repairs              []string `json:"repairs"`                // repairs done, or to do in dry-run
+	Errors               []string `json:"errors"`                 // files which couldn't be checked or repaired
+}
+
+// Consistent returns whether no inconsistency has been found.
+func (r FsckReport) Consistent() bool {
+	return len(r.Orphans) == 0 && len(r.Missing) == 0 && len(r.MissingThumbnails) == 0 &&
+		len(r.HashMismatches) == 0 && len(r.DanglingLastUploaded) == 0
+}
+
+// CheckFsckConfig refuses a configuration whose fs output directory contains
+// the runtime directory, the backup directory or the audit log file: their
+// files could be taken for stored files.
+func CheckFsckConfig(config Config) error {
+	for _, output := range fsOutputDirectories(config) {
+		for _, path := range []string{config.RuntimeDir, config.BackupConfig.Directory, config.AuditLogFile} {
+			if len(path) > 0 && containsPath(output, path) {
+				return fmt.Errorf("the output directory %s contains %s, use a dedicated output directory", output, path)
+			}
+		}
+	}
+	return nil
+}
+
+// fsOutputDirectories returns the output directories
+// of the fs storages of the configuration.
+func fsOutputDirectories(config Config) []string {
+	var directories []string
+	switch config.Storage {
+	case FS_STORAGE:
+		directories = append(directories, config.FSConfig.OutputDirectory)
+	case TIERED_STORAGE:
+		if config.TieredConfig.Hot == FS_STORAGE || config.TieredConfig.Cold == FS_STORAGE {
+			directories = append(directories, config.FSConfig.OutputDirectory)
+		}
+	case REPLICATED_STORAGE:
+		for _, replica := range config.Replicas {
+			if replica.Storage == FS_STORAGE {
+				directories = append(directories, replica.FSConfig.OutputDirectory)
+			}
+		}
+	}
+	return directories
+}
+
+// containsPath returns whether the path is the directory or is in it.
+func containsPath(directory, path string) bool {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return true
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+
+	rel, err := filepath.Rel(directory, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Fsck compares the stored files with the metadata and the last
+// uploaded list, and repairs them: the orphan files are deleted, the
+// metadata of the missing files and the dangling ids are dropped. The
+// files with a wrong content are only reported.
+type Fsck struct {
+	Metadata MetadataStore
+	Storage  Storage
+	Log      *slog.Logger
+
+	Hashes bool // whether the content of the files is verified, reading all of them
+	Repair bool
+	DryRun bool          // only lists the repairs
+	Grace  time.Duration // orphans written more recently aren't deleted
+}
+
+func (f *Fsck) Run(ctx context.Context) (FsckReport, error) {
+	report := FsckReport{
+		Orphans:              make([]string, 0),
+		RecentOrphans:        make([]string, 0),
+		Missing:              make([]string, 0),
+		MissingThumbnails:    make([]string, 0),
+		HashMismatches:       make([]string, 0),
+		DanglingLastUploaded: make([]string, 0),
+		Repairs:              make([]string, 0),
+		Errors:               make([]string, 0),
+	}
+	start := time.Now()
+
+	// listed before reading the metadata, the files being
+	// uploaded meanwhile have their metadata
+	blobs, err := f.Storage.List()
+	if err != nil {
+		return report, fmt.Errorf("can't list the stored files: %v", err)
+	}
+	report.Blobs = len(blobs)
+
+	stored := make(map[string]bool)
+	for _, name := range blobs {
+		stored[name] = true
+	}
+
+	entries, err := f.Metadata.Query(nil)
+	if err != nil {
+		return report, err
+	}
+	lastUploaded, err := f.Metadata.ListRecent()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(entries)
+
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		referenced[entry.Filename] = true
+		for _, thumbnail := range entry.Thumbnails {
+			referenced[thumbnail] = true
+		}
+	}
+
+	for _, name := range blobs {
+		if !referenced[name] {
+			report.Orphans = append(report.Orphans, name)
+		}
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		// uploaded during the check
+		if entry.CreationTime.After(start) {
+			continue
+		}
+
+		if !f.exists(&report, entry.Filename, stored) {
+			report.Missing = append(report.Missing, entry.Filename)
+			continue
+		}
+
+		for _, thumbnail := range entry.Thumbnails {
+			if !f.exists(&report, thumbnail, stored) {
+				report.MissingThumbnails = append(report.MissingThumbnails, thumbnail)
+			}
+		}
+
+		if f.Hashes && len(entry.SHA256) > 0 {
+			data, err := f.Storage.Read(entry.Filename)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", entry.Filename, err))
+				continue
+			}
+			hash := sha256.Sum256(data)
+			if int64(len(data)) != entry.Size || hex.EncodeToString(hash[:]) != entry.SHA256 {
+				report.HashMismatches = append(report.HashMismatches, entry.Filename)
+			}
+		}
+	}
+
+	for _, id := range lastUploaded {
+		if !referenced[id] {
+			report.DanglingLastUploaded = append(report.DanglingLastUploaded, id)
+		}
+	}
+
+	if f.Repair {
+		f.repair(ctx, &report)
+	}
+
+	return report, nil
+}
+
+// exists returns whether the file is stored. The files not listed are
+// checked again, they may have been stored after the listing. A file
+// which can't be checked is reported as an error, not as missing.
+func (f *Fsck) exists(report *FsckReport, name string, stored map[string]bool) bool {
+	if stored[name] {
+		return true
+	}
+
+	file, err := f.Storage.Open(name)
+	if err == nil {
+		file.Close()
+		return true
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", name, err))
+		return true
+	}
+	return false
+}
+
+func (f *Fsck) repair(ctx context.Context, report *FsckReport) {
+	for _, name := range report.Orphans {
+		if ctx.Err() != nil {
+			return
+		}
+		// its metadata may have been stored since the check
+		if f.referenced(name) {
+			continue
+		}
+		if recent, err := f.recent(name); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", name, err))
+			}
+			continue
+		} else if recent {
+			report.RecentOrphans = append(report.RecentOrphans, name)
+			continue
+		}
+		f.apply(report, "delete the orphan file "+name, func() error {
+			return f.Storage.Delete(name)
+		})
+	}
+
+	for _, id := range report.Missing {
+		f.apply(report, "drop the metadata of the missing file "+id, func() error {
+			return f.dropMetadata(id)
+		})
+	}
+
+	for _, thumbnail := range report.MissingThumbnails {
+		f.apply(report, "drop the missing thumbnail "+thumbnail, func() error {
+			return f.dropThumbnail(thumbnail)
+		})
+	}
+
+	if len(report.DanglingLastUploaded) > 0 {
+		f.apply(report, fmt.Sprintf("remove %d dangling ids from the last uploaded list", len(report.DanglingLastUploaded)), func() error {
+			return f.cleanLastUploaded(report.DanglingLastUploaded)
+		})
+	}
+}
+
+// apply applies the repair, or only lists it in dry-run.
+func (f *Fsck) apply(report *FsckReport, repair string, do func() error) {
+	if f.DryRun {
+		report.Repairs = append(report.Repairs, repair)
+		return
+	}
+
+	if err := do(); err != nil {
+		f.Log.Error("Can't repair", "repair", repair, "err", err)
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", repair, err))
+		return
+	}
+
+	f.Log.Info("Repaired", "repair", repair)
+	report.Repairs = append(report.Repairs, repair)
+}
+
+// recent returns whether the file has been written during the grace
+// window. A file whose write time is unknown is never deleted.
+func (f *Fsck) recent(name string) (bool, error) {
+	if f.Grace <= 0 {
+		return false, nil
+	}
+
+	modTimer, ok := f.Storage.(ModTimer)
+	if !ok {
+		return true, nil
+	}
+	modTime, err := modTimer.ModTime(name)
+	if err != nil {
+		return false, err
+	}
+	return time.Since(modTime) < f.Grace, nil
+}
+
+// thumbnailOwner returns the id of the file of a thumbnail,
+// the name itself if it isn't a thumbnail.
+func thumbnailOwner(name string) string {
+	if id, _, found := strings.Cut(name, ".thumb."); found {
+		return id
+	}
+	return name
+}
+
+// referenced returns whether the file is referenced in the metadata.
+func (f *Fsck) referenced(name string) bool {
+	id := thumbnailOwner(name)
+	metadata, err := f.Metadata.Get(id)
+	if err != nil || metadata == nil {
+		return false
+	}
+	if id == name {
+		return true
+	}
+
+	for _, thumbnail := range metadata.Thumbnails {
+		if thumbnail == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dropMetadata deletes the metadata of the file, its
+// thumbnails being deleted from the storage.
+func (f *Fsck) dropMetadata(id string) error {
+	metadata, err := f.Metadata.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Metadata.Delete(id); err != nil {
+		return err
+	}
+
+	if metadata != nil {
+		for _, thumbnail := range metadata.Thumbnails {
+			f.Storage.Delete(thumbnail)
+		}
+	}
+	return nil
+}
+
+// dropThumbnail removes the thumbnail from the metadata of its file.
+func (f *Fsck) dropThumbnail(name string) error {
+	return f.Metadata.Update(thumbnailOwner(name), func(m *Metadata) bool {
+		var thumbnails []string
+		for _, thumbnail := range m.Thumbnails {
+			if thumbnail != name {
+				thumbnails = append(thumbnails, thumbnail)
+			}
+		}
+		m.Thumbnails = thumbnails
+		return true
+	})
+}
+
+// cleanLastUploaded removes the ids without metadata
+// from the last uploaded list.
+func (f *Fsck) cleanLastUploaded(ids []string) error {
+	for _, id := range ids {
+		// deleting the metadata removes the id from the list
+		if err := f.Metadata.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FsckHandler lets the administrators check the consistency of the
+// metadata and the storage, and repair it with a POST.
+type FsckHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (s *FsckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(s.Server, r) {
+		s.Server.audit(r, AUDIT_AUTH_FAILURE, nil, "fsck")
+		w.WriteHeader(403)
+		return
+	}
+
+	query := r.URL.Query()
+	repair := query.Get("repair") == "true"
+	if repair && r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	grace := DEFAULT_FSCK_GRACE
+	if value := query.Get("grace"); len(value) > 0 {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		grace = d
+	}
+
+	logger := s.Server.logger(r)
+	if err := CheckFsckConfig(s.Server.Config); err != nil {
+		logger.Error("Can't check the consistency of the storage", "err", err)
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	fsck := &Fsck{
+		Metadata: s.Server.Metadata,
+		Storage:  s.Server.backend,
+		Log:      logger,
+		Hashes:   query.Get("hashes") != "false",
+		Repair:   repair,
+		DryRun:   query.Get("dry_run") == "true",
+		Grace:    grace,
+	}
+
+	report, err := fsck.Run(r.Context())
+	if err != nil {
+		logger.Error("Can't check the consistency of the storage", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		logger.Error("Can't marshal the fsck report", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,100 @@
+// Tests of the consistency check.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestBoltStore returns a metadata store in
+// a new database, with the buckets of the server.
+func newTestBoltStore(t *testing.T) (*bolt.DB, *BoltStore) {
+	db, err := OpenDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{METADATA_BUCKET, COLLECTIONS_BUCKET, "Runtime", "Config"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, NewBoltStore(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestFsckRepairGrace(t *testing.T) {
+	_, metadata := newTestBoltStore(t)
+
+	storage := NewFSStorage(FSConfig{OutputDirectory: t.TempDir()})
+	for _, name := range []string{"oldorph1", "neworph1"} {
+		if err := storage.Write(name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(storage.path("oldorph1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := &Fsck{
+		Metadata: metadata,
+		Storage:  storage,
+		Log:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Repair:   true,
+		Grace:    DEFAULT_FSCK_GRACE,
+	}
+	report, err := fsck.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Orphans) != 2 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.RecentOrphans) != 1 || report.RecentOrphans[0] != "neworph1" {
+		t.Errorf("the recent orphan isn't reported: %v", report.RecentOrphans)
+	}
+	if _, err := storage.ModTime("oldorph1"); !os.IsNotExist(err) {
+		t.Errorf("the old orphan isn't deleted: %v", err)
+	}
+	if _, err := storage.ModTime("neworph1"); err != nil {
+		t.Errorf("the recent orphan is deleted: %v", err)
+	}
+}
+
+func TestFsckAdminCSRF(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.AdminIdentities = []string{"admin@example.com"}
+	})
+
+	s.oidc = &oidcAuth{sessionKey: []byte("key")}
+	cookie, err := s.oidc.encode(oidcSession{Name: "admin@example.com", Expiration: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{"Cookie": SESSION_COOKIE + "=" + cookie}
+
+	// a page of another site posting to the fsck route
+	if w := post(h, "/upd/1.0/fsck?repair=true", headers); w.Code != http.StatusForbidden {
+		t.Fatalf("repair without the CSRF header: status %d", w.Code)
+	}
+
+	headers[CSRF_HEADER] = "1"
+	if w := post(h, "/upd/1.0/fsck?repair=true", headers); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+}
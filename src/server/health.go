@@ -0,0 +1,177 @@
+// Health and readiness probes.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+const (
+	HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+	CHECK_OK   = "ok"
+	CHECK_FAIL = "fail"
+)
+
+// handleProbes registers the probes of the orchestrators.
+func (s *Server) handleProbes(r *mux.Router) {
+	r.Handle("/healthz", instrument("healthz", &HealthHandler{s}))
+	r.Handle("/readyz", instrument("readyz", &ReadyHandler{s}))
+}
+
+// startHealthServer starts the plain http listener only serving the
+// probes, which can't use the main listener when it requires tls
+// or client certificates.
+func (s *Server) startHealthServer(errs chan<- error) {
+	r := mux.NewRouter()
+	s.handleProbes(r)
+
+	s.healthServer = &http.Server{
+		Addr:              s.Config.HealthAddr,
+		Handler:           r,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	s.Log.Info("Start listening for the probes", "addr", s.Config.HealthAddr)
+	go func() { errs <- s.healthServer.ListenAndServe() }()
+}
+
+// ReadyURL returns the url of the readiness probe of the server of the
+// configuration, on the health listener if any, on the main one otherwise.
+func ReadyURL(config Config) string {
+	scheme, addr := "http", config.HealthAddr
+	if len(addr) == 0 {
+		addr = config.Addr
+		if config.ACMEConfig.Enabled || (len(config.CertificateFile) > 0 && len(config.CertificateKey) > 0) {
+			scheme = "https"
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return scheme + "://" + addr + "/readyz"
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + "/readyz"
+}
+
+// HealthHandler answers as long as the process is alive.
+type HealthHandler struct {
+	Server *Server
+}
+
+func (s *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// ReadyHandler checks that the server can serve the requests:
+// the database and the storage must be usable. The errors are
+// logged, and only returned to the administrators.
+type ReadyHandler struct {
+	Server *Server
+}
+
+type ReadyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *ReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	resp := ReadyResponse{
+		Status: CHECK_OK,
+		Checks: map[string]CheckResult{
+			"database": checkResult(s.Server.checkDatabase()),
+			"metadata": checkResult(s.Server.checkMetadata()),
+			"storage":  checkResult(s.Server.checkStorage(ctx)),
+		},
+	}
+
+	admin := IsAdmin(s.Server, r)
+
+	code := 200
+	for name, check := range resp.Checks {
+		if check.Status != CHECK_OK {
+			s.Server.logger(r).Warn("Readiness check failed", "check", name, "err", check.Error)
+			resp.Status = CHECK_FAIL
+			code = 503
+		}
+		if !admin {
+			check.Error = ""
+			resp.Checks[name] = check
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.Server.logger(r).Error("Can't marshal the readiness response", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func checkResult(err error) CheckResult {
+	if err != nil {
+		return CheckResult{Status: CHECK_FAIL, Error: err.Error()}
+	}
+	return CheckResult{Status: CHECK_OK}
+}
+
+// checkDatabase checks that the BoltDB file is open and still on the disk.
+// Nothing is written: a write transaction on every probe would fsync the
+// database every few seconds.
+func (s *Server) checkDatabase() error {
+	if s.Database == nil {
+		return fmt.Errorf("database not opened")
+	}
+
+	if _, err := os.Stat(s.Database.Path()); err != nil {
+		return err
+	}
+
+	return s.Database.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Runtime")) == nil {
+			return fmt.Errorf("missing bucket Runtime")
+		}
+		return nil
+	})
+}
+
+// checkMetadata checks that the metadata store can be read.
+func (s *Server) checkMetadata() error {
+	if s.Metadata == nil {
+		return fmt.Errorf("metadata store not opened")
+	}
+	return s.Metadata.Check()
+}
+
+// checkStorage checks that the storage can be used.
+func (s *Server) checkStorage(ctx context.Context) error {
+	if s.backend == nil {
+		return fmt.Errorf("storage not opened")
+	}
+	return s.backend.Check(ctx)
+}
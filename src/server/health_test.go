@@ -0,0 +1,104 @@
+// Tests of the health and readiness probes.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// lastTransaction returns the id of the last
+// write transaction of the database.
+func lastTransaction(db *bolt.DB) int {
+	var id int
+	db.View(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		return nil
+	})
+	return id
+}
+
+func TestHealthz(t *testing.T) {
+	_, h := newTestServer(t, nil)
+
+	w := get(h, "/healthz", nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}` {
+		t.Fatalf("status %d, %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	before := lastTransaction(s.Database)
+	w := get(h, "/readyz", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, %s", w.Code, w.Body.String())
+	}
+
+	var response ReadyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != CHECK_OK || len(response.Checks) != 3 {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	// the probes are frequent, they mustn't write the database
+	if after := lastTransaction(s.Database); after != before {
+		t.Errorf("the database is written: transaction %d, %d before", after, before)
+	}
+}
+
+func TestReadyzFailure(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "files")
+	s, h := newTestServer(t, func(c *Config) {
+		c.AdminKey = "admin"
+		c.FSConfig.OutputDirectory = output
+	})
+
+	// the output directory can't be created
+	if err := os.WriteFile(output, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, admin := range []bool{false, true} {
+		headers := map[string]string{}
+		if admin {
+			headers[ADMIN_KEY_HEADER] = "admin"
+		}
+
+		w := get(h, "/readyz", headers)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status %d", w.Code)
+		}
+
+		var response ReadyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		storage := response.Checks["storage"]
+		if response.Status != CHECK_FAIL || storage.Status != CHECK_FAIL || response.Checks["database"].Status != CHECK_OK {
+			t.Errorf("unexpected response %+v", response)
+		}
+		// the errors are only returned to the administrators
+		if (len(storage.Error) > 0) != admin {
+			t.Errorf("admin %v: unexpected error %q", admin, storage.Error)
+		}
+	}
+
+	// the database file is removed
+	if err := os.Remove(s.Database.Path()); err != nil {
+		t.Fatal(err)
+	}
+	var response ReadyResponse
+	json.Unmarshal(get(h, "/readyz", nil).Body.Bytes(), &response)
+	if response.Checks["database"].Status != CHECK_FAIL {
+		t.Errorf("unexpected response %+v", response)
+	}
+}
@@ -0,0 +1,137 @@
+// Identity of the authenticated users.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+const (
+	CLIENT_AUTH_NONE     = "none"
+	CLIENT_AUTH_OPTIONAL = "optional"
+	CLIENT_AUTH_REQUIRE  = "require"
+
+	// sent by the owners authenticated by a client certificate
+	// or an OIDC session to delete their files without the key
+	CSRF_HEADER = "X-upd-csrf"
+)
+
+// Identity of a user.
+type Identity struct {
+	Name   string   // email, DNS name or common name of the client certificate, or OIDC user claim
+	Groups []string // groups of the user, given by the OIDC provider
+	Source string   // where the identity comes from
+}
+
+// configureClientAuth configures the verification of the client
+// certificates, signed by the configured CA, on the tls listener.
+func (s *Server) configureClientAuth(config *tls.Config) error {
+	switch s.Config.ClientAuth {
+	case "", CLIENT_AUTH_NONE:
+		return nil
+	case CLIENT_AUTH_OPTIONAL:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client_auth: %s", s.Config.ClientAuth)
+	}
+
+	pem, err := os.ReadFile(s.Config.ClientCAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", s.Config.ClientCAFile)
+	}
+	config.ClientCAs = pool
+
+	return nil
+}
+
+// identity returns the identity of the user who sent the request,
+// nil if the user is anonymous: from its client certificate, its
+// OIDC bearer token or its OIDC session.
+func (s *Server) identity(r *http.Request) *Identity {
+	// only the verified certificates are used
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return certificateIdentity(r.TLS.VerifiedChains[0][0])
+	}
+
+	if s.oidc != nil {
+		return s.oidc.identity(r)
+	}
+
+	return nil
+}
+
+// certificateIdentity maps a certificate to an identity, using in order
+// its first email SAN, its first DNS SAN and its subject common name.
+func certificateIdentity(cert *x509.Certificate) *Identity {
+	switch {
+	case len(cert.EmailAddresses) > 0:
+		return &Identity{Name: cert.EmailAddresses[0], Source: "certificate email"}
+	case len(cert.DNSNames) > 0:
+		return &Identity{Name: cert.DNSNames[0], Source: "certificate dns"}
+	case len(cert.Subject.CommonName) > 0:
+		return &Identity{Name: cert.Subject.CommonName, Source: "certificate cn"}
+	}
+	return nil
+}
+
+// requiresIdentity returns whether the users are authenticated
+// by OIDC or by their client certificates.
+func (s *Server) requiresIdentity() bool {
+	clientAuth := len(s.Config.ClientAuth) > 0 && s.Config.ClientAuth != CLIENT_AUTH_NONE
+	return s.Config.OIDCConfig.Enabled || clientAuth
+}
+
+// isAllowedIdentity returns whether the identity can use the API: its name
+// must be in the allowed identities or one of its groups in the allowed groups.
+// Every identity is allowed when none is configured.
+func (s *Server) isAllowedIdentity(identity *Identity) bool {
+	config := s.currentConfig()
+	if len(config.AllowedIdentities) == 0 && len(config.OIDCConfig.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, name := range config.AllowedIdentities {
+		if name == identity.Name {
+			return true
+		}
+	}
+
+	for _, allowed := range config.OIDCConfig.AllowedGroups {
+		for _, group := range identity.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isOwner returns whether the user who sent the request owns the given file.
+func (s *Server) isOwner(r *http.Request, entry Metadata) bool {
+	identity := s.identity(r)
+	if identity == nil || len(entry.Owner) == 0 || identity.Name != entry.Owner {
+		return false
+	}
+	return isIntended(r, identity)
+}
+
+// isIntended returns whether the identity has been sent on purpose. The
+// browsers send the client certificate and the OIDC session cookie on their
+// own, even from the pages of other sites: these users must also send the
+// CSRF header, which can't be sent cross-site since it isn't allowed by the
+// CORS headers. The bearer tokens are never sent on their own.
+func isIntended(r *http.Request, identity *Identity) bool {
+	return identity.Source == "oidc token" || len(r.Header.Get(CSRF_HEADER)) > 0
+}
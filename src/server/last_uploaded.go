@@ -4,7 +4,6 @@ package server
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 	"time"
 )
@@ -23,6 +22,10 @@ type LastUploadedResponse struct {
 	Original     string    `json:"original"`
 	DeleteKey    string    `json:"delete_key"`
 	CreationTime time.Time `json:"creation_time"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	SHA256       string    `json:"sha256"`
+	Owner        string    `json:"owner,omitempty"`
 }
 
 func (l *LastUploadedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -32,9 +35,9 @@ func (l *LastUploadedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 
 	lastUploadedResp := make([]LastUploadedResponse, 0)
-	lastUploaded, err := l.Server.GetLastUploaded()
+	lastUploaded, err := l.Server.Metadata.ListRecent()
 	if err != nil {
-		log.Println("[err] can't retrieve the last uploaded ids:", err.Error())
+		l.Server.logger(r).Error("Can't retrieve the last uploaded ids", "err", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -42,7 +45,7 @@ func (l *LastUploadedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	for _, id := range lastUploaded {
 		metadata, err := l.Server.GetEntry(id)
 		if err != nil {
-			log.Println("[err] Error while retrieving an entry in LastUploaded handler:", err.Error())
+			l.Server.logger(r).Error("Can't read a last uploaded entry", "file", id, "err", err)
 			continue
 		}
 
@@ -55,12 +58,16 @@ func (l *LastUploadedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			Original:     metadata.Original,
 			DeleteKey:    metadata.DeleteKey,
 			CreationTime: metadata.CreationTime,
+			Size:         metadata.Size,
+			ContentType:  metadata.ContentType,
+			SHA256:       metadata.SHA256,
+			Owner:        metadata.Owner,
 		})
 	}
 
 	bytes, err := json.Marshal(lastUploadedResp)
 	if err != nil {
-		log.Println("[err] Can't marshal the list of last uploaded:", err.Error())
+		l.Server.logger(r).Error("Can't marshal the list of last uploaded", "err", err)
 		w.WriteHeader(500)
 	}
 
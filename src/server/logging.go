@@ -0,0 +1,190 @@
+// Structured logging, request ids and access logs.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+
+	ACCESS_LOG_APACHE = "apache"
+	ACCESS_LOG_JSON   = "json"
+
+	REQUEST_ID_HEADER = "X-Request-Id"
+)
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+)
+
+// NewLogger creates a leveled logger writing in the given format
+// (logfmt or json) to the writer. The level is set in the given
+// variable, which can be modified later.
+func NewLogger(w io.Writer, format string, level string, levelVar *slog.LevelVar) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	levelVar.Set(lvl)
+
+	opts := &slog.HandlerOptions{Level: levelVar}
+
+	switch format {
+	case "", LOG_FORMAT_LOGFMT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+// parseLogLevel parses a log level (debug, info, warn or error),
+// info being the default.
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if len(level) > 0 {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return lvl, err
+		}
+	}
+	return lvl, nil
+}
+
+// logger returns the logger to use while handling the given
+// request, logging the id of the request.
+func (s *Server) logger(r *http.Request) *slog.Logger {
+	if id, ok := r.Context().Value(requestIdKey).(string); ok {
+		return s.Log.With("request_id", id)
+	}
+	return s.Log
+}
+
+// RequestIdHandler attributes an id to every request, or uses the one given
+// by the client/proxy, stores it in the request context and returns it
+// in a response header.
+type RequestIdHandler struct {
+	h http.Handler
+}
+
+func (h *RequestIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if len(id) == 0 || len(id) > 64 || strings.ContainsAny(id, " \t\r\n\"") {
+		id = randomString(16)
+	}
+
+	w.Header().Set(REQUEST_ID_HEADER, id)
+	h.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey, id)))
+}
+
+// AccessLogHandler writes a line in the access log, in the Apache
+// combined format or in JSON, for every request.
+type AccessLogHandler struct {
+	h      http.Handler
+	format string // apache or json
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewAccessLogHandler opens the access log file (stdout if empty) and
+// wraps the given handler to log its requests.
+func NewAccessLogHandler(h http.Handler, format string, filename string) (*AccessLogHandler, error) {
+	if format != ACCESS_LOG_APACHE && format != ACCESS_LOG_JSON {
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	var w io.Writer = os.Stdout
+	if len(filename) > 0 {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+
+	return &AccessLogHandler{h: h, format: format, w: w}, nil
+}
+
+// accessLogEntry is a line of the access log in JSON.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+}
+
+func (a *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, code: 200}
+
+	a.h.ServeHTTP(recorder, r)
+
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	var line []byte
+	if a.format == ACCESS_LOG_JSON {
+		id, _ := r.Context().Value(requestIdKey).(string)
+		line, _ = json.Marshal(accessLogEntry{
+			Time:      start,
+			RequestId: id,
+			Remote:    remote,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    recorder.code,
+			Bytes:     recorder.bytes,
+			Duration:  time.Since(start).Seconds(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %d %q %q",
+			remote,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto,
+			recorder.code,
+			recorder.bytes,
+			orDash(r.Referer()),
+			orDash(r.UserAgent()),
+		))
+	}
+
+	a.lock.Lock()
+	a.w.Write(append(line, '\n'))
+	a.lock.Unlock()
+}
+
+// orDash returns the value or "-" if empty, as in the
+// Apache logs.
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
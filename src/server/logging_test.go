@@ -0,0 +1,107 @@
+// Tests of the logs, of the request ids and of the access logs.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdAccessLog(t *testing.T) {
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	s, h := newTestServer(t, func(c *Config) {
+		c.AccessLog = ACCESS_LOG_JSON
+		c.AccessLogFile = accessLog
+	})
+
+	var logs bytes.Buffer
+	s.Log = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	// the id given by the proxy is used, in the logs of the request too
+	w, _ := upload(t, h, "notes.txt", []byte("some notes"), map[string]string{"ttl": "invalid"}, map[string]string{REQUEST_ID_HEADER: "proxy-id-1"})
+	if w.Code != http.StatusBadRequest || w.Header().Get(REQUEST_ID_HEADER) != "proxy-id-1" {
+		t.Fatalf("status %d, request id %q", w.Code, w.Header().Get(REQUEST_ID_HEADER))
+	}
+	if !strings.Contains(logs.String(), `"msg":"Invalid TTL"`) || !strings.Contains(logs.String(), `"request_id":"proxy-id-1"`) {
+		t.Errorf("the request id isn't logged: %s", logs.String())
+	}
+
+	// an invalid id is replaced
+	w = get(h, "/upd/missing1", map[string]string{REQUEST_ID_HEADER: "two words", "User-Agent": "test"})
+	id := w.Header().Get(REQUEST_ID_HEADER)
+	if w.Code != http.StatusNotFound || len(id) != 16 {
+		t.Fatalf("status %d, request id %q", w.Code, id)
+	}
+
+	data, err := os.ReadFile(accessLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected access log %q", data)
+	}
+
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.RequestId != id || entry.Method != "GET" || entry.URI != "/upd/missing1" || entry.Status != http.StatusNotFound || entry.UserAgent != "test" || entry.Remote != "192.0.2.1" {
+		t.Errorf("unexpected access log entry %+v", entry)
+	}
+}
+
+func TestApacheAccessLog(t *testing.T) {
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	_, h := newTestServer(t, func(c *Config) {
+		c.AccessLog = ACCESS_LOG_APACHE
+		c.AccessLogFile = accessLog
+	})
+
+	get(h, "/healthz", nil)
+
+	data, err := os.ReadFile(accessLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /healthz HTTP/1\.1" 200 15 "-" "-"\n$`)
+	if !line.Match(data) {
+		t.Errorf("unexpected access log %q", data)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var level slog.LevelVar
+
+	logger, err := NewLogger(&buf, LOG_FORMAT_JSON, "warn", &level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), `"msg":"shown"`) {
+		t.Errorf("unexpected logs %s", buf.String())
+	}
+
+	// the level can be changed on reload
+	level.Set(slog.LevelInfo)
+	logger.Info("now shown")
+	if !strings.Contains(buf.String(), "now shown") {
+		t.Errorf("the level isn't changed: %s", buf.String())
+	}
+
+	if _, err := NewLogger(&buf, "xml", "", &level); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if _, err := NewLogger(&buf, LOG_FORMAT_LOGFMT, "verbose", &level); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
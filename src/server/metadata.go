@@ -3,7 +3,19 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	FILEINFO_BACKFILLED_KEY = "fileinfo_backfilled"
 )
 
 type Metadata struct {
@@ -14,4 +26,138 @@ type Metadata struct {
 	ExpirationTime time.Time `json:"expiration_time"` // at which time this file should expire.
 	DeleteKey      string    `json:"delete_key"`      // The key to delete this file.
 	CreationTime   time.Time `json:"creation_time"`
+	Owner          string    `json:"owner,omitempty"`      // identity of the user who uploaded the file, if authenticated.
+	Thumbnails     []string  `json:"thumbnails,omitempty"` // names of the resized variants stored.
+
+	FirstDownloadTime time.Time `json:"first_download_time"` // when the file has been downloaded for the first time.
+	LastAccessTime    time.Time `json:"last_access_time"`    // when the file has been downloaded for the last time, with the tiered storage.
+	Tier              string    `json:"tier,omitempty"`      // tier of the tiered storage containing the file: hot (if empty) or cold.
+
+	MetadataStripped bool `json:"metadata_stripped"` // whether the EXIF/XMP/... metadata has been removed on upload.
+
+	Size        int64  `json:"size"`         // size in bytes of the stored file.
+	ContentType string `json:"content_type"` // content-type detected on upload.
+	SHA256      string `json:"sha256"`       // hex encoded SHA-256 of the stored file.
+}
+
+// setFileInfo computes and sets the size, content-type and
+// hash of the stored data.
+func (m *Metadata) setFileInfo(data []byte) {
+	hash := sha256.Sum256(data)
+
+	m.Size = int64(len(data))
+	m.ContentType = detectContentType(data, m.Original)
+	m.SHA256 = hex.EncodeToString(hash[:])
+}
+
+// detectContentType detects the content-type of the data by sniffing
+// it and, for the generic types, by looking at the extension of its
+// original name.
+func detectContentType(data []byte, original string) string {
+	sniffed := http.DetectContentType(data)
+
+	byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(original)))
+	if len(byExtension) == 0 {
+		return sniffed
+	}
+
+	// never trusted over the content: an html or svg file
+	// named x.html must not become an active document
+	if isActiveContentType(byExtension) {
+		return sniffed
+	}
+
+	// the sniffing only recognizes a few types, it doesn't
+	// make the difference between a text or a css file, a zip
+	// or a docx, etc.
+	switch {
+	case sniffed == "application/octet-stream",
+		sniffed == "application/zip",
+		strings.HasPrefix(sniffed, "text/plain"):
+		return byExtension
+	}
+
+	return sniffed
+}
+
+// isActiveContentType returns whether a browser runs the scripts
+// of a document of this content-type: html, svg, xml or javascript.
+func isActiveContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml",
+		"text/javascript", "application/javascript", "application/ecmascript", "text/ecmascript":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// updateMetadata reads the metadata of the given file, calls the function
+// to modify it and stores it back if the function returns true. Nothing is
+// done if the file doesn't exist.
+func (s *Server) updateMetadata(id string, update func(m *Metadata) bool) error {
+	return s.Metadata.Update(id, update)
+}
+
+// backfillFileInfo computes the size, content-type and hash of the files
+// uploaded before they were stored in the metadata. The files which can't
+// be read are logged and skipped, the backfill is run again on next start
+// until every file has been done.
+func (s *Server) backfillFileInfo() {
+	var done bool
+	s.Database.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket([]byte("Config")).Get([]byte(FILEINFO_BACKFILLED_KEY)) != nil
+		return nil
+	})
+	if done {
+		return
+	}
+
+	entries, err := s.Metadata.Query(func(m Metadata) bool {
+		return len(m.SHA256) == 0
+	})
+	if err != nil {
+		s.Log.Error("Can't list the files to compute their size and hash", "err", err)
+		return
+	}
+
+	if len(entries) > 0 {
+		s.Log.Info("Computing the size, content-type and hash of the files", "count", len(entries))
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if s.stopping() {
+			return
+		}
+
+		data, err := s.ReadFile(entry.Filename)
+		if err != nil {
+			s.Log.Error("Can't read the file to compute its size and hash", "file", entry.Filename, "err", err)
+			failed++
+			continue
+		}
+
+		err = s.updateMetadata(entry.Filename, func(m *Metadata) bool {
+			m.setFileInfo(data)
+			return true
+		})
+		if err != nil {
+			s.Log.Error("Can't store the size and hash of the file", "file", entry.Filename, "err", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		s.Log.Warn("The size, content-type and hash of some files couldn't be computed", "count", failed)
+		return
+	}
+
+	s.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Config")).Put([]byte(FILEINFO_BACKFILLED_KEY), []byte("true"))
+	})
 }
@@ -0,0 +1,356 @@
+// Store of the metadata of the files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	METADATA_BUCKET = "Metadata"
+)
+
+// MetadataStore stores the metadata of the files and the collections.
+// The BoltDB store is local to the server, the SQL store can be shared
+// by several servers using the same storage.
+type MetadataStore interface {
+	// Get returns the metadata of the file, nil if it doesn't exist.
+	Get(id string) (*Metadata, error)
+	// Put stores the metadata of a new file, which becomes the most recent one.
+	Put(metadata Metadata) error
+	// Update reads the metadata of the file, calls the function to modify it
+	// and stores it back if the function returns true. Nothing is done if
+	// the file doesn't exist.
+	Update(id string, update func(m *Metadata) bool) error
+	// Delete deletes the metadata of the file and removes it
+	// from the most recent files.
+	Delete(id string) error
+	// Query returns the metadata matching the filter, all of them if nil.
+	Query(filter func(m Metadata) bool) ([]Metadata, error)
+	// ListRecent returns the ids of the last uploaded files, the most recent first.
+	ListRecent() ([]string, error)
+	// ExpireDue returns the metadata of the files expired at the given time.
+	ExpireDue(now time.Time) ([]Metadata, error)
+	// GetCollection returns the collection, nil if it doesn't exist.
+	GetCollection(id string) (*Collection, error)
+	// PutCollection stores a new collection.
+	PutCollection(c Collection) error
+	// UpdateCollection reads the collection, calls the function to modify it
+	// and stores it back if the function returns true. Nothing is done if
+	// the collection doesn't exist.
+	UpdateCollection(id string, update func(c *Collection) bool) error
+	// DeleteCollection deletes the collection and returns whether it
+	// existed, false if it has already been deleted, e.g. by another server.
+	DeleteCollection(id string) (bool, error)
+	// QueryCollections returns the collections matching the filter, all of them if nil.
+	QueryCollections(filter func(c Collection) bool) ([]Collection, error)
+	// Check checks that the store can be read, without writing.
+	Check() error
+	Close() error
+}
+
+// NewMetadataStore returns the metadata store of the configuration,
+// the BoltDB store using the given database.
+func NewMetadataStore(config Config, db *bolt.DB, log *slog.Logger) (MetadataStore, error) {
+	switch config.MetadataStore {
+	case "", BOLT_STORE:
+		return NewBoltStore(db, log), nil
+	case SQLITE_STORE, POSTGRES_STORE:
+		return NewSQLStore(config.MetadataStore, config.SQLConfig, log)
+	}
+	return nil, fmt.Errorf("unknown metadata store: %s", config.MetadataStore)
+}
+
+// BoltStore stores the metadata in the Metadata bucket and the
+// last uploaded files in the Runtime bucket of the BoltDB database.
+type BoltStore struct {
+	Database *bolt.DB
+	Log      *slog.Logger
+}
+
+func NewBoltStore(db *bolt.DB, log *slog.Logger) *BoltStore {
+	return &BoltStore{Database: db, Log: log}
+}
+
+// bucket returns the Metadata bucket, which only exists
+// once the database has been opened by the server.
+func (b *BoltStore) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	bucket := tx.Bucket([]byte(METADATA_BUCKET))
+	if bucket == nil {
+		return nil, fmt.Errorf("the database has never been used by the server")
+	}
+	return bucket, nil
+}
+
+func (b *BoltStore) Get(id string) (*Metadata, error) {
+	var metadata *Metadata
+	err := b.Database.View(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		metadata = new(Metadata)
+		return json.Unmarshal(v, metadata)
+	})
+
+	return metadata, err
+}
+
+func (b *BoltStore) Put(metadata Metadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return b.Database.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(metadata.Filename), data); err != nil {
+			return err
+		}
+
+		return updateLastUploaded(tx, func(ids []string) []string {
+			lastUploaded := []string{metadata.Filename}
+			for _, id := range ids {
+				if id != metadata.Filename && len(lastUploaded) < MAX_LAST_UPLOADED {
+					lastUploaded = append(lastUploaded, id)
+				}
+			}
+			return lastUploaded
+		})
+	})
+}
+
+func (b *BoltStore) Update(id string, update func(m *Metadata) bool) error {
+	return b.Database.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		var metadata Metadata
+		if err := json.Unmarshal(v, &metadata); err != nil {
+			return err
+		}
+
+		if !update(&metadata) {
+			return nil
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+func (b *BoltStore) Delete(id string) error {
+	return b.Database.Update(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		return updateLastUploaded(tx, func(ids []string) []string {
+			var kept []string
+			for _, v := range ids {
+				if v != id {
+					kept = append(kept, v)
+				}
+			}
+			return kept
+		})
+	})
+}
+
+func (b *BoltStore) Query(filter func(m Metadata) bool) ([]Metadata, error) {
+	entries := make([]Metadata, 0)
+
+	err := b.Database.View(func(tx *bolt.Tx) error {
+		bucket, err := b.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var metadata Metadata
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				b.Log.Error("Can't read a metadata", "file", string(k), "err", err)
+				continue
+			}
+
+			if filter == nil || filter(metadata) {
+				entries = append(entries, metadata)
+			}
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+func (b *BoltStore) ListRecent() ([]string, error) {
+	values := make([]string, 0)
+	err := b.Database.View(func(tx *bolt.Tx) error {
+		if _, err := b.bucket(tx); err != nil {
+			return err
+		}
+
+		v := tx.Bucket([]byte("Runtime")).Get([]byte(LAST_UPLOADED_KEY))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &values)
+	})
+
+	return values, err
+}
+
+func (b *BoltStore) ExpireDue(now time.Time) ([]Metadata, error) {
+	return b.Query(func(m Metadata) bool {
+		return !m.ExpirationTime.IsZero() && m.ExpirationTime.Before(now)
+	})
+}
+
+func (b *BoltStore) Check() error {
+	return b.Database.View(func(tx *bolt.Tx) error {
+		_, err := b.bucket(tx)
+		return err
+	})
+}
+
+func (b *BoltStore) GetCollection(id string) (*Collection, error) {
+	var collection *Collection
+	err := b.Database.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(COLLECTIONS_BUCKET)).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		collection = new(Collection)
+		return json.Unmarshal(v, collection)
+	})
+
+	return collection, err
+}
+
+func (b *BoltStore) PutCollection(c Collection) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return b.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(COLLECTIONS_BUCKET)).Put([]byte(c.Id), data)
+	})
+}
+
+func (b *BoltStore) UpdateCollection(id string, update func(c *Collection) bool) error {
+	return b.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		var collection Collection
+		if err := json.Unmarshal(v, &collection); err != nil {
+			return err
+		}
+
+		if !update(&collection) {
+			return nil
+		}
+
+		data, err := json.Marshal(collection)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+func (b *BoltStore) DeleteCollection(id string) (bool, error) {
+	var deleted bool
+	err := b.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+		deleted = bucket.Get([]byte(id)) != nil
+		return bucket.Delete([]byte(id))
+	})
+
+	return deleted, err
+}
+
+func (b *BoltStore) QueryCollections(filter func(c Collection) bool) ([]Collection, error) {
+	collections := make([]Collection, 0)
+
+	err := b.Database.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(COLLECTIONS_BUCKET)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var collection Collection
+			if err := json.Unmarshal(v, &collection); err != nil {
+				b.Log.Error("Can't read a collection", "collection", string(k), "err", err)
+				continue
+			}
+
+			if filter == nil || filter(collection) {
+				collections = append(collections, collection)
+			}
+		}
+		return nil
+	})
+
+	return collections, err
+}
+
+// updateLastUploaded modifies the last uploaded list in the transaction.
+func updateLastUploaded(tx *bolt.Tx, update func(ids []string) []string) error {
+	bucket := tx.Bucket([]byte("Runtime"))
+
+	var ids []string
+	if v := bucket.Get([]byte(LAST_UPLOADED_KEY)); v != nil {
+		if err := json.Unmarshal(v, &ids); err != nil {
+			return err
+		}
+	}
+
+	ids = update(ids)
+	if ids == nil {
+		ids = make([]string, 0)
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(LAST_UPLOADED_KEY), data)
+}
+
+// Close does nothing, the database is closed by its owner.
+func (b *BoltStore) Close() error {
+	return nil
+}
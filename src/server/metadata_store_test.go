@@ -0,0 +1,341 @@
+// Tests of the metadata stores, the same behaviors being
+// expected from the BoltDB and the SQL stores.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSQLStore returns a SQL store in a new SQLite database.
+func newTestSQLStore(t *testing.T) *SQLStore {
+	store, err := NewSQLStore(SQLITE_STORE, SQLConfig{DSN: filepath.Join(t.TempDir(), "metadata.db")},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// forEachStore runs the test against every metadata store.
+func forEachStore(t *testing.T, test func(t *testing.T, store MetadataStore)) {
+	stores := map[string]func(t *testing.T) MetadataStore{
+		BOLT_STORE: func(t *testing.T) MetadataStore {
+			_, store := newTestBoltStore(t)
+			return store
+		},
+		SQLITE_STORE: func(t *testing.T) MetadataStore {
+			return newTestSQLStore(t)
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+// testMetadata returns the metadata of a file created at the given time.
+func testMetadata(id string, creation time.Time, expiration time.Time) Metadata {
+	return Metadata{
+		Filename:       id,
+		Original:       id + ".txt",
+		CreationTime:   creation,
+		ExpirationTime: expiration,
+		DeleteKey:      "key",
+	}
+}
+
+func TestMetadataStoreGetPut(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		if metadata, err := store.Get("missing1"); err != nil || metadata != nil {
+			t.Fatalf("unexpected metadata %+v, %v", metadata, err)
+		}
+
+		now := time.Now()
+		if err := store.Put(testMetadata("file0001", now, time.Time{})); err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, err := store.Get("file0001")
+		if err != nil || metadata == nil {
+			t.Fatalf("unexpected metadata %+v, %v", metadata, err)
+		}
+		if metadata.Original != "file0001.txt" || !metadata.CreationTime.Equal(now) || !metadata.ExpirationTime.IsZero() {
+			t.Errorf("unexpected metadata %+v", metadata)
+		}
+
+		if err := store.Delete("file0001"); err != nil {
+			t.Fatal(err)
+		}
+		if metadata, err := store.Get("file0001"); err != nil || metadata != nil {
+			t.Fatalf("the metadata isn't deleted: %+v, %v", metadata, err)
+		}
+	})
+}
+
+func TestMetadataStoreUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		// nothing is done for a missing file
+		called := false
+		if err := store.Update("missing1", func(m *Metadata) bool { called = true; return true }); err != nil || called {
+			t.Fatalf("missing file updated: %v, %v", called, err)
+		}
+
+		expiration := time.Now().Add(time.Hour)
+		if err := store.Put(testMetadata("file0001", time.Now(), expiration)); err != nil {
+			t.Fatal(err)
+		}
+
+		// not stored back if false is returned
+		err := store.Update("file0001", func(m *Metadata) bool {
+			m.Tags = []string{"ignored"}
+			return false
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata, _ := store.Get("file0001"); len(metadata.Tags) != 0 {
+			t.Errorf("an unchanged metadata is stored: %v", metadata.Tags)
+		}
+
+		// the expiration time changed is used to find the expired files
+		err = store.Update("file0001", func(m *Metadata) bool {
+			m.ExpirationTime = time.Now().Add(-time.Hour)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if due, err := store.ExpireDue(time.Now()); err != nil || len(due) != 1 {
+			t.Errorf("the updated expiration time isn't used: %v, %v", due, err)
+		}
+	})
+}
+
+func TestMetadataStoreConcurrentUpdates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		if err := store.Put(testMetadata("file0001", time.Now(), time.Time{})); err != nil {
+			t.Fatal(err)
+		}
+
+		// fewer writers than attempts: an update can't
+		// be overtaken by the others more than it retries
+		var wg sync.WaitGroup
+		errs := make(chan error, SQL_UPDATE_ATTEMPTS-2)
+		for i := 0; i < SQL_UPDATE_ATTEMPTS-2; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.Update("file0001", func(m *Metadata) bool {
+					m.Tags = append(m.Tags, fmt.Sprint(i))
+					return true
+				})
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if metadata, _ := store.Get("file0001"); len(metadata.Tags) != SQL_UPDATE_ATTEMPTS-2 {
+			t.Errorf("updates are lost: %v", metadata.Tags)
+		}
+	})
+}
+
+func TestSQLStoreUpdateConflict(t *testing.T) {
+	store := newTestSQLStore(t)
+	if err := store.Put(testMetadata("file0001", time.Now(), time.Time{})); err != nil {
+		t.Fatal(err)
+	}
+
+	// modified by another server between the read and the write
+	calls := 0
+	err := store.Update("file0001", func(m *Metadata) bool {
+		calls++
+		if calls == 1 {
+			store.Update("file0001", func(m *Metadata) bool {
+				m.Tags = append(m.Tags, "other")
+				return true
+			})
+		}
+		m.Tags = append(m.Tags, "mine")
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata, _ := store.Get("file0001"); calls != 2 || strings.Join(metadata.Tags, ",") != "other,mine" {
+		t.Errorf("unexpected tags %v after %d calls", metadata.Tags, calls)
+	}
+
+	// always modified meanwhile
+	err = store.Update("file0001", func(m *Metadata) bool {
+		store.Update("file0001", func(m *Metadata) bool {
+			m.Tags = append(m.Tags, "other")
+			return true
+		})
+		return true
+	})
+	if err == nil {
+		t.Errorf("the update is stored over a concurrent one")
+	}
+}
+
+func TestSQLStoreUpdateCollectionConflict(t *testing.T) {
+	store := newTestSQLStore(t)
+	if err := store.PutCollection(Collection{Id: "coll0001"}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	err := store.UpdateCollection("coll0001", func(c *Collection) bool {
+		calls++
+		if calls == 1 {
+			store.UpdateCollection("coll0001", func(c *Collection) bool {
+				c.Files = append(c.Files, "other001")
+				return true
+			})
+		}
+		c.Files = append(c.Files, "mine0001")
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := store.GetCollection("coll0001"); calls != 2 || strings.Join(c.Files, ",") != "other001,mine0001" {
+		t.Errorf("unexpected files %v after %d calls", c.Files, calls)
+	}
+
+	err = store.UpdateCollection("coll0001", func(c *Collection) bool {
+		store.UpdateCollection("coll0001", func(c *Collection) bool {
+			c.Title = c.Title + "x"
+			return true
+		})
+		return true
+	})
+	if err == nil {
+		t.Errorf("the collection is stored over a concurrent update")
+	}
+}
+
+func TestMetadataStoreListRecent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		if ids, err := store.ListRecent(); err != nil || len(ids) != 0 {
+			t.Fatalf("unexpected list %v, %v", ids, err)
+		}
+
+		start := time.Now().Add(-time.Hour)
+		for i := 0; i < MAX_LAST_UPLOADED+2; i++ {
+			if err := store.Put(testMetadata(fmt.Sprintf("file%04d", i), start.Add(time.Duration(i)*time.Second), time.Time{})); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids, err := store.ListRecent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := fmt.Sprintf("file%04d", MAX_LAST_UPLOADED+1)
+		if len(ids) != MAX_LAST_UPLOADED || ids[0] != last || ids[len(ids)-1] != "file0002" {
+			t.Fatalf("unexpected list %v", ids)
+		}
+
+		if err := store.Delete(last); err != nil {
+			t.Fatal(err)
+		}
+		if ids, _ := store.ListRecent(); ids[0] == last {
+			t.Errorf("a deleted file is listed: %v", ids)
+		}
+	})
+}
+
+func TestMetadataStoreExpireDue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		now := time.Now()
+		entries := []Metadata{
+			testMetadata("never001", now, time.Time{}),
+			testMetadata("expired1", now, now.Add(-time.Minute)),
+			testMetadata("expired2", now, now.Add(-time.Hour)),
+			testMetadata("future01", now, now.Add(time.Minute)),
+		}
+		for _, metadata := range entries {
+			if err := store.Put(metadata); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		due, err := store.ExpireDue(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, metadata := range due {
+			ids = append(ids, metadata.Filename)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, ",") != "expired1,expired2" {
+			t.Errorf("unexpected expired files %v", ids)
+		}
+
+		all, err := store.Query(func(m Metadata) bool { return strings.HasPrefix(m.Filename, "expired") })
+		if err != nil || len(all) != 2 {
+			t.Errorf("unexpected query result %v, %v", all, err)
+		}
+	})
+}
+
+func TestMetadataStoreCollections(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store MetadataStore) {
+		if c, err := store.GetCollection("missing1"); err != nil || c != nil {
+			t.Fatalf("unexpected collection %+v, %v", c, err)
+		}
+
+		for _, id := range []string{"coll0001", "coll0002"} {
+			if err := store.PutCollection(Collection{Id: id, Title: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := store.UpdateCollection("coll0001", func(c *Collection) bool {
+			c.Files = append(c.Files, "file0001")
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := store.GetCollection("coll0001"); err != nil || !c.Contains("file0001") {
+			t.Errorf("the collection isn't updated: %+v, %v", c, err)
+		}
+
+		collections, err := store.QueryCollections(func(c Collection) bool { return len(c.Files) > 0 })
+		if err != nil || len(collections) != 1 || collections[0].Id != "coll0001" {
+			t.Errorf("unexpected collections %+v, %v", collections, err)
+		}
+
+		if deleted, err := store.DeleteCollection("coll0001"); err != nil || !deleted {
+			t.Fatalf("not deleted: %v", err)
+		}
+		// already deleted, e.g. by another server
+		if deleted, err := store.DeleteCollection("coll0001"); err != nil || deleted {
+			t.Fatalf("deleted twice: %v", err)
+		}
+		if collections, _ := store.QueryCollections(nil); len(collections) != 1 {
+			t.Errorf("unexpected collections %+v", collections)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+// Prometheus metrics of the server.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	METRICS_NAMESPACE = "upd"
+
+	// METRICS_SCAN_TTL is the duration during which the counts of the
+	// stored files and of the files to repair, which scan the metadata
+	// and the replica states, are reused by the next scrapes.
+	METRICS_SCAN_TTL = time.Minute
+)
+
+var (
+	uploadsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "uploads_total",
+		Help:      "Number of files uploaded.",
+	})
+	uploadedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "uploaded_bytes_total",
+		Help:      "Number of bytes uploaded.",
+	})
+	downloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "downloads_total",
+		Help:      "Number of files downloaded, by variant (original, thumbnail or presigned).",
+	}, []string{"variant"})
+	downloadedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "downloaded_bytes_total",
+		Help:      "Number of bytes downloaded, by variant (original or thumbnail).",
+	}, []string{"variant"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the HTTP requests, by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "code"})
+	storageErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "storage_errors_total",
+		Help:      "Number of errors returned by the storage backend, by storage and operation.",
+	}, []string{"storage", "operation"})
+	cleanJobRunsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "clean_job_runs_total",
+		Help:      "Number of runs of the job cleaning the expired files.",
+	})
+	cleanJobDeletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "clean_job_deletions_total",
+		Help:      "Number of expired files and collections deleted by the clean job.",
+	}, []string{"kind"})
+	tierJobRunsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "tier_job_runs_total",
+		Help:      "Number of runs of the job demoting the files to the cold storage.",
+	})
+	tierJobDemotionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "tier_job_demotions_total",
+		Help:      "Number of files demoted to the cold storage by the tier job.",
+	})
+	replicaFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "replica_failures_total",
+		Help:      "Number of writes and deletes failed on a replica of the replicated storage, by replica and operation.",
+	}, []string{"replica", "operation"})
+	replicaRepairsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "replica_repairs_total",
+		Help:      "Number of files repaired on a replica by the repair job, by replica and state (missing or orphan).",
+	}, []string{"replica", "state"})
+	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "backups_total",
+		Help:      "Number of scheduled backups, by result (success or failure).",
+	}, []string{"result"})
+	thumbnailDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "thumbnail_generation_seconds",
+		Help:      "Time spent generating the thumbnails.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		uploadsTotal,
+		uploadedBytesTotal,
+		downloadsTotal,
+		downloadedBytesTotal,
+		requestDuration,
+		storageErrorsTotal,
+		cleanJobRunsTotal,
+		cleanJobDeletionsTotal,
+		tierJobRunsTotal,
+		tierJobDemotionsTotal,
+		replicaFailuresTotal,
+		replicaRepairsTotal,
+		backupsTotal,
+		thumbnailDuration,
+	)
+}
+
+// countStorageError increments the storage errors counter
+// if an error has occurred during the given operation.
+func (s *Server) countStorageError(operation string, err error) {
+	if err != nil {
+		storageErrorsTotal.WithLabelValues(s.Config.Storage, operation).Inc()
+	}
+}
+
+// statusRecorder keeps the status code and the amount
+// of bytes written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives access to the wrapped writer, to flush
+// the streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument measures the duration of the requests handled by
+// the given handler, labelled with the given route name.
+func instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: 200}
+
+		h.ServeHTTP(recorder, r)
+
+		requestDuration.WithLabelValues(route, strconv.Itoa(recorder.code)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// serverCollector collects the metrics read on demand from
+// the server: BoltDB statistics and the stored files.
+type serverCollector struct {
+	server *Server
+
+	mu           sync.Mutex // one scan at a time
+	scannedAt    time.Time
+	files        int64
+	size         int64
+	replicaFiles map[string]map[string]int // files to repair by replica and state
+
+	storedFiles   *prometheus.Desc
+	storedBytes   *prometheus.Desc
+	boltSize      *prometheus.Desc
+	boltTx        *prometheus.Desc
+	boltOpenTx    *prometheus.Desc
+	boltFreePages *prometheus.Desc
+	boltFreeAlloc *prometheus.Desc
+	replicas      *prometheus.Desc
+}
+
+func newServerCollector(s *Server) *serverCollector {
+	return &serverCollector{
+		server:        s,
+		storedFiles:   prometheus.NewDesc(METRICS_NAMESPACE+"_stored_files", "Number of files stored.", nil, nil),
+		storedBytes:   prometheus.NewDesc(METRICS_NAMESPACE+"_stored_bytes", "Number of bytes stored, thumbnails excluded.", nil, nil),
+		boltSize:      prometheus.NewDesc(METRICS_NAMESPACE+"_bolt_size_bytes", "Size of the BoltDB file.", nil, nil),
+		boltTx:        prometheus.NewDesc(METRICS_NAMESPACE+"_bolt_read_tx_total", "Number of read transactions started on the BoltDB file.", nil, nil),
+		boltOpenTx:    prometheus.NewDesc(METRICS_NAMESPACE+"_bolt_open_read_tx", "Number of read transactions currently open on the BoltDB file.", nil, nil),
+		boltFreePages: prometheus.NewDesc(METRICS_NAMESPACE+"_bolt_free_pages", "Number of free pages in the BoltDB file.", nil, nil),
+		boltFreeAlloc: prometheus.NewDesc(METRICS_NAMESPACE+"_bolt_free_alloc_bytes", "Number of bytes allocated in the free pages of the BoltDB file.", nil, nil),
+		replicas:      prometheus.NewDesc(METRICS_NAMESPACE+"_replicas_to_repair", "Number of files to repair on a replica, by replica and state (missing or orphan).", []string{"replica", "state"}, nil),
+	}
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.storedFiles
+	ch <- c.storedBytes
+	ch <- c.boltSize
+	ch <- c.boltTx
+	ch <- c.boltOpenTx
+	ch <- c.boltFreePages
+	ch <- c.boltFreeAlloc
+	ch <- c.replicas
+}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	db := c.server.Database
+
+	stats := db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.boltTx, prometheus.CounterValue, float64(stats.TxN))
+	ch <- prometheus.MustNewConstMetric(c.boltOpenTx, prometheus.GaugeValue, float64(stats.OpenTxN))
+	ch <- prometheus.MustNewConstMetric(c.boltFreePages, prometheus.GaugeValue, float64(stats.FreePageN))
+	ch <- prometheus.MustNewConstMetric(c.boltFreeAlloc, prometheus.GaugeValue, float64(stats.FreeAlloc))
+
+	if fi, err := os.Stat(db.Path()); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.boltSize, prometheus.GaugeValue, float64(fi.Size()))
+	}
+
+	files, size, replicaFiles := c.scan()
+
+	ch <- prometheus.MustNewConstMetric(c.storedFiles, prometheus.GaugeValue, float64(files))
+	ch <- prometheus.MustNewConstMetric(c.storedBytes, prometheus.GaugeValue, float64(size))
+
+	for replica, states := range replicaFiles {
+		for state, count := range states {
+			ch <- prometheus.MustNewConstMetric(c.replicas, prometheus.GaugeValue, float64(count), replica, state)
+		}
+	}
+}
+
+// scan counts the stored files, their size and the files to repair
+// on every replica, the counts being reused during METRICS_SCAN_TTL.
+func (c *serverCollector) scan() (int64, int64, map[string]map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.scannedAt.IsZero() && time.Since(c.scannedAt) < METRICS_SCAN_TTL {
+		return c.files, c.size, c.replicaFiles
+	}
+
+	var files, size int64
+	c.server.Metadata.Query(func(m Metadata) bool {
+		files++
+		size += m.Size
+		return false
+	})
+
+	var replicaFiles map[string]map[string]int
+	if replicated, ok := c.server.backend.(*ReplicatedStorage); ok {
+		replicaFiles = c.countReplicas(replicated)
+	}
+
+	c.files, c.size, c.replicaFiles = files, size, replicaFiles
+	c.scannedAt = time.Now()
+	return files, size, replicaFiles
+}
+
+// countReplicas counts the files to repair on every replica, by state.
+func (c *serverCollector) countReplicas(replicated *ReplicatedStorage) map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, replica := range replicated.Replicas {
+		counts[replica.Name] = map[string]int{REPLICA_MISSING: 0, REPLICA_ORPHAN: 0}
+	}
+
+	c.server.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(REPLICAS_BUCKET)).ForEach(func(k, v []byte) error {
+			var states map[string]string
+			if err := json.Unmarshal(v, &states); err != nil {
+				return nil
+			}
+			for replica, state := range states {
+				if counts[replica] != nil {
+					counts[replica][state]++
+				}
+			}
+			return nil
+		})
+	})
+
+	return counts
+}
@@ -0,0 +1,107 @@
+// Tests of the Prometheus metrics.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricValue returns the value of the metric, name and labels as
+// written in the exposition format, -1 if not exposed.
+func metricValue(t *testing.T, body string, metric string) float64 {
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, metric+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return -1
+}
+
+func TestMetricsRoute(t *testing.T) {
+	_, h := newTestServer(t, func(c *Config) {
+		c.MetricsRoute = "/metrics"
+	})
+
+	before := get(h, "/metrics", nil).Body.String()
+
+	w, response := upload(t, h, "notes.txt", []byte("some notes"), nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if w := get(h, "/upd/"+response.Name, nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	w = get(h, "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	after := w.Body.String()
+
+	// the counters are global, shared with the other tests
+	for metric, increment := range map[string]float64{
+		"upd_uploads_total":                                                1,
+		"upd_uploaded_bytes_total":                                         10,
+		`upd_downloads_total{variant="original"}`:                          1,
+		`upd_http_request_duration_seconds_count{code="200",route="send"}`: 1,
+	} {
+		previous := metricValue(t, before, metric)
+		if previous < 0 {
+			previous = 0
+		}
+		if value := metricValue(t, after, metric); value != previous+increment {
+			t.Errorf("%s: %v, %v before", metric, value, previous)
+		}
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newServerCollector(s))
+	metrics := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	for _, content := range []string{"first", "second file"} {
+		if w, _ := upload(t, h, "notes.txt", []byte(content), nil, nil); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	body := scrape()
+	if files := metricValue(t, body, "upd_stored_files"); files != 2 {
+		t.Errorf("unexpected stored files %v", files)
+	}
+	if size := metricValue(t, body, "upd_stored_bytes"); size != 16 {
+		t.Errorf("unexpected stored bytes %v", size)
+	}
+	if size := metricValue(t, body, "upd_bolt_size_bytes"); size <= 0 {
+		t.Errorf("unexpected database size %v", size)
+	}
+
+	// the scan of the metadata is reused by the next scrapes
+	upload(t, h, "notes.txt", []byte("third"), nil, nil)
+	if files := metricValue(t, scrape(), "upd_stored_files"); files != 2 {
+		t.Errorf("the metadata is scanned again: %v files", files)
+	}
+}
@@ -0,0 +1,276 @@
+// Migration of the stored files from a storage to another.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	MIGRATION_BUCKET     = "Migration"
+	MIGRATION_TARGET_KEY = "_target"
+
+	DEFAULT_MIGRATION_CONCURRENCY = 4
+)
+
+// OpenDatabase opens the database of the server for the administration
+// tools. It fails if the server is running.
+func OpenDatabase(runtimeDir string) (*bolt.DB, error) {
+	db, err := bolt.Open(runtimeDir+"/metadata.db", 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("the database is locked, the server must be stopped")
+	}
+	return db, err
+}
+
+// StorageDescription describes where the files of the given
+// storage type are stored with the configuration.
+func StorageDescription(storage string, config Config) string {
+	switch storage {
+	case FS_STORAGE:
+		return "fs:" + config.FSConfig.OutputDirectory
+	case S3_STORAGE:
+		return fmt.Sprintf("s3:%s/%s/%s", config.S3Config.Endpoint, config.S3Config.Bucket, config.S3Config.Prefix)
+	case TIERED_STORAGE:
+		return fmt.Sprintf("tiered:%s,%s", StorageDescription(config.TieredConfig.Hot, config), StorageDescription(config.TieredConfig.Cold, config))
+	case REPLICATED_STORAGE:
+		var replicas []string
+		for _, replica := range config.Replicas {
+			replicas = append(replicas, StorageDescription(replica.Storage, Config{FSConfig: replica.FSConfig, S3Config: replica.S3Config}))
+		}
+		return "replicated:" + strings.Join(replicas, ",")
+	}
+	return storage
+}
+
+// Migration copies every file referenced in the metadata, with its
+// thumbnails, from a storage to another. The copied files are recorded
+// in the database for the migration to be resumed if interrupted.
+type Migration struct {
+	Database *bolt.DB      // records the progress and the storage
+	Metadata MetadataStore // lists the files to copy
+	Log      *slog.Logger
+
+	From Storage
+	To   Storage
+
+	ToStorage string // type of the target storage, recorded in the database once done
+	Target    string // description of the target storage, to not resume a migration to another one
+
+	Concurrency int
+	DryRun      bool // only lists the files to copy
+}
+
+type MigrationReport struct {
+	Files   int   // files referenced in the metadata, thumbnails included
+	Copied  int   // files copied during this run
+	Skipped int   // files already copied by a previous run
+	Missing int   // thumbnails missing from the source storage
+	Failed  int   // files which couldn't be copied
+	Bytes   int64 // bytes copied, or to copy in dry-run
+}
+
+// migrationItem is a file to copy.
+type migrationItem struct {
+	name   string
+	size   int64  // expected size, -1 if unknown
+	sha256 string // expected hash, empty if unknown
+	thumb  bool
+}
+
+// Run copies the files. The storage recorded in the database is
+// updated once every file has been copied.
+func (m *Migration) Run() (MigrationReport, error) {
+	var report MigrationReport
+
+	if err := m.prepare(); err != nil {
+		return report, err
+	}
+
+	items, done, err := m.items()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(items)
+
+	concurrency := m.Concurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_MIGRATION_CONCURRENCY
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan migrationItem)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				size, missing, err := m.copy(item)
+
+				lock.Lock()
+				switch {
+				case missing:
+					m.Log.Warn("Thumbnail missing from the source storage, ignored", "file", item.name)
+					report.Missing++
+				case err != nil:
+					m.Log.Error("Can't copy the file", "file", item.name, "err", err)
+					report.Failed++
+				default:
+					report.Copied++
+					report.Bytes += size
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, item := range items {
+		if done[item.name] {
+			report.Skipped++
+			continue
+		}
+
+		if m.DryRun {
+			m.Log.Info("To copy", "file", item.name, "size", item.size)
+			if item.size > 0 {
+				report.Bytes += item.size
+			}
+			continue
+		}
+
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+
+	if m.DryRun || report.Failed > 0 {
+		return report, nil
+	}
+
+	// every file is in the new storage
+	err = m.Database.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("Config")).Put([]byte("storage"), []byte(m.ToStorage)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(MIGRATION_BUCKET))
+	})
+
+	return report, err
+}
+
+// prepare creates the bucket recording the progress of the migration,
+// reset if a previous migration was targeting another storage.
+func (m *Migration) prepare() error {
+	if m.DryRun {
+		return nil
+	}
+
+	return m.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(MIGRATION_BUCKET))
+		if bucket != nil && string(bucket.Get([]byte(MIGRATION_TARGET_KEY))) != m.Target {
+			m.Log.Warn("A migration to another storage was in progress, starting over", "previous_target", string(bucket.Get([]byte(MIGRATION_TARGET_KEY))))
+			if err := tx.DeleteBucket([]byte(MIGRATION_BUCKET)); err != nil {
+				return err
+			}
+			bucket = nil
+		}
+
+		if bucket == nil {
+			var err error
+			if bucket, err = tx.CreateBucket([]byte(MIGRATION_BUCKET)); err != nil {
+				return err
+			}
+		}
+
+		return bucket.Put([]byte(MIGRATION_TARGET_KEY), []byte(m.Target))
+	})
+}
+
+// items lists the files to copy and the ones already copied.
+func (m *Migration) items() ([]migrationItem, map[string]bool, error) {
+	var items []migrationItem
+	done := make(map[string]bool)
+
+	entries, err := m.Metadata.Query(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, metadata := range entries {
+		size := metadata.Size
+		if len(metadata.SHA256) == 0 {
+			size = -1 // not backfilled yet
+		}
+		items = append(items, migrationItem{name: metadata.Filename, size: size, sha256: metadata.SHA256})
+
+		for _, thumbnail := range metadata.Thumbnails {
+			items = append(items, migrationItem{name: thumbnail, size: -1, thumb: true})
+		}
+	}
+
+	err = m.Database.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(MIGRATION_BUCKET)); bucket != nil {
+			bucket.ForEach(func(k, v []byte) error {
+				done[string(k)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return items, done, err
+}
+
+// copy copies a file, verifies it has been correctly written in the
+// target storage and records it as copied. The second value is true
+// if a thumbnail is missing from the source, the other errors reading
+// it being failures.
+func (m *Migration) copy(item migrationItem) (int64, bool, error) {
+	data, err := m.From.Read(item.name)
+	if err != nil {
+		return 0, item.thumb && errors.Is(err, os.ErrNotExist), err
+	}
+
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+
+	if item.size >= 0 && int64(len(data)) != item.size {
+		return 0, false, fmt.Errorf("source size mismatch: %d bytes, %d expected", len(data), item.size)
+	}
+	if len(item.sha256) > 0 && sum != item.sha256 {
+		return 0, false, fmt.Errorf("source hash mismatch: %s, %s expected", sum, item.sha256)
+	}
+
+	if err := m.To.Write(item.name, data); err != nil {
+		return 0, false, err
+	}
+
+	// reads it back to verify it
+	written, err := m.To.Read(item.name)
+	if err != nil {
+		return 0, false, fmt.Errorf("can't read the copy: %v", err)
+	}
+	writtenHash := sha256.Sum256(written)
+	if len(written) != len(data) || !bytes.Equal(writtenHash[:], hash[:]) {
+		return 0, false, fmt.Errorf("the copy differs from the source: %d bytes", len(written))
+	}
+
+	err = m.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(MIGRATION_BUCKET)).Put([]byte(item.name), []byte(sum))
+	})
+
+	return int64(len(data)), false, err
+}
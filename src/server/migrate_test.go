@@ -0,0 +1,61 @@
+// Tests of the migration of the files to another storage.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// failingStorage fails to read the given file.
+type failingStorage struct {
+	Storage
+	name string
+}
+
+func (f failingStorage) Read(name string) ([]byte, error) {
+	if name == f.name {
+		return nil, errors.New("input/output error")
+	}
+	return f.Storage.Read(name)
+}
+
+func TestMigrationThumbnailErrors(t *testing.T) {
+	db, metadata := newTestBoltStore(t)
+
+	from := NewFSStorage(FSConfig{OutputDirectory: t.TempDir()})
+	for _, name := range []string{"abcdefgh", "abcdefgh.thumb.20x20.png.png"} {
+		if err := from.Write(name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := metadata.Put(Metadata{
+		Filename:   "abcdefgh",
+		Size:       -1,
+		Thumbnails: []string{"abcdefgh.thumb.10x10.png.png", "abcdefgh.thumb.20x20.png.png"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migration := &Migration{
+		Database:  db,
+		Metadata:  metadata,
+		Log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		From:      failingStorage{from, "abcdefgh.thumb.20x20.png.png"},
+		To:        NewFSStorage(FSConfig{OutputDirectory: t.TempDir()}),
+		ToStorage: FS_STORAGE,
+		Target:    "test",
+	}
+	report, err := migration.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the thumbnail which can't be read isn't taken for a missing one
+	if report.Copied != 1 || report.Missing != 1 || report.Failed != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
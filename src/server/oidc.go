@@ -0,0 +1,395 @@
+// Authentication of the users with an OpenID Connect provider:
+// browser sessions (authorization code flow) and bearer tokens.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	SESSION_COOKIE    = "upd_session"
+	OIDC_STATE_COOKIE = "upd_oidc_state"
+
+	DEFAULT_SESSION_TTL  = 12 * time.Hour
+	DEFAULT_USER_CLAIM   = "email"
+	DEFAULT_GROUPS_CLAIM = "groups"
+
+	OIDC_STATE_TTL = 10 * time.Minute
+)
+
+var errInvalidSession = errors.New("invalid session")
+
+// oidcAuth verifies the tokens of the OpenID Connect provider
+// and the sessions created after a login.
+type oidcAuth struct {
+	config         OIDCConfig
+	oauth2         oauth2.Config
+	idVerifier     *oidc.IDTokenVerifier // verifies the id tokens received on login
+	bearerVerifier *oidc.IDTokenVerifier // verifies the bearer tokens of the API calls
+	sessionKey     []byte                // signs the cookies
+	sessionTTL     time.Duration
+}
+
+// oidcSession is stored, signed, in the session cookie.
+type oidcSession struct {
+	Name       string    `json:"name"`
+	Groups     []string  `json:"groups,omitempty"`
+	Expiration time.Time `json:"exp"`
+}
+
+// oidcState is stored, signed, in a cookie during the login.
+type oidcState struct {
+	State      string    `json:"state"`
+	Nonce      string    `json:"nonce"`
+	Redirect   string    `json:"redirect"`
+	Expiration time.Time `json:"exp"`
+}
+
+// newOIDCAuth discovers the provider configuration (endpoints, JWKS)
+// and prepares the verification of its tokens. The signing keys are
+// fetched on demand and cached.
+func (s *Server) newOIDCAuth(ctx context.Context) (*oidcAuth, error) {
+	config := s.Config.OIDCConfig
+	if err := checkOIDCConfig(config); err != nil {
+		return nil, err
+	}
+
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	audience := config.Audience
+	if len(audience) == 0 {
+		audience = config.ClientID
+	}
+
+	sessionKey := []byte(config.SessionKey)
+	if len(sessionKey) == 0 {
+		// the sessions won't survive a restart
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	sessionTTL := DEFAULT_SESSION_TTL
+	if len(config.SessionTTL) > 0 {
+		if sessionTTL, err = time.ParseDuration(config.SessionTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	return &oidcAuth{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		idVerifier:     provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		bearerVerifier: provider.Verifier(&oidc.Config{ClientID: audience}),
+		sessionKey:     sessionKey,
+		sessionTTL:     sessionTTL,
+	}, nil
+}
+
+// identity returns the identity of the user from its bearer
+// token or its session cookie, nil if none is valid.
+func (o *oidcAuth) identity(r *http.Request) *Identity {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token, err := o.bearerVerifier.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil
+		}
+		identity, err := o.claimsIdentity(token)
+		if err != nil {
+			return nil
+		}
+		identity.Source = "oidc token"
+		return identity
+	}
+
+	if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+		var sess oidcSession
+		if err := o.decode(cookie.Value, &sess); err != nil || time.Now().After(sess.Expiration) {
+			return nil
+		}
+		return &Identity{Name: sess.Name, Groups: sess.Groups, Source: "oidc session"}
+	}
+
+	return nil
+}
+
+// claimsIdentity maps the claims of the token to an identity.
+func (o *oidcAuth) claimsIdentity(token *oidc.IDToken) (*Identity, error) {
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	userClaim := o.config.UserClaim
+	if len(userClaim) == 0 {
+		userClaim = DEFAULT_USER_CLAIM
+	}
+	groupsClaim := o.config.GroupsClaim
+	if len(groupsClaim) == 0 {
+		groupsClaim = DEFAULT_GROUPS_CLAIM
+	}
+
+	name, _ := claimValue(claims, userClaim).(string)
+	if len(name) == 0 {
+		name = token.Subject
+	}
+
+	identity := &Identity{Name: name}
+	switch groups := claimValue(claims, groupsClaim).(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, group)
+			}
+		}
+	}
+
+	return identity, nil
+}
+
+// claimValue returns the value of a claim, nested claims being
+// separated by a dot (ex: realm_access.roles).
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// encode signs the value to store it in a cookie.
+func (o *oidcAuth) encode(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + o.sign(payload), nil
+}
+
+// decode verifies the signature of a cookie value and decodes it.
+func (o *oidcAuth) decode(cookie string, value interface{}) error {
+	payload, signature, found := strings.Cut(cookie, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(o.sign(payload))) {
+		return errInvalidSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidSession
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (o *oidcAuth) sign(payload string) string {
+	mac := hmac.New(sha256.New, o.sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// OIDCLoginHandler redirects the user to the provider to log in.
+type OIDCLoginHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (s *OIDCLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := s.Server.oidc
+
+	state := oidcState{
+		State:      randomToken(),
+		Nonce:      randomToken(),
+		Redirect:   localRedirect(r.URL.Query().Get("redirect"), s.Server.Config.Route+"/1.0/auth_check"),
+		Expiration: time.Now().Add(OIDC_STATE_TTL),
+	}
+
+	value, err := o.encode(state)
+	if err != nil {
+		s.Server.logger(r).Error("Can't encode the login state", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    value,
+		Path:     s.Server.Config.Route + "/oidc/",
+		Expires:  state.Expiration,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, o.oauth2.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+// OIDCCallbackHandler receives the user back from the provider,
+// verifies its id token and opens its session.
+type OIDCCallbackHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (s *OIDCCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := s.Server.oidc
+	logger := s.Server.logger(r)
+
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var state oidcState
+	if err := o.decode(cookie.Value, &state); err != nil || time.Now().After(state.Expiration) {
+		w.WriteHeader(400)
+		return
+	}
+
+	if r.URL.Query().Get("state") != state.State {
+		w.WriteHeader(400)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); len(errCode) > 0 {
+		logger.Warn("Login refused by the OIDC provider", "error", errCode, "description", r.URL.Query().Get("error_description"))
+		w.WriteHeader(403)
+		return
+	}
+
+	token, err := o.oauth2.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		logger.Warn("Can't exchange the OIDC authorization code", "err", err)
+		w.WriteHeader(403)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		logger.Warn("No id token received from the OIDC provider")
+		w.WriteHeader(403)
+		return
+	}
+
+	idToken, err := o.idVerifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != state.Nonce {
+		logger.Warn("Invalid OIDC id token", "err", err)
+		w.WriteHeader(403)
+		return
+	}
+
+	identity, err := o.claimsIdentity(idToken)
+	if err != nil {
+		logger.Warn("Can't read the claims of the OIDC id token", "err", err)
+		w.WriteHeader(403)
+		return
+	}
+
+	if !s.Server.isAllowedIdentity(identity) {
+		logger.Warn("OIDC user not allowed", "user", identity.Name)
+		w.WriteHeader(403)
+		return
+	}
+
+	sess := oidcSession{
+		Name:       identity.Name,
+		Groups:     identity.Groups,
+		Expiration: time.Now().Add(o.sessionTTL),
+	}
+	value, err := o.encode(sess)
+	if err != nil {
+		logger.Error("Can't encode the session", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    value,
+		Path:     "/",
+		Expires:  sess.Expiration,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   OIDC_STATE_COOKIE,
+		Path:   s.Server.Config.Route + "/oidc/",
+		MaxAge: -1,
+	})
+
+	logger.Info("User logged in", "user", identity.Name)
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+}
+
+// OIDCLogoutHandler closes the session of the user.
+type OIDCLogoutHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (s *OIDCLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   SESSION_COOKIE,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.Write([]byte("Logged out."))
+}
+
+// randomToken returns a random string which can't be guessed.
+func randomToken() string {
+	data := make([]byte, 24)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// localRedirect returns the redirection if it stays on this
+// server, the fallback otherwise.
+func localRedirect(redirect string, fallback string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return fallback
+	}
+	return redirect
+}
+
+// checkOIDCConfig checks the configuration required by the login.
+func checkOIDCConfig(config OIDCConfig) error {
+	if len(config.Issuer) == 0 || len(config.ClientID) == 0 {
+		return fmt.Errorf("the OIDC issuer and client id are required")
+	}
+	return nil
+}
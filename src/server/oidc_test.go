@@ -0,0 +1,335 @@
+// Tests of the OpenID Connect authentication against a fake provider.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OpenID Connect provider serving its discovery
+// document, its JWKS and a token endpoint. The authorization code
+// exchanged at the token endpoint is the nonce of the id token.
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims := issuer.tokenClaims("upd", "alice@example.com")
+		claims["nonce"] = r.Form.Get("code")
+
+		writeTestJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.sign(key, claims),
+		})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func writeTestJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// tokenClaims returns the claims of a valid token.
+func (i *testIssuer) tokenClaims(audience string, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   i.server.URL,
+		"aud":   audience,
+		"sub":   "subject",
+		"email": email,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// sign returns the RS256 JWT of the claims.
+func (i *testIssuer) sign(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestOIDCServer returns a server authenticating
+// the users with the issuer.
+func newTestOIDCServer(t *testing.T, issuer *testIssuer, configure func(c *Config)) *Server {
+	config := Config{
+		Route: "/upd",
+		OIDCConfig: OIDCConfig{
+			Enabled:      true,
+			Issuer:       issuer.server.URL,
+			ClientID:     "upd",
+			ClientSecret: "secret",
+			RedirectURL:  "http://upd.example.com/upd/oidc/callback",
+		},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	s := NewServer(config)
+	s.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	auth, err := s.newOIDCAuth(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.oidc = auth
+	return s
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/upd/1.0/auth_check", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestOIDCBearerToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, nil)
+
+	r := bearerRequest(issuer.sign(issuer.key, issuer.tokenClaims("upd", "alice@example.com")))
+	if !IsAuthValid(s, r) {
+		t.Fatal("a valid token is refused")
+	}
+
+	identity := s.identity(r)
+	if identity == nil || identity.Name != "alice@example.com" || identity.Source != "oidc token" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestOIDCInvalidBearerTokens(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, nil)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := issuer.tokenClaims("upd", "alice@example.com")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	otherIssuer := issuer.tokenClaims("upd", "alice@example.com")
+	otherIssuer["iss"] = "https://other.example.com"
+
+	tokens := map[string]string{
+		"audience mismatch": issuer.sign(issuer.key, issuer.tokenClaims("other", "alice@example.com")),
+		"expired":           issuer.sign(issuer.key, expired),
+		"other issuer":      issuer.sign(issuer.key, otherIssuer),
+		"other key":         issuer.sign(otherKey, issuer.tokenClaims("upd", "alice@example.com")),
+		"not a token":       "garbage",
+	}
+
+	for name, token := range tokens {
+		r := bearerRequest(token)
+		if IsAuthValid(s, r) {
+			t.Errorf("%s: the token is accepted", name)
+		}
+		if s.identity(r) != nil {
+			t.Errorf("%s: the token gives an identity", name)
+		}
+	}
+}
+
+func TestOIDCBearerTokenAudience(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, func(c *Config) {
+		c.OIDCConfig.Audience = "api"
+	})
+
+	if !IsAuthValid(s, bearerRequest(issuer.sign(issuer.key, issuer.tokenClaims("api", "alice@example.com")))) {
+		t.Error("a token for the configured audience is refused")
+	}
+	if IsAuthValid(s, bearerRequest(issuer.sign(issuer.key, issuer.tokenClaims("upd", "alice@example.com")))) {
+		t.Error("a token for the client id is accepted with another audience")
+	}
+}
+
+func TestOIDCAllowedIdentities(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, func(c *Config) {
+		c.AllowedIdentities = []string{"alice@example.com"}
+		c.OIDCConfig.AllowedGroups = []string{"uploaders"}
+	})
+
+	bob := issuer.tokenClaims("upd", "bob@example.com")
+	uploader := issuer.tokenClaims("upd", "carol@example.com")
+	uploader["groups"] = []string{"staff", "uploaders"}
+
+	tokens := map[string]bool{
+		issuer.sign(issuer.key, issuer.tokenClaims("upd", "alice@example.com")): true,
+		issuer.sign(issuer.key, bob):      false,
+		issuer.sign(issuer.key, uploader): true,
+	}
+
+	for token, allowed := range tokens {
+		if valid := IsAuthValid(s, bearerRequest(token)); valid != allowed {
+			t.Errorf("token of %s: valid %v, expected %v", s.identity(bearerRequest(token)).Name, valid, allowed)
+		}
+	}
+}
+
+func TestOIDCAnonymous(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	s := newTestOIDCServer(t, issuer, nil)
+	if IsAuthValid(s, httptest.NewRequest("GET", "/upd/1.0/auth_check", nil)) {
+		t.Error("an anonymous request is accepted")
+	}
+
+	s = newTestOIDCServer(t, issuer, func(c *Config) {
+		c.SecretKey = "key"
+	})
+	r := httptest.NewRequest("GET", "/upd/1.0/auth_check", nil)
+	if IsAuthValid(s, r) {
+		t.Error("a request without the secret key is accepted")
+	}
+	r.Header.Set(SECRET_KEY_HEADER, "key")
+	if !IsAuthValid(s, r) {
+		t.Error("a request with the secret key is refused")
+	}
+}
+
+// login goes through the login and the callback, the provider
+// returning an id token with the given nonce.
+func login(t *testing.T, s *Server, nonce func(expected string) string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	(&OIDCLoginHandler{s}).ServeHTTP(w, httptest.NewRequest("GET", "/upd/oidc/login?redirect=/upd/collection/abc", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d", w.Code)
+	}
+
+	authorize, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := authorize.Query().Get("state")
+	code := nonce(authorize.Query().Get("nonce"))
+
+	r := httptest.NewRequest("GET", "/upd/oidc/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(code), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+
+	w = httptest.NewRecorder()
+	(&OIDCCallbackHandler{s}).ServeHTTP(w, r)
+	return w
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SESSION_COOKIE && len(cookie.Value) > 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestOIDCSession(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, nil)
+
+	w := login(t, s, func(expected string) string { return expected })
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/upd/collection/abc" {
+		t.Fatalf("callback: status %d, location %s", w.Code, w.Header().Get("Location"))
+	}
+
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+
+	r := httptest.NewRequest("GET", "/upd/1.0/auth_check", nil)
+	r.AddCookie(cookie)
+	if !IsAuthValid(s, r) {
+		t.Fatal("the session is refused")
+	}
+	if identity := s.identity(r); identity.Name != "alice@example.com" || identity.Source != "oidc session" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	// the signature covers the session
+	r = httptest.NewRequest("GET", "/upd/1.0/auth_check", nil)
+	r.AddCookie(&http.Cookie{Name: SESSION_COOKIE, Value: "x" + cookie.Value})
+	if IsAuthValid(s, r) {
+		t.Error("a tampered session is accepted")
+	}
+}
+
+func TestOIDCSessionNonceMismatch(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, nil)
+
+	w := login(t, s, func(expected string) string { return "other" })
+	if w.Code != http.StatusForbidden || sessionCookie(w) != nil {
+		t.Fatalf("a replayed id token opens a session: status %d", w.Code)
+	}
+}
+
+func TestOIDCSessionNotAllowed(t *testing.T) {
+	issuer := newTestIssuer(t)
+	s := newTestOIDCServer(t, issuer, func(c *Config) {
+		c.AllowedIdentities = []string{"bob@example.com"}
+	})
+
+	w := login(t, s, func(expected string) string { return expected })
+	if w.Code != http.StatusForbidden || sessionCookie(w) != nil {
+		t.Fatalf("a user not allowed opens a session: status %d", w.Code)
+	}
+}
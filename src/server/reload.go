@@ -0,0 +1,90 @@
+// Hot reload of the configuration.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// currentConfig returns the configuration, with the reloadable
+// values up-to-date. It must be used to read these values while the
+// server is running.
+func (s *Server) currentConfig() Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.Config
+}
+
+// reload reloads the configuration with the ConfigLoader.
+func (s *Server) reload() {
+	if s.ConfigLoader == nil {
+		s.Log.Warn("No configuration to reload")
+		return
+	}
+
+	config, err := s.ConfigLoader()
+	if err != nil {
+		s.Log.Error("Can't reload the configuration, keeping the current one", "err", err)
+		return
+	}
+
+	if err := s.Reload(config); err != nil {
+		s.Log.Error("Can't reload the configuration", "err", err)
+		return
+	}
+
+	s.Log.Info("Configuration reloaded")
+}
+
+// Reload applies the values of the given configuration which can be
+// modified without restarting the server: the secrets and identities, the limits,
+// the log level and the tls certificate. The other values are ignored.
+func (s *Server) Reload(config Config) error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	// the new certificate must be valid before applying anything
+	if s.certificate.Load() != nil {
+		if len(config.CertificateFile) == 0 || len(config.CertificateKey) == 0 {
+			return fmt.Errorf("the tls certificate can't be removed without a restart")
+		}
+		if err := s.loadCertificate(config.CertificateFile, config.CertificateKey); err != nil {
+			return err
+		}
+	}
+
+	s.configLock.Lock()
+	s.Config.SecretKey = config.SecretKey
+	s.Config.AllowedIdentities = config.AllowedIdentities
+	s.Config.AdminIdentities = config.AdminIdentities
+	s.Config.AdminKey = config.AdminKey
+	s.Config.MaxUploadSize = config.MaxUploadSize
+	s.Config.ThumbnailMaxSize = config.ThumbnailMaxSize
+	s.Config.StripMetadata = config.StripMetadata
+	s.Config.LogLevel = config.LogLevel
+	s.Config.CertificateFile = config.CertificateFile
+	s.Config.CertificateKey = config.CertificateKey
+	s.configLock.Unlock()
+
+	s.logLevel.Set(level)
+
+	return nil
+}
+
+// loadCertificate loads the tls certificate and starts serving it.
+func (s *Server) loadCertificate(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.certificate.Store(&cert)
+	return nil
+}
+
+// getCertificate returns the tls certificate currently served.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certificate.Load(), nil
+}
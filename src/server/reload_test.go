@@ -0,0 +1,67 @@
+// Tests of the hot reload of the configuration.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "old"
+	})
+
+	config := s.Config
+	config.SecretKey = "new"
+	config.MaxUploadSize = 1024
+	config.LogLevel = "debug"
+	config.Addr = "127.0.0.1:1"
+	s.ConfigLoader = func() (Config, error) { return config, nil }
+	s.reload()
+
+	if w, _ := upload(t, h, "notes.txt", []byte("abc"), nil, map[string]string{SECRET_KEY_HEADER: "old"}); w.Code != http.StatusForbidden {
+		t.Errorf("old key: status %d", w.Code)
+	}
+	if w, _ := upload(t, h, "notes.txt", []byte("abc"), nil, map[string]string{SECRET_KEY_HEADER: "new"}); w.Code != http.StatusOK {
+		t.Errorf("new key: status %d", w.Code)
+	}
+	if w, _ := upload(t, h, "notes.txt", bytes.Repeat([]byte("a"), 2048), nil, map[string]string{SECRET_KEY_HEADER: "new"}); w.Code == http.StatusOK {
+		t.Error("the new max upload size isn't applied")
+	}
+	if s.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("unexpected log level %v", s.logLevel.Level())
+	}
+	// the other values need a restart
+	if s.currentConfig().Addr == config.Addr {
+		t.Error("the address is reloaded")
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	s, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "old"
+	})
+	s.certificate.Store(&tls.Certificate{})
+
+	for _, loader := range []func() (Config, error){
+		func() (Config, error) { return Config{}, errors.New("invalid file") },
+		func() (Config, error) { return Config{SecretKey: "new", LogLevel: "verbose"}, nil },
+		func() (Config, error) { return Config{SecretKey: "new"}, nil },
+		func() (Config, error) {
+			return Config{SecretKey: "new", CertificateFile: "missing.pem", CertificateKey: "missing.key"}, nil
+		},
+	} {
+		s.ConfigLoader = loader
+		s.reload()
+
+		// the current configuration is kept
+		if w, _ := upload(t, h, "notes.txt", []byte("abc"), nil, map[string]string{SECRET_KEY_HEADER: "old"}); w.Code != http.StatusOK {
+			t.Errorf("status %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// State of the replicas of the replicated storage
+// and job repairing them.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	REPLICAS_BUCKET = "Replicas"
+
+	REPLICA_MISSING = "missing" // the file must be copied to the replica
+	REPLICA_ORPHAN  = "orphan"  // the file must be deleted from the replica
+)
+
+// recordReplicas stores, with the replicated storage, the replicas on which
+// the write or delete of the file failed to repair them later. The error is
+// returned if nothing has been written or deleted.
+func (s *Server) recordReplicas(name string, operation string, err error) error {
+	if _, ok := s.backend.(*ReplicatedStorage); !ok {
+		return err
+	}
+
+	var replicaErr *ReplicaError
+	if err != nil && !errors.As(err, &replicaErr) {
+		return err
+	}
+
+	state := REPLICA_MISSING
+	if operation == "delete" {
+		state = REPLICA_ORPHAN
+	}
+
+	// a successful operation fixes the previous failures
+	states := make(map[string]string)
+	if replicaErr != nil {
+		for replica, err := range replicaErr.Failed {
+			s.Log.Warn("Replica failed, it will be repaired", "file", name, "replica", replica, "operation", operation, "err", err)
+			replicaFailuresTotal.WithLabelValues(replica, operation).Inc()
+			states[replica] = state
+		}
+	}
+
+	if dbErr := s.setReplicaStates(name, states); dbErr != nil {
+		s.Log.Error("Can't store the state of the replicas", "file", name, "err", dbErr)
+	}
+
+	if replicaErr != nil && replicaErr.All {
+		return err
+	}
+	return nil
+}
+
+// setReplicaStates replaces the states of the replicas of the file,
+// the states of the replicas having the file up-to-date aren't stored.
+func (s *Server) setReplicaStates(name string, states map[string]string) error {
+	if len(states) == 0 {
+		// avoids a write transaction for every file
+		var exists bool
+		s.Database.View(func(tx *bolt.Tx) error {
+			exists = tx.Bucket([]byte(REPLICAS_BUCKET)).Get([]byte(name)) != nil
+			return nil
+		})
+		if !exists {
+			return nil
+		}
+	}
+
+	return s.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(REPLICAS_BUCKET))
+		if len(states) == 0 {
+			return bucket.Delete([]byte(name))
+		}
+
+		data, err := json.Marshal(states)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+// StartRepairJob starts the repair job if the replicated storage is used.
+func (s *Server) StartRepairJob() {
+	replicated, ok := s.backend.(*ReplicatedStorage)
+	if !ok {
+		return
+	}
+
+	// validated on startup
+	interval := DEFAULT_REPAIR_INTERVAL
+	if len(s.Config.Replication.RepairInterval) > 0 {
+		interval, _ = time.ParseDuration(s.Config.Replication.RepairInterval)
+	}
+
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			s.repairReplicas(replicated)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// repairReplicas copies the files to the replicas missing them and
+// deletes the files from the replicas which couldn't delete them.
+func (s *Server) repairReplicas(replicated *ReplicatedStorage) {
+	pending := make(map[string]map[string]string)
+
+	s.Database.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(REPLICAS_BUCKET)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var states map[string]string
+			if err := json.Unmarshal(v, &states); err != nil {
+				s.Log.Error("Can't read the state of the replicas", "file", string(k), "err", err)
+				continue
+			}
+			pending[string(k)] = states
+		}
+		return nil
+	})
+
+	for name, states := range pending {
+		repaired := make(map[string]string)
+
+		for replicaName, state := range states {
+			if s.stopping() {
+				return
+			}
+
+			replica := replicated.Replica(replicaName)
+			if replica == nil {
+				// removed from the configuration
+				repaired[replicaName] = state
+				continue
+			}
+
+			var err error
+			switch state {
+			case REPLICA_MISSING:
+				err = replicated.Repair(name, replica)
+			case REPLICA_ORPHAN:
+				err = replica.Storage.Delete(name)
+			}
+			// deleted in the meantime, nothing to repair
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+
+			if err != nil {
+				s.Log.Warn("Can't repair the replica", "file", name, "replica", replicaName, "state", state, "err", err)
+				continue
+			}
+
+			s.Log.Info("Replica repaired", "file", name, "replica", replicaName, "state", state)
+			replicaRepairsTotal.WithLabelValues(replicaName, state).Inc()
+			repaired[replicaName] = state
+		}
+
+		if err := s.removeReplicaStates(name, repaired); err != nil {
+			s.Log.Error("Can't store the state of the replicas", "file", name, "err", err)
+		}
+	}
+}
+
+// removeReplicaStates removes the repaired states, unless they
+// have been modified in the meantime.
+func (s *Server) removeReplicaStates(name string, repaired map[string]string) error {
+	if len(repaired) == 0 {
+		return nil
+	}
+
+	return s.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(REPLICAS_BUCKET))
+		v := bucket.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+
+		var states map[string]string
+		if err := json.Unmarshal(v, &states); err != nil {
+			return err
+		}
+
+		for replica, state := range repaired {
+			if states[replica] == state {
+				delete(states, replica)
+			}
+		}
+
+		if len(states) == 0 {
+			return bucket.Delete([]byte(name))
+		}
+
+		data, err := json.Marshal(states)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
@@ -0,0 +1,279 @@
+// Replicated storage: every file written in several storages.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica is a storage of the replicated storage.
+type Replica struct {
+	Name    string
+	Storage Storage
+
+	unhealthy atomic.Bool // set on errors, the healthy replicas are read first
+}
+
+// ReplicatedStorage writes the files in every replica and reads them from
+// the first healthy one. The replicas which can't be written or deleted
+// are returned in a ReplicaError, for the server to repair them later.
+type ReplicatedStorage struct {
+	Replicas  []*Replica
+	MinWrites int // replicas which must be written for a write to succeed
+}
+
+// ReplicaError is returned when an operation failed on some replicas.
+type ReplicaError struct {
+	Failed map[string]error // errors by replica
+	All    bool             // whether the operation failed on every replica
+}
+
+func (e *ReplicaError) Error() string {
+	var names []string
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %v", name, e.Failed[name]))
+	}
+	return "replicas failed: " + strings.Join(parts, ", ")
+}
+
+func NewReplicatedStorage(config Config) (*ReplicatedStorage, error) {
+	if err := validateReplicasConfig(config); err != nil {
+		return nil, err
+	}
+
+	replicated := &ReplicatedStorage{MinWrites: config.Replication.MinWrites}
+	if replicated.MinWrites == 0 {
+		replicated.MinWrites = len(config.Replicas)
+	}
+
+	for _, replica := range config.Replicas {
+		storage, err := NewStorage(replica.Storage, Config{FSConfig: replica.FSConfig, S3Config: replica.S3Config})
+		if err != nil {
+			return nil, fmt.Errorf("replica %s: %v", replica.Name, err)
+		}
+		replicated.Replicas = append(replicated.Replicas, &Replica{Name: replica.Name, Storage: storage})
+	}
+
+	return replicated, nil
+}
+
+// Write writes the file in every replica, concurrently. If less than
+// MinWrites replicas have been written, the written ones are deleted.
+func (r *ReplicatedStorage) Write(name string, data []byte) error {
+	failed := r.each(r.Replicas, func(replica *Replica) error {
+		return replica.Storage.Write(name, data)
+	})
+
+	if len(r.Replicas)-len(failed) < r.MinWrites {
+		for _, replica := range r.Replicas {
+			if _, ok := failed[replica.Name]; !ok {
+				replica.Storage.Delete(name)
+			}
+		}
+		return fmt.Errorf("written on %d replicas, %d required: %v", len(r.Replicas)-len(failed), r.MinWrites, &ReplicaError{Failed: failed})
+	}
+
+	if len(failed) > 0 {
+		return &ReplicaError{Failed: failed}
+	}
+	return nil
+}
+
+func (r *ReplicatedStorage) Read(name string) ([]byte, error) {
+	var data []byte
+	err := r.read(name, func(replica *Replica) error {
+		var err error
+		data, err = replica.Storage.Read(name)
+		return err
+	})
+	return data, err
+}
+
+func (r *ReplicatedStorage) Open(name string) (io.ReadCloser, error) {
+	var file io.ReadCloser
+	err := r.read(name, func(replica *Replica) error {
+		var err error
+		file, err = replica.Storage.Open(name)
+		return err
+	})
+	return file, err
+}
+
+// read calls the function on the healthy replicas then on the unhealthy
+// ones, until it succeeds. A replica not having the file isn't considered
+// unhealthy, it may not have been repaired yet.
+func (r *ReplicatedStorage) read(name string, read func(replica *Replica) error) error {
+	var healthy, unhealthy []*Replica
+	for _, replica := range r.Replicas {
+		if replica.unhealthy.Load() {
+			unhealthy = append(unhealthy, replica)
+		} else {
+			healthy = append(healthy, replica)
+		}
+	}
+
+	failed := make(map[string]error)
+	notExist := true
+	for _, replica := range append(healthy, unhealthy...) {
+		err := read(replica)
+		if err == nil {
+			replica.unhealthy.Store(false)
+			return nil
+		}
+
+		failed[replica.Name] = err
+		if !errors.Is(err, os.ErrNotExist) {
+			replica.unhealthy.Store(true)
+			notExist = false
+		}
+	}
+
+	if notExist {
+		return &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return &ReplicaError{Failed: failed, All: true}
+}
+
+// Delete deletes the file from every replica, a file
+// already missing from a replica isn't an error.
+func (r *ReplicatedStorage) Delete(name string) error {
+	failed := r.each(r.Replicas, func(replica *Replica) error {
+		if err := replica.Storage.Delete(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+
+	if len(failed) > 0 {
+		return &ReplicaError{Failed: failed, All: len(failed) == len(r.Replicas)}
+	}
+	return nil
+}
+
+// Check checks every replica. The storage is usable as long as
+// enough replicas can be written.
+func (r *ReplicatedStorage) Check(ctx context.Context) error {
+	failed := r.each(r.Replicas, func(replica *Replica) error {
+		return replica.Storage.Check(ctx)
+	})
+
+	if len(r.Replicas)-len(failed) < r.MinWrites {
+		return &ReplicaError{Failed: failed, All: len(failed) == len(r.Replicas)}
+	}
+	return nil
+}
+
+// List lists the files of every replica.
+func (r *ReplicatedStorage) List() ([]string, error) {
+	var storages []Storage
+	for _, replica := range r.Replicas {
+		storages = append(storages, replica.Storage)
+	}
+	return listAll(storages)
+}
+
+// ModTime returns the time of the last write of the file in any replica,
+// the replicas failing to answer being ignored.
+func (r *ReplicatedStorage) ModTime(name string) (time.Time, error) {
+	var latest time.Time
+	var err error
+	found := false
+
+	for _, replica := range r.Replicas {
+		t, replicaErr := latestModTime([]Storage{replica.Storage}, name)
+		if replicaErr != nil {
+			if err == nil || errors.Is(err, os.ErrNotExist) {
+				err = replicaErr
+			}
+			continue
+		}
+		if !found || t.After(latest) {
+			latest = t
+		}
+		found = true
+	}
+
+	if found {
+		return latest, nil
+	}
+	return latest, err
+}
+
+// Clean cleans every replica.
+func (r *ReplicatedStorage) Clean() error {
+	var storages []Storage
+	for _, replica := range r.Replicas {
+		storages = append(storages, replica.Storage)
+	}
+	return cleanAll(storages)
+}
+
+// Replica returns the replica of the given name, nil if unknown.
+func (r *ReplicatedStorage) Replica(name string) *Replica {
+	for _, replica := range r.Replicas {
+		if replica.Name == name {
+			return replica
+		}
+	}
+	return nil
+}
+
+// Repair copies the file to the given replica from another one.
+func (r *ReplicatedStorage) Repair(name string, target *Replica) error {
+	var others []*Replica
+	for _, replica := range r.Replicas {
+		if replica != target {
+			others = append(others, replica)
+		}
+	}
+
+	source := &ReplicatedStorage{Replicas: others}
+	data, err := source.Read(name)
+	if err != nil {
+		return err
+	}
+
+	err = target.Storage.Write(name, data)
+	target.unhealthy.Store(err != nil)
+	return err
+}
+
+// each calls the function concurrently on the replicas, updates
+// their health and returns the errors by replica.
+func (r *ReplicatedStorage) each(replicas []*Replica, f func(replica *Replica) error) map[string]error {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+
+	for _, replica := range replicas {
+		wg.Add(1)
+		go func(replica *Replica) {
+			defer wg.Done()
+			err := f(replica)
+			replica.unhealthy.Store(err != nil)
+			if err != nil {
+				lock.Lock()
+				failed[replica.Name] = err
+				lock.Unlock()
+			}
+		}(replica)
+	}
+	wg.Wait()
+
+	return failed
+}
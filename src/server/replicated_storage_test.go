@@ -0,0 +1,164 @@
+// Tests of the replicated storage and of the repair of its replicas.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestReplica returns a replica storing its files in a temporary
+// directory. If broken, the directory is a file: it can't be written
+// until the file is removed.
+func newTestReplica(t *testing.T, name string, broken bool) *Replica {
+	dir := filepath.Join(t.TempDir(), name)
+	if broken {
+		if err := os.WriteFile(dir, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Replica{Name: name, Storage: NewFSStorage(FSConfig{OutputDirectory: dir})}
+}
+
+// fixReplica makes a broken replica writable again.
+func fixReplica(t *testing.T, replica *Replica) {
+	if err := os.Remove(replica.Storage.(*FSStorage).Config.OutputDirectory); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replicaStates returns the states of the replicas of the file.
+func replicaStates(t *testing.T, s *Server, name string) map[string]string {
+	var states map[string]string
+	err := s.Database.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(REPLICAS_BUCKET)).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &states)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+// newTestReplicatedServer returns a server storing its files
+// in the given replicas.
+func newTestReplicatedServer(t *testing.T, replicas ...*Replica) (*Server, *ReplicatedStorage) {
+	s, _ := newTestServer(t, nil)
+	replicated := &ReplicatedStorage{Replicas: replicas, MinWrites: 1}
+	s.backend = replicated
+	return s, replicated
+}
+
+func TestReplicatedWriteMinWrites(t *testing.T) {
+	a, b, broken := newTestReplica(t, "a", false), newTestReplica(t, "b", false), newTestReplica(t, "c", true)
+	replicated := &ReplicatedStorage{Replicas: []*Replica{a, b, broken}, MinWrites: 3}
+
+	err := replicated.Write("abcdefgh", []byte("data"))
+	if err == nil {
+		t.Fatal("written on less replicas than required")
+	}
+	// not kept on the replicas written
+	for _, replica := range []*Replica{a, b} {
+		if _, err := replica.Storage.Read("abcdefgh"); !os.IsNotExist(err) {
+			t.Errorf("replica %s: the file is kept: %v", replica.Name, err)
+		}
+	}
+
+	replicated.MinWrites = 2
+	err = replicated.Write("abcdefgh", []byte("data"))
+	var replicaErr *ReplicaError
+	if !errors.As(err, &replicaErr) || replicaErr.All || len(replicaErr.Failed) != 1 || replicaErr.Failed["c"] == nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if data, err := replicated.Read("abcdefgh"); err != nil || string(data) != "data" {
+		t.Fatalf("unexpected content %q, %v", data, err)
+	}
+}
+
+func TestReplicatedRepairMissing(t *testing.T) {
+	a, b := newTestReplica(t, "a", false), newTestReplica(t, "b", true)
+	s, replicated := newTestReplicatedServer(t, a, b)
+
+	if err := s.WriteFile("abcdefgh", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if states := replicaStates(t, s, "abcdefgh"); states["b"] != REPLICA_MISSING || len(states) != 1 {
+		t.Fatalf("unexpected states %v", states)
+	}
+
+	// still broken: kept to be repaired later
+	s.repairReplicas(replicated)
+	if states := replicaStates(t, s, "abcdefgh"); states["b"] != REPLICA_MISSING {
+		t.Fatalf("unexpected states %v", states)
+	}
+
+	fixReplica(t, b)
+	s.repairReplicas(replicated)
+	if data, err := b.Storage.Read("abcdefgh"); err != nil || string(data) != "data" {
+		t.Fatalf("the replica isn't repaired: %q, %v", data, err)
+	}
+	if states := replicaStates(t, s, "abcdefgh"); states != nil {
+		t.Errorf("the states aren't cleared: %v", states)
+	}
+}
+
+func TestReplicatedDeleteStates(t *testing.T) {
+	a, b := newTestReplica(t, "a", false), newTestReplica(t, "b", true)
+	s, replicated := newTestReplicatedServer(t, a, b)
+
+	if err := s.WriteFile("abcdefgh", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file missing from the replica isn't written back once deleted
+	fixReplica(t, b)
+	if err := s.deleteFile("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if states := replicaStates(t, s, "abcdefgh"); states != nil {
+		t.Fatalf("the states aren't cleared: %v", states)
+	}
+	s.repairReplicas(replicated)
+	if _, err := b.Storage.Read("abcdefgh"); !os.IsNotExist(err) {
+		t.Fatalf("a deleted file is repaired: %v", err)
+	}
+
+	// a replica which can't delete the file is repaired by deleting it
+	if err := s.WriteFile("abcdefgh", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	dir := b.Storage.(*FSStorage).Config.OutputDirectory
+	if err := os.Rename(dir, dir+".away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.deleteFile("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if states := replicaStates(t, s, "abcdefgh"); states["b"] != REPLICA_ORPHAN || len(states) != 1 {
+		t.Fatalf("unexpected states %v", states)
+	}
+
+	fixReplica(t, b)
+	if err := os.Rename(dir+".away", dir); err != nil {
+		t.Fatal(err)
+	}
+	s.repairReplicas(replicated)
+	if _, err := b.Storage.Read("abcdefgh"); !os.IsNotExist(err) {
+		t.Fatalf("the orphan isn't deleted: %v", err)
+	}
+	if states := replicaStates(t, s, "abcdefgh"); states != nil {
+		t.Errorf("the states aren't cleared: %v", states)
+	}
+}
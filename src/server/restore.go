@@ -0,0 +1,180 @@
+// Restoration of a backup.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Restore restores a backup written by WriteBackup while the server is
+// stopped. The snapshot of the database is validated before replacing the
+// database, the previous one being kept aside.
+type Restore struct {
+	RuntimeDir string
+	Log        *slog.Logger
+
+	StorageType string  // storage of the configuration, the snapshot must have been made with it
+	Storage     Storage // storage in which the files of the backup are written, nil to ignore them
+}
+
+type RestoreReport struct {
+	Files    int    // files in the metadata of the snapshot
+	Restored int    // files written in the storage
+	Previous string // path of the previous database, empty if none
+}
+
+func (r *Restore) Run(backup io.Reader) (RestoreReport, error) {
+	var report RestoreReport
+
+	gz, err := gzip.NewReader(backup)
+	if err != nil {
+		return report, fmt.Errorf("not a backup: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != BACKUP_DATABASE_ENTRY {
+		return report, fmt.Errorf("not a backup: %s expected first", BACKUP_DATABASE_ENTRY)
+	}
+
+	path := filepath.Join(r.RuntimeDir, "metadata.db")
+	restored := filepath.Join(r.RuntimeDir, ".metadata.db.restore")
+	defer os.Remove(restored)
+
+	if err := extractFile(tr, restored); err != nil {
+		return report, fmt.Errorf("can't extract the database: %v", err)
+	}
+
+	if report.Files, err = r.validate(restored); err != nil {
+		return report, fmt.Errorf("invalid database snapshot: %v", err)
+	}
+
+	if r.Storage != nil {
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return report, fmt.Errorf("can't read the backup: %v", err)
+			}
+
+			name := strings.TrimPrefix(header.Name, BACKUP_FILES_DIR)
+			if !strings.HasPrefix(header.Name, BACKUP_FILES_DIR) || len(name) == 0 || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+				r.Log.Warn("Unexpected entry in the backup, ignored", "entry", header.Name)
+				continue
+			}
+
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return report, fmt.Errorf("can't read %s: %v", name, err)
+			}
+			if err := r.Storage.Write(name, data); err != nil {
+				return report, fmt.Errorf("can't restore %s: %v", name, err)
+			}
+			report.Restored++
+		}
+	}
+
+	// swaps the databases
+	if _, err := os.Stat(path); err == nil {
+		report.Previous = path + "." + time.Now().UTC().Format(BACKUP_TIME_FORMAT) + ".bak"
+		if err := os.Rename(path, report.Previous); err != nil {
+			return report, err
+		}
+	}
+	if err := os.Rename(restored, path); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// extractFile writes the current entry of the archive in the file.
+func extractFile(tr *tar.Reader, filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, tr); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// validate checks the consistency of the snapshot, its buckets, its storage
+// and its metadata. It returns the number of files in the metadata.
+func (r *Restore) validate(filename string) (files int, err error) {
+	// BoltDB panics on some corrupted pages
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("corrupted database: %v", p)
+		}
+	}()
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		// the errors must all be read for the check to end
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+
+		for _, name := range []string{"Metadata", "Runtime", "Config"} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("missing bucket %s", name)
+			}
+		}
+
+		version, err := SchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > SCHEMA_VERSION {
+			return fmt.Errorf("schema version %d, newer than the version %d of this server", version, SCHEMA_VERSION)
+		}
+
+		storage := string(tx.Bucket([]byte("Config")).Get([]byte("storage")))
+		if len(storage) > 0 && storage != r.StorageType {
+			return fmt.Errorf("made with the storage %s, the configuration uses %s", storage, r.StorageType)
+		}
+
+		return tx.Bucket([]byte("Metadata")).ForEach(func(k, v []byte) error {
+			var metadata Metadata
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				return fmt.Errorf("invalid metadata %s: %v", string(k), err)
+			}
+			files++
+			return nil
+		})
+	})
+
+	return files, err
+}
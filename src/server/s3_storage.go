@@ -0,0 +1,174 @@
+// Storage of the files in an S3 bucket, or in any
+// S3-compatible service (MinIO, Ceph, ...).
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type S3Storage struct {
+	Config S3Config
+	client *s3.S3 // created once, safe for concurrent use
+}
+
+// NewS3Storage creates the S3 client. Without an access key in the configuration,
+// the credentials are read from the environment, the shared configuration files
+// or the IAM role of the instance.
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	awsConfig := aws.NewConfig().
+		WithRegion(config.Region).
+		WithS3ForcePathStyle(config.PathStyle)
+
+	if len(config.Endpoint) > 0 {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+
+	if len(config.AccessKey) > 0 {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKey, config.AccessSecret, ""))
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{
+		Config: config,
+		client: s3.New(sess),
+	}, nil
+}
+
+// key returns the key of the object storing the given file.
+func (s *S3Storage) key(name string) *string {
+	return aws.String(s.Config.Prefix + name)
+}
+
+func (s *S3Storage) Write(name string, data []byte) error {
+	contentLength := int64(len(data))
+
+	// Creates the S3 put request
+	por := &s3.PutObjectInput{
+		Body:          bytes.NewReader(data),
+		Key:           s.key(name),
+		ContentLength: &contentLength,
+		Bucket:        aws.String(s.Config.Bucket),
+	}
+
+	if len(s.Config.StorageClass) > 0 {
+		por.StorageClass = aws.String(s.Config.StorageClass)
+	}
+	if len(s.Config.ServerSideEncryption) > 0 {
+		por.ServerSideEncryption = aws.String(s.Config.ServerSideEncryption)
+	}
+	if len(s.Config.KMSKeyId) > 0 {
+		por.SSEKMSKeyId = aws.String(s.Config.KMSKeyId)
+	}
+
+	_, err := s.client.PutObject(por)
+	return err
+}
+
+func (s *S3Storage) Read(name string) ([]byte, error) {
+	body, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.client.GetObject(&s3.GetObjectInput{
+		Key:    s.key(name),
+		Bucket: aws.String(s.Config.Bucket),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, &os.PathError{Op: "open", Path: *s.key(name), Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Key:    s.key(name),
+		Bucket: aws.String(s.Config.Bucket),
+	})
+	return err
+}
+
+// ModTime returns the last modification time of the object.
+func (s *S3Storage) ModTime(name string) (time.Time, error) {
+	resp, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Key:    s.key(name),
+		Bucket: aws.String(s.Config.Bucket),
+	})
+	// without body, a missing object is only a 404
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return time.Time{}, &os.PathError{Op: "stat", Path: *s.key(name), Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return aws.TimeValue(resp.LastModified), nil
+}
+
+// List lists the objects under the prefix, the ones in a
+// "sub-directory" of the prefix aren't files of upd.
+func (s *S3Storage) List() ([]string, error) {
+	var names []string
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Config.Bucket),
+		Prefix: aws.String(s.Config.Prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), s.Config.Prefix)
+			if isStoredName(name) {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names, err
+}
+
+// PresignGet returns a presigned GET url of the object, answering
+// with the given content-type and disposition.
+func (s *S3Storage) PresignGet(name string, contentType string, disposition string, ttl time.Duration) (string, error) {
+	input := &s3.GetObjectInput{
+		Key:                        s.key(name),
+		Bucket:                     aws.String(s.Config.Bucket),
+		ResponseContentType:        aws.String(contentType),
+		ResponseContentDisposition: aws.String(disposition),
+	}
+
+	req, _ := s.client.GetObjectRequest(input)
+	return req.Presign(ttl)
+}
+
+// Check checks that the bucket is reachable.
+func (s *S3Storage) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.Config.Bucket),
+	})
+	return err
+}
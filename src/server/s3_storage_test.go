@@ -0,0 +1,306 @@
+// Tests of the S3 storage against a fake S3 service.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a path-style S3 service storing the objects of
+// a single bucket, recording the headers of the last PUT.
+type fakeS3 struct {
+	bucket string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	put      http.Header
+	paths    []string
+}
+
+type fakeS3Object struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+type fakeS3List struct {
+	XMLName     xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	KeyCount    int            `xml:"KeyCount"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []fakeS3Object `xml:"Contents"`
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string][]byte), modified: make(map[string]time.Time)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.paths = append(f.paths, r.URL.Path)
+
+	// path-style: /<bucket>/<key>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, 404, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case r.Method == "HEAD" && len(key) == 0:
+		w.WriteHeader(200)
+	case r.Method == "GET" && len(key) == 0 && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		list := fakeS3List{Name: f.bucket, Prefix: prefix}
+		for k, v := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				list.Contents = append(list.Contents, fakeS3Object{Key: k, Size: len(v)})
+			}
+		}
+		sort.Slice(list.Contents, func(i, j int) bool { return list.Contents[i].Key < list.Contents[j].Key })
+		list.KeyCount = len(list.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(list)
+	case r.Method == "PUT":
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		f.modified[key] = time.Now()
+		f.put = r.Header.Clone()
+		w.WriteHeader(200)
+	case r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", f.modified[key].UTC().Format(http.TimeFormat))
+		w.WriteHeader(200)
+	case r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			f.error(w, 404, "NoSuchKey")
+			return
+		}
+		w.Write(data)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	default:
+		f.error(w, 405, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+// newTestS3Storage starts a fake S3 service and
+// returns a storage using it as its endpoint.
+func newTestS3Storage(t *testing.T, config S3Config) (*S3Storage, *fakeS3) {
+	fake := newFakeS3("upd")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	config.Endpoint = server.URL
+	config.PathStyle = true
+	config.Region = "us-east-1"
+	config.Bucket = "upd"
+	config.AccessKey = "access"
+	config.AccessSecret = "secret"
+
+	storage, err := NewS3Storage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, fake
+}
+
+func TestS3StorageWriteRead(t *testing.T) {
+	storage, fake := newTestS3Storage(t, S3Config{
+		Prefix:               "files/",
+		StorageClass:         "STANDARD_IA",
+		ServerSideEncryption: "aws:kms",
+		KMSKeyId:             "key-id",
+	})
+
+	if err := storage.Write("abcdefgh", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fake.objects["files/abcdefgh"]; !ok {
+		t.Fatalf("the object isn't stored under the prefix: %v", fake.paths)
+	}
+	if path := fake.paths[len(fake.paths)-1]; path != "/upd/files/abcdefgh" {
+		t.Errorf("the bucket isn't in the path: %s", path)
+	}
+
+	headers := map[string]string{
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-id",
+	}
+	for header, expected := range headers {
+		if v := fake.put.Get(header); v != expected {
+			t.Errorf("%s: got %q, expected %q", header, v, expected)
+		}
+	}
+
+	data, err := storage.Read("abcdefgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Errorf("read %q", data)
+	}
+}
+
+func TestS3StorageWriteWithoutOptions(t *testing.T) {
+	storage, fake := newTestS3Storage(t, S3Config{})
+
+	if err := storage.Write("abcdefgh", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fake.objects["abcdefgh"]; !ok {
+		t.Fatalf("the object isn't stored at the root of the bucket: %v", fake.paths)
+	}
+	for _, header := range []string{"X-Amz-Storage-Class", "X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"} {
+		if v := fake.put.Get(header); len(v) > 0 {
+			t.Errorf("unexpected %s: %s", header, v)
+		}
+	}
+}
+
+func TestS3StorageNotExist(t *testing.T) {
+	storage, _ := newTestS3Storage(t, S3Config{Prefix: "files/"})
+
+	_, err := storage.Open("abcdefgh")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	_, err = storage.Read("abcdefgh")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestS3StorageModTime(t *testing.T) {
+	storage, _ := newTestS3Storage(t, S3Config{Prefix: "files/"})
+
+	if _, err := storage.ModTime("abcdefgh"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	if err := storage.Write("abcdefgh", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	modTime, err := storage.ModTime("abcdefgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := time.Since(modTime); since < -time.Second || since > time.Minute {
+		t.Fatalf("unexpected modification time %v", modTime)
+	}
+}
+
+func TestS3StorageDelete(t *testing.T) {
+	storage, fake := newTestS3Storage(t, S3Config{Prefix: "files/"})
+
+	if err := storage.Write("abcdefgh", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("the object hasn't been deleted: %v", fake.objects)
+	}
+}
+
+func TestS3StorageList(t *testing.T) {
+	storage, fake := newTestS3Storage(t, S3Config{Prefix: "files/"})
+
+	for _, key := range []string{
+		"files/abcdefgh",
+		"files/abcdefgh.thumb.200x200.fit.png",
+		"files/sub/ijklmnop", // in a sub-directory of the prefix
+		"files/notes.txt",    // not named by upd
+		"other/qrstuvwx",     // out of the prefix
+	} {
+		fake.objects[key] = []byte("content")
+	}
+
+	names, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+
+	expected := []string{"abcdefgh", "abcdefgh.thumb.200x200.fit.png"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("listed %v, expected %v", names, expected)
+	}
+}
+
+func TestS3StorageCheck(t *testing.T) {
+	storage, _ := newTestS3Storage(t, S3Config{})
+	if err := storage.Check(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Config.Bucket = "missing"
+	if err := storage.Check(t.Context()); err == nil {
+		t.Fatal("a missing bucket is reachable")
+	}
+}
+
+func TestS3StoragePresignGet(t *testing.T) {
+	storage, _ := newTestS3Storage(t, S3Config{Prefix: "files/"})
+
+	link, err := storage.PresignGet("abcdefgh", "image/png", contentDisposition("inline", "été.png"), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/upd/files/abcdefgh" {
+		t.Errorf("presigned path %s", u.Path)
+	}
+
+	query := u.Query()
+	if v := query.Get("response-content-type"); v != "image/png" {
+		t.Errorf("content-type %q", v)
+	}
+	if v := query.Get("response-content-disposition"); v != "inline; filename*=UTF-8''%C3%A9t%C3%A9.png" {
+		t.Errorf("content-disposition %q", v)
+	}
+	if v := query.Get("X-Amz-Expires"); v != "300" {
+		t.Errorf("expires %q", v)
+	}
+}
@@ -0,0 +1,154 @@
+// Versioning and migrations of the schema of the database.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	SCHEMA_VERSION_KEY = "schema_version"
+
+	SCHEMA_BACKUP_PREFIX = "upd-schema-"
+
+	// version of the database once every migration has been
+	// run, the version of the last migration
+	SCHEMA_VERSION = 1
+)
+
+// schemaMigration migrates the database to its version. A migration
+// which fails is run again on next start.
+type schemaMigration struct {
+	Version     int
+	Description string
+	Migrate     func(s *Server, db *bolt.DB) error
+}
+
+// schemaMigrations are run in order, a migration is
+// never modified once released, a new one is added.
+var schemaMigrations = []schemaMigration{
+	{1, "record the version of the schema", noMigration},
+}
+
+// noMigration only bumps the version of the schema. The migrations
+// never read the files from the storage: a storage error would stop
+// the server, the work on the files is done by background jobs,
+// e.g. backfillFileInfo.
+func noMigration(s *Server, db *bolt.DB) error {
+	return nil
+}
+
+// SchemaVersion returns the version of the schema of the database,
+// 0 if it has never been migrated.
+func SchemaVersion(tx *bolt.Tx) (int, error) {
+	bucket := tx.Bucket([]byte("Config"))
+	if bucket == nil {
+		return 0, nil
+	}
+
+	v := bucket.Get([]byte(SCHEMA_VERSION_KEY))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// setSchemaVersion records the version of the schema.
+func setSchemaVersion(db *bolt.DB, version int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Config")).Put([]byte(SCHEMA_VERSION_KEY), []byte(strconv.Itoa(version)))
+	})
+}
+
+// migrateDatabase runs the migrations the database hasn't been through,
+// after having written a backup of it. A new database is directly
+// at the last version.
+func (s *Server) migrateDatabase() error {
+	var version int
+	var empty bool
+	err := s.Database.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = SchemaVersion(tx)
+		empty = tx.Bucket([]byte(METADATA_BUCKET)).Stats().KeyN == 0
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't read the schema version: %v", err)
+	}
+
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("the database has been migrated to the version %d by a newer server, this one only knows the version %d", version, SCHEMA_VERSION)
+	}
+	if version == SCHEMA_VERSION {
+		return nil
+	}
+
+	if version == 0 && empty {
+		return setSchemaVersion(s.Database, SCHEMA_VERSION)
+	}
+
+	backup, err := s.backupBeforeMigration(version)
+	if err != nil {
+		return fmt.Errorf("can't backup the database before migrating it: %v", err)
+	}
+	s.Log.Info("Database backed up before its migration", "file", backup)
+
+	for _, migration := range schemaMigrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		s.Log.Info("Migrating the database", "version", migration.Version, "migration", migration.Description)
+		start := time.Now()
+
+		if err := migration.Migrate(s, s.Database); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Description, err)
+		}
+		if err := setSchemaVersion(s.Database, migration.Version); err != nil {
+			return err
+		}
+
+		s.Log.Info("Database migrated", "version", migration.Version, "duration", time.Since(start).String())
+	}
+
+	return nil
+}
+
+// backupBeforeMigration writes a backup of the database, restorable
+// with the restore command, in the backup directory if configured,
+// in the runtime directory otherwise.
+func (s *Server) backupBeforeMigration(version int) (string, error) {
+	directory := s.Config.BackupConfig.Directory
+	if len(directory) == 0 {
+		directory = s.Config.RuntimeDir
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", err
+	}
+
+	// not pruned with the scheduled backups
+	name := filepath.Join(directory, fmt.Sprintf("%sv%d-%s%s", SCHEMA_BACKUP_PREFIX, version, time.Now().UTC().Format(BACKUP_TIME_FORMAT), BACKUP_SUFFIX))
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if err := WriteBackup(file, s.Database, nil, nil, s.Log); err != nil {
+		file.Close()
+		os.Remove(name)
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(name)
+		return "", err
+	}
+	return name, file.Close()
+}
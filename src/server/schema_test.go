@@ -0,0 +1,145 @@
+// Tests of the migrations of the schema of the database.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestSchemaServer returns a server using a new database,
+// never migrated, and the directory of its backups.
+func newTestSchemaServer(t *testing.T) (*Server, string) {
+	db, _ := newTestBoltStore(t)
+
+	backups := t.TempDir()
+	s := NewServer(Config{RuntimeDir: t.TempDir(), BackupConfig: BackupConfig{Directory: backups}})
+	s.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.Database = db
+	return s, backups
+}
+
+// schemaVersion returns the version of the schema of the database.
+func schemaVersion(t *testing.T, db *bolt.DB) int {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = SchemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// schemaBackups returns the backups written before the migrations.
+func schemaBackups(t *testing.T, directory string) []string {
+	names, err := filepath.Glob(filepath.Join(directory, SCHEMA_BACKUP_PREFIX+"*"+BACKUP_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	s, backups := newTestSchemaServer(t)
+	s.Metadata = NewBoltStore(s.Database, s.Log)
+	if err := s.Metadata.Put(Metadata{Filename: "abcdefgh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if version := schemaVersion(t, s.Database); version != SCHEMA_VERSION {
+		t.Fatalf("unexpected version %d", version)
+	}
+
+	// the backup of the version 0 can be restored
+	names := schemaBackups(t, backups)
+	if len(names) != 1 {
+		t.Fatalf("unexpected backups %v", names)
+	}
+	backup, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	restore := &Restore{RuntimeDir: t.TempDir(), Log: s.Log}
+	if report, err := restore.Run(backup); err != nil || report.Files != 1 {
+		t.Fatalf("the backup can't be restored: %+v, %v", report, err)
+	}
+
+	// nothing to do once migrated
+	if err := s.migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if names := schemaBackups(t, backups); len(names) != 1 {
+		t.Errorf("backed up again: %v", names)
+	}
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	s, backups := newTestSchemaServer(t)
+
+	if err := s.migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if version := schemaVersion(t, s.Database); version != SCHEMA_VERSION {
+		t.Fatalf("unexpected version %d", version)
+	}
+	if names := schemaBackups(t, backups); len(names) != 0 {
+		t.Errorf("a new database is backed up: %v", names)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	s, backups := newTestSchemaServer(t)
+	if err := setSchemaVersion(s.Database, SCHEMA_VERSION+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.migrateDatabase(); err == nil {
+		t.Fatal("a database migrated by a newer server is used")
+	}
+	if version := schemaVersion(t, s.Database); version != SCHEMA_VERSION+1 {
+		t.Errorf("the version is modified: %d", version)
+	}
+	if names := schemaBackups(t, backups); len(names) != 0 {
+		t.Errorf("unexpected backups %v", names)
+	}
+}
+
+func TestMigrateDatabaseFailure(t *testing.T) {
+	migrations := schemaMigrations
+	t.Cleanup(func() { schemaMigrations = migrations })
+	schemaMigrations = append(append([]schemaMigration{}, migrations...), schemaMigration{
+		Version:     SCHEMA_VERSION + 1,
+		Description: "failing",
+		Migrate: func(s *Server, db *bolt.DB) error {
+			return errors.New("failed")
+		},
+	})
+
+	s, _ := newTestSchemaServer(t)
+	s.Metadata = NewBoltStore(s.Database, s.Log)
+	if err := s.Metadata.Put(Metadata{Filename: "abcdefgh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.migrateDatabase(); err == nil {
+		t.Fatal("the failure isn't returned")
+	}
+	// the failed migration is run again on next start
+	if version := schemaVersion(t, s.Database); version != SCHEMA_VERSION {
+		t.Errorf("unexpected version %d", version)
+	}
+}
@@ -4,12 +4,9 @@ package server
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 	"strings"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 type SearchTagsHandler struct {
@@ -30,6 +27,10 @@ type SearchTagsEntryResponse struct {
 	CreationTime   time.Time `json:"creation_time"`   // creation time of the given file
 	ExpirationTime time.Time `json:"expiration_time"` // When this file expired
 	Tags           []string  `json:"tags"`            // Tags attached to this file.
+	Size           int64     `json:"size"`            // size in bytes of the file
+	ContentType    string    `json:"content_type"`    // content-type detected on upload
+	SHA256         string    `json:"sha256"`          // hex encoded SHA-256 of the file
+	Owner          string    `json:"owner,omitempty"` // identity of the user who uploaded the file
 }
 
 func (l *SearchTagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -38,60 +39,101 @@ func (l *SearchTagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.ParseForm()
-	if len(r.Form["tags"]) == 0 || len(r.Form["tags"][0]) == 0 {
-		println("!")
+	tags := readTagsParam(r)
+	if len(tags) == 0 {
 		w.WriteHeader(400)
 		return
 	}
 
-	tagParam := r.Form["tags"][0]
-	tags := strings.Split(tagParam, ",")
-	for i := range tags {
-		tags[i] = strings.Trim(tags[i], " ")
+	entries, err := l.Server.SearchTags(tags)
+	if err != nil {
+		l.Server.logger(r).Error("Can't search by tags", "tags", tags, "err", err)
+		w.WriteHeader(500)
+		return
 	}
 
-	// At the moment, without a 'database' system, we must
-	// look in every entries to find if some have the tags.
 	response := SearchTagsResponse{Results: make([]SearchTagsEntryResponse, 0)}
-
-	l.Server.Database.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Metadata"))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			// unmarshal
-			var metadata Metadata
-			err := json.Unmarshal(v, &metadata)
-			if err != nil {
-				log.Println("[err] Can't read a metadata:", err.Error())
-				continue
-			}
-
-			if stringArrayContainsOne(metadata.Tags, tags) {
-				entry := SearchTagsEntryResponse{
-					Filename:       metadata.Filename,
-					Original:       metadata.Original,
-					CreationTime:   metadata.CreationTime,
-					DeleteKey:      metadata.DeleteKey,
-					ExpirationTime: metadata.ExpirationTime,
-					Tags:           metadata.Tags,
-				}
-				response.Results = append(response.Results, entry)
-			}
+	for _, metadata := range entries {
+		entry := SearchTagsEntryResponse{
+			Filename:       metadata.Filename,
+			Original:       metadata.Original,
+			CreationTime:   metadata.CreationTime,
+			DeleteKey:      metadata.DeleteKey,
+			ExpirationTime: metadata.ExpirationTime,
+			Tags:           metadata.Tags,
+			Size:           metadata.Size,
+			ContentType:    metadata.ContentType,
+			SHA256:         metadata.SHA256,
+			Owner:          metadata.Owner,
 		}
-		return nil
-	})
+		response.Results = append(response.Results, entry)
+	}
 
 	bytes, err := json.Marshal(response)
 	if err != nil {
-		log.Println("[err] Can't marshal the list of last uploaded:", err.Error())
+		l.Server.logger(r).Error("Can't marshal the search results", "err", err)
 		w.WriteHeader(500)
 	}
 
 	w.Write(bytes)
 }
 
+// SearchTagsZipHandler streams a zip archive of every file
+// matching the tags query.
+type SearchTagsZipHandler struct {
+	Server *Server // pointer to the started server
+}
+
+func (l *SearchTagsZipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthValid(l.Server, r) {
+		w.WriteHeader(403)
+		return
+	}
+
+	tags := readTagsParam(r)
+	if len(tags) == 0 {
+		w.WriteHeader(400)
+		return
+	}
+
+	entries, err := l.Server.SearchTags(tags)
+	if err != nil {
+		l.Server.logger(r).Error("Can't search by tags", "tags", tags, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	setZipHeaders(w, strings.Join(tags, "-")+".zip")
+	if err := l.Server.writeZip(w, entries); err != nil {
+		l.Server.logger(r).Error("Can't write the zip archive of the tags", "tags", tags, "err", err)
+	}
+}
+
+// SearchTags returns the metadata of every file having at least
+// one of the given tags.
+func (s *Server) SearchTags(tags []string) ([]Metadata, error) {
+	// the tags aren't indexed, we must look
+	// in every entries to find if some have them.
+	return s.Metadata.Query(func(m Metadata) bool {
+		return stringArrayContainsOne(m.Tags, tags)
+	})
+}
+
+// readTagsParam reads the comma-separated tags given
+// in the request.
+func readTagsParam(r *http.Request) []string {
+	r.ParseForm()
+	if len(r.Form["tags"]) == 0 || len(r.Form["tags"][0]) == 0 {
+		return nil
+	}
+
+	tags := strings.Split(r.Form["tags"][0], ",")
+	for i := range tags {
+		tags[i] = strings.Trim(tags[i], " ")
+	}
+	return tags
+}
+
 // stringArrayContains returns true if the array contains at least one of the values.
 func stringArrayContainsOne(array []string, tags []string) bool {
 	for i := range array {
@@ -4,15 +4,15 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 type SendHandler struct {
@@ -25,9 +25,14 @@ const (
 
 // Json returned to the client
 type SendResponse struct {
-	Name           string    `json:"name"`
-	DeleteKey      string    `json:"delete_key"`
-	ExpirationTime time.Time `json:"expiration_time"`
+	Name             string    `json:"name"`
+	DeleteKey        string    `json:"delete_key"`
+	ExpirationTime   time.Time `json:"expiration_time"`
+	MetadataStripped bool      `json:"metadata_stripped"`
+	Size             int64     `json:"size"`
+	ContentType      string    `json:"content_type"`
+	SHA256           string    `json:"sha256"`
+	Owner            string    `json:"owner,omitempty"`
 }
 
 const (
@@ -42,13 +47,25 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	logger := s.Server.logger(r)
+	config := s.Server.currentConfig()
+
+	if config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	}
+
 	// parse the form
 	reader, _, err := r.FormFile("data")
 
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(413)
+		return
+	}
+
 	if err != nil {
 		w.WriteHeader(500)
-		log.Println("[err] Error while receiving data (FormFile).")
-		log.Println(err)
+		logger.Error("Error while receiving data (FormFile)", "err", err)
 		return
 	}
 
@@ -56,8 +73,7 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
 		w.WriteHeader(500)
-		log.Println("[err] Error while receiving data (ReadAll).")
-		log.Println(err)
+		logger.Error("Error while receiving data (ReadAll)", "err", err)
 		return
 	}
 
@@ -74,11 +90,11 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for {
-		name = s.randomString(8)
+		name = randomString(8)
 		// test existence
 		entry, err := s.Server.GetEntry(name)
 		if err != nil {
-			log.Println("[err] While reading the database:", err.Error())
+			logger.Error("Can't read the database", "err", err)
 			w.WriteHeader(500)
 			return
 		}
@@ -97,7 +113,7 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// check that the value is a correct duration
 		_, err := time.ParseDuration(ttl)
 		if err != nil {
-			println(err.Error())
+			logger.Debug("Invalid TTL", "ttl", ttl, "err", err)
 			w.WriteHeader(400)
 			return
 		}
@@ -112,26 +128,72 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		tags = strings.Split(r.Form["tags"][0], ",")
 	}
 
+	// strips the metadata of the images if asked
+	strip := config.StripMetadata
+	if len(r.Form["strip_metadata"]) > 0 {
+		strip, err = strconv.ParseBool(r.Form["strip_metadata"][0])
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	var stripped bool
+	if strip {
+		data, stripped, err = stripMetadata(data)
+		if err != nil {
+			// stored untouched, the image would still contain
+			// the location the uploader wants to remove
+			logger.Info("Can't strip the metadata of the image, upload refused", "original", original, "err", err)
+			w.WriteHeader(422)
+			return
+		}
+	}
+
 	// writes the data on the storage
 	if err := s.Server.WriteFile(name, data); err != nil {
-		log.Println("[err] unable to write file to storage", err)
+		logger.Error("Unable to write the file to the storage", "file", name, "err", err)
 		w.WriteHeader(500)
 		return
 	}
 
 	// add to metadata
-	deleteKey := s.randomString(16)
-	if err := s.addMetadata(name, original, tags, expirationTime, ttl, deleteKey, now); err != nil {
-		log.Println("[err] unable to add metadata", err)
+	metadata := Metadata{
+		Filename:         name,
+		Original:         original,
+		Tags:             tags,
+		TTL:              ttl,
+		ExpirationTime:   expirationTime,
+		DeleteKey:        randomString(16),
+		CreationTime:     now,
+		MetadataStripped: stripped,
+	}
+	if identity := s.Server.identity(r); identity != nil {
+		metadata.Owner = identity.Name
+	}
+	metadata.setFileInfo(data)
+	if err := s.addMetadata(logger, metadata); err != nil {
+		logger.Error("Unable to add the metadata", "file", name, "err", err)
 		w.WriteHeader(500)
 		return
 	}
 
+	s.Server.audit(r, AUDIT_UPLOAD, &metadata, "")
+	s.Server.publish(EVENT_UPLOAD, metadata)
+
+	uploadsTotal.Inc()
+	uploadedBytesTotal.Add(float64(metadata.Size))
+
 	// encode the response json
 	response := SendResponse{
-		Name:           name,
-		DeleteKey:      deleteKey,
-		ExpirationTime: expirationTime,
+		Name:             name,
+		DeleteKey:        metadata.DeleteKey,
+		ExpirationTime:   expirationTime,
+		MetadataStripped: stripped,
+		Size:             metadata.Size,
+		ContentType:      metadata.ContentType,
+		SHA256:           metadata.SHA256,
+		Owner:            metadata.Owner,
 	}
 
 	resp, _ := json.Marshal(response)
@@ -141,7 +203,7 @@ func (s *SendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // randomString generates a random valid URL string of the given size
-func (s *SendHandler) randomString(size int) string {
+func randomString(size int) string {
 	result := ""
 
 	for i := 0; i < size; i++ {
@@ -152,53 +214,9 @@ func (s *SendHandler) randomString(size int) string {
 }
 
 // addMetadata adds the given entry to the Server metadata information.
-func (s *SendHandler) addMetadata(name string, original string, tags []string, expirationTime time.Time, ttl string, key string, now time.Time) error {
-	metadata := Metadata{
-		Filename:       name,
-		Original:       original,
-		Tags:           tags,
-		TTL:            ttl,
-		ExpirationTime: expirationTime,
-		DeleteKey:      key,
-		CreationTime:   now,
-	}
-
-	// marshal the object
-	data, err := json.Marshal(metadata)
-	if err != nil {
-		log.Println("[err] Can't marshal an object to store it", err)
-		return err
-	}
-
-	// store into BoltDB
-	err = s.Server.Database.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("Metadata"))
-		return bucket.Put([]byte(name), data)
-	})
-
-	if err != nil {
-		log.Println("[err] Can't store")
-		log.Println(string(data))
-		log.Printf("[err] Reason: %s\n", err.Error())
-		return err
-	}
-
-	// store the LastUploaded infos
-	lastUploaded, err := s.Server.GetLastUploaded()
-	if err != nil {
-		log.Println("[err] Can't read the last uploaded in send handler:", err.Error())
-		return err
-	}
-
-	lastUploaded = append([]string{name}, lastUploaded[:]...)
-	if len(lastUploaded) > MAX_LAST_UPLOADED {
-		lastUploaded = lastUploaded[:len(lastUploaded)-1]
-	}
-
-	s.Server.SetLastUploaded(lastUploaded)
-
-	if err != nil {
-		log.Printf("[err] Can't store the LastUploaded infos for %s, reason: %s\n", name, err.Error())
+func (s *SendHandler) addMetadata(logger *slog.Logger, metadata Metadata) error {
+	if err := s.Server.Metadata.Put(metadata); err != nil {
+		logger.Error("Can't store the metadata", "file", metadata.Filename, "err", err)
 		return err
 	}
 
@@ -4,15 +4,24 @@
 package server
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -20,51 +29,250 @@ const (
 )
 
 type Server struct {
-	Config   Config   // Configuration
-	Database *bolt.DB // opened bolt db
-	Storage  string   // Storage used with this metadata file.
+	Config   Config        // Configuration
+	Database *bolt.DB      // opened bolt db
+	Metadata MetadataStore // store of the metadata of the files
+	Storage  string        // Storage used with this metadata file.
+	Log      *slog.Logger  // logger of the server
+	backend  Storage       // storage of the files
+
+	// ConfigLoader, if set, is called to reload the configuration on SIGHUP.
+	ConfigLoader func() (Config, error)
+
+	configLock     sync.RWMutex                    // protects the reloadable values of the Config
+	logLevel       *slog.LevelVar                  // level of the logger, reloadable
+	certificate    atomic.Pointer[tls.Certificate] // tls certificate currently served
+	httpServer     *http.Server                    // listening http server
+	acmeHTTPServer *http.Server                    // listener of the ACME HTTP-01 challenges, if any
+	healthServer   *http.Server                    // plain http listener of the probes, if any
+	oidc           *oidcAuth                       // OIDC authentication, if enabled
+	auditFile      *os.File                        // JSONL file of the audit log, if any
+	auditLock      sync.Mutex                      // protects the writes in the audit file
+	outboxNotify   chan struct{}                   // wakes up the webhooks delivery job
+	events         *EventBus                       // dispatches the events to the streams
+	stop           chan struct{}                   // closed to stop the background jobs
+	jobs           sync.WaitGroup                  // running background jobs
+	thumbnailSlots chan struct{}                   // limits the amount of thumbnails generated at the same time
+	authFailures   authFailureLimiter              // limits the authentication failures recorded in the audit log
 }
 
 func NewServer(config Config) *Server {
 	// init the random
 	rand.Seed(time.Now().Unix())
 
+	logLevel := new(slog.LevelVar)
+	logger, err := NewLogger(os.Stderr, config.LogFormat, config.LogLevel, logLevel)
+	if err != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+		logger.Warn("Invalid logging configuration, falling back on the default one", "err", err)
+	}
+
 	return &Server{
-		Config:  config,
-		Storage: config.Storage,
+		Config:         config,
+		Storage:        config.Storage,
+		Log:            logger,
+		logLevel:       logLevel,
+		stop:           make(chan struct{}),
+		outboxNotify:   make(chan struct{}, 1),
+		events:         NewEventBus(),
+		thumbnailSlots: make(chan struct{}, runtime.NumCPU()),
 	}
 }
 
-// Starts the listening daemon.
+// Starts the listening daemon. It returns once the server
+// has been stopped by a SIGINT/SIGTERM.
 func (s *Server) Start() {
-	router := s.prepareRouter()
+	if s.Config.OIDCConfig.Enabled {
+		// the context is kept to fetch the signing keys of the provider
+		ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: 30 * time.Second})
+		auth, err := s.newOIDCAuth(ctx)
+		if err != nil {
+			s.Log.Error("Can't configure the OIDC authentication", "issuer", s.Config.OIDCConfig.Issuer, "err", err)
+			os.Exit(1)
+		}
+		s.oidc = auth
+	}
 
-	// Setup the router on the net/http stack
-	http.Handle("/", router)
+	if s.backend == nil {
+		backend, err := NewStorage(s.Config.Storage, s.Config)
+		if err != nil {
+			s.Log.Error("Can't create the storage", "storage", s.Config.Storage, "err", err)
+			os.Exit(1)
+		}
+		s.backend = backend
+	}
+
+	if err := cleanAll([]Storage{s.backend}); err != nil {
+		s.Log.Warn("Can't delete the temporary files of the storage", "err", err)
+	}
+
+	router := s.prepareRouter()
 
 	// Open the database
 	s.openBoltDatabase()
+	s.openMetadataStore()
+
+	if err := s.openAuditLog(); err != nil {
+		s.Log.Error("Can't open the audit log file", "file", s.Config.AuditLogFile, "err", err)
+		os.Exit(1)
+	}
+
+	s.startJob(s.backfillFileInfo)
 
-	go s.StartCleanJob()
+	prometheus.MustRegister(newServerCollector(s))
+
+	s.startJob(s.StartCleanJob)
+	s.startJob(s.StartTierJob)
+	s.startJob(s.StartRepairJob)
+	s.startJob(s.StartWebhookJob)
+	s.startJob(s.StartBackupJob)
+
+	s.httpServer = &http.Server{
+		Addr:              s.Config.Addr,
+		Handler:           router,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
 
 	// Listen
-	if len(s.Config.CertificateFile) != 0 && len(s.Config.CertificateKey) != 0 {
-		log.Println("[info] Start secure listening on", s.Config.Addr)
-		err := http.ListenAndServeTLS(s.Config.Addr, s.Config.CertificateFile, s.Config.CertificateKey, nil)
-		log.Println("[err]", err.Error())
+	errs := make(chan error, 3)
+	if len(s.Config.HealthAddr) > 0 {
+		s.startHealthServer(errs)
+	}
+	if s.Config.ACMEConfig.Enabled {
+		manager, err := s.newACMEManager()
+		if err != nil {
+			s.Log.Error("Can't configure ACME", "err", err)
+			os.Exit(1)
+		}
+		// TLS-ALPN-01 challenges are answered by the tls listener
+		s.httpServer.TLSConfig = manager.TLSConfig()
+
+		if len(s.Config.ACMEConfig.HTTPAddr) > 0 {
+			s.startACMEHTTPServer(manager, errs)
+		}
+	} else if len(s.Config.CertificateFile) != 0 && len(s.Config.CertificateKey) != 0 {
+		if err := s.loadCertificate(s.Config.CertificateFile, s.Config.CertificateKey); err != nil {
+			s.Log.Error("Can't load the tls certificate", "err", err)
+			os.Exit(1)
+		}
+		s.httpServer.TLSConfig = &tls.Config{GetCertificate: s.getCertificate}
+	}
+
+	if s.httpServer.TLSConfig != nil {
+		if err := s.configureClientAuth(s.httpServer.TLSConfig); err != nil {
+			s.Log.Error("Can't configure the client certificates authentication", "err", err)
+			os.Exit(1)
+		}
+
+		s.Log.Info("Start secure listening", "addr", s.Config.Addr, "acme", s.Config.ACMEConfig.Enabled, "client_auth", s.Config.ClientAuth)
+		go func() { errs <- s.httpServer.ListenAndServeTLS("", "") }()
 	} else {
-		log.Println("[info] Start listening on", s.Config.Addr)
-		err := http.ListenAndServe(s.Config.Addr, nil)
-		log.Println("[err]", err.Error())
+		if len(s.Config.ClientAuth) > 0 && s.Config.ClientAuth != CLIENT_AUTH_NONE {
+			s.Log.Error("Client certificates can't be used without tls")
+			os.Exit(1)
+		}
+
+		s.Log.Info("Start listening", "addr", s.Config.Addr)
+		go func() { errs <- s.httpServer.ListenAndServe() }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case err := <-errs:
+			s.Log.Error("Can't listen", "err", err)
+			s.Shutdown()
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.reload()
+				continue
+			}
+			s.Log.Info("Stopping the server", "signal", sig.String())
+			s.Shutdown()
+			return
+		}
+	}
+}
+
+// Shutdown stops accepting new connections, waits for the
+// running requests (up to the shutdown timeout), stops the
+// background jobs and closes the database.
+func (s *Server) Shutdown() {
+	timeout := DEFAULT_SHUTDOWN_TIMEOUT
+	if len(s.Config.ShutdownTimeout) > 0 {
+		if d, err := time.ParseDuration(s.Config.ShutdownTimeout); err == nil {
+			timeout = d
+		}
+	}
+
+	// ends the events streams, which would be waited for
+	s.events.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	for _, server := range []*http.Server{s.healthServer, s.acmeHTTPServer, s.httpServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			s.Log.Warn("Some requests were still running when the server stopped", "addr", server.Addr, "err", err)
+		}
+	}
+	cancel()
+
+	close(s.stop)
+	s.jobs.Wait()
+
+	if err := s.Metadata.Close(); err != nil {
+		s.Log.Error("Can't close the metadata store", "err", err)
+	}
+	if err := s.Database.Close(); err != nil {
+		s.Log.Error("Can't close the database", "err", err)
+	}
+
+	if s.auditFile != nil {
+		s.auditFile.Close()
+	}
+
+	s.Log.Info("Server stopped")
+}
+
+// startJob starts a background job, waited for
+// when the server stops.
+func (s *Server) startJob(job func()) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		job()
+	}()
+}
+
+// stopping returns whether the server is being stopped.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
 	}
 }
 
 // Starts the Clean Job
 func (s *Server) StartCleanJob() {
 	timer := time.NewTicker(60 * time.Second)
-	for range timer.C {
-		job := CleanJob{s}
-		job.Run()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			job := CleanJob{s}
+			job.Run()
+		case <-s.stop:
+			return
+		}
 	}
 }
 
@@ -72,12 +280,11 @@ func (s *Server) StartCleanJob() {
 func (s *Server) openBoltDatabase() {
 	db, err := bolt.Open(s.Config.RuntimeDir+"/metadata.db", 0600, nil)
 	if err != nil {
-		log.Println("[err] Can't open the metadata.db file in :", s.Config.RuntimeDir)
-		log.Println(err)
+		s.Log.Error("Can't open the metadata.db file", "runtime_dir", s.Config.RuntimeDir, "err", err)
 		os.Exit(1)
 	}
 
-	log.Printf("[info] %s opened.", s.Config.RuntimeDir+"/metadata.db")
+	s.Log.Info("Database opened", "path", s.Config.RuntimeDir+"/metadata.db")
 
 	s.Database = db
 
@@ -85,18 +292,34 @@ func (s *Server) openBoltDatabase() {
 	db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("Metadata"))
 		if err != nil {
-			log.Println("Can't create the bucket 'Metadata'")
-			log.Println(err)
+			s.Log.Error("Can't create the bucket", "bucket", "Metadata", "err", err)
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte("Runtime"))
 		if err != nil {
-			log.Println("Can't create the bucket 'Runtime'")
-			log.Println(err)
+			s.Log.Error("Can't create the bucket", "bucket", "Runtime", "err", err)
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte("Config"))
 		if err != nil {
-			log.Println("Can't create the bucket 'LastUploaded'")
-			log.Println(err)
+			s.Log.Error("Can't create the bucket", "bucket", "Config", "err", err)
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(COLLECTIONS_BUCKET))
+		if err != nil {
+			s.Log.Error("Can't create the bucket", "bucket", "Collections", "err", err)
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(AUDIT_BUCKET))
+		if err != nil {
+			s.Log.Error("Can't create the bucket", "bucket", "Audit", "err", err)
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(OUTBOX_BUCKET))
+		if err != nil {
+			s.Log.Error("Can't create the bucket", "bucket", "Outbox", "err", err)
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(REPLICAS_BUCKET))
+		if err != nil {
+			s.Log.Error("Can't create the bucket", "bucket", "Replicas", "err", err)
 		}
 		return err
 	})
@@ -111,8 +334,15 @@ func (s *Server) openBoltDatabase() {
 			return nil
 		}
 
+		// the files already stored are in the hot storage of the tiered storage
+		if s.Config.Storage == TIERED_STORAGE && string(v) == s.Config.TieredConfig.Hot {
+			s.Log.Info("Switching to the tiered storage", "hot", s.Config.TieredConfig.Hot, "cold", s.Config.TieredConfig.Cold)
+			mustSave = true
+			return nil
+		}
+
 		if string(v) != s.Config.Storage {
-			log.Printf("The database use the storage %s, can't start with the storage %s\n", string(v), s.Config.Storage)
+			s.Log.Error("The database uses another storage, can't start", "database_storage", string(v), "storage", s.Config.Storage)
 			os.Exit(1)
 		}
 		return nil
@@ -126,100 +356,119 @@ func (s *Server) openBoltDatabase() {
 			return nil
 		})
 	}
+
+	if err := s.migrateDatabase(); err != nil {
+		s.Log.Error("Can't migrate the database", "err", err)
+		os.Exit(1)
+	}
+}
+
+// openMetadataStore opens the store of the metadata
+// of the files, the BoltDB database by default.
+func (s *Server) openMetadataStore() {
+	store, err := NewMetadataStore(s.Config, s.Database, s.Log)
+	if err != nil {
+		s.Log.Error("Can't open the metadata store", "metadata_store", s.Config.MetadataStore, "err", err)
+		os.Exit(1)
+	}
+
+	if _, ok := store.(*SQLStore); ok {
+		s.Log.Info("Metadata stored in the SQL database", "metadata_store", s.Config.MetadataStore)
+	}
+
+	s.Metadata = store
 }
 
 func (s *Server) deleteMetadata(name string) error {
-	err := s.Database.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("Metadata"))
-		return bucket.Delete([]byte(name))
-	})
+	err := s.Metadata.Delete(name)
 	if err != nil {
-		log.Println("Can't delete some metadata from the database:")
-		log.Println(err)
+		s.Log.Error("Can't delete some metadata from the database", "file", name, "err", err)
 	}
 
 	return err
 }
 
-// getEntry looks in the Bolt DB whether this entry exists and returns it
-// if found, otherwise, nil is returned.
+// getEntry looks in the metadata store whether this entry exists and
+// returns it if found, otherwise, nil is returned.
 func (s *Server) GetEntry(id string) (*Metadata, error) {
-	var metadata *Metadata
-	err := s.Database.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("Metadata"))
-		v := bucket.Get([]byte(id))
-		if v == nil {
-			return nil
-		}
+	return s.Metadata.Get(id)
+}
 
-		metadata = new(Metadata)
+// Prepares the route
+func (s *Server) prepareRouter() http.Handler {
+	r := mux.NewRouter()
 
-		// unmarshal the bytes
-		err := json.Unmarshal(v, &metadata)
-		if err != nil {
-			return err
-		}
+	// registered first to not be taken for a file when the route is /
+	if len(s.Config.MetricsRoute) > 0 {
+		r.Handle(s.Config.MetricsRoute, promhttp.Handler())
+	}
 
-		return nil
-	})
+	// probes of the orchestrators
+	s.handleProbes(r)
 
-	return metadata, err
-}
+	s.Log.Info("Serving files", "route", s.Config.Route)
+	sendHandler := &SendHandler{s}
+	r.Handle(s.Config.Route+"/1.0/send", instrument("send", sendHandler))
 
-// GetLastUploaded reads into BoltDB the array
-// of last uploaded entries.
-func (s *Server) GetLastUploaded() ([]string, error) {
-	values := make([]string, 0)
-	err := s.Database.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("Runtime"))
-		v := bucket.Get([]byte(LAST_UPLOADED_KEY))
+	lastUploadeHandler := &LastUploadedHandler{s}
+	r.Handle(s.Config.Route+"/1.0/list", instrument("list", lastUploadeHandler))
 
-		if v == nil {
-			return nil
-		}
+	searchTagsHandler := &SearchTagsHandler{s}
+	r.Handle(s.Config.Route+"/1.0/search_tags", instrument("search_tags", searchTagsHandler))
 
-		err := json.Unmarshal(v, &values)
-		return err
-	})
+	searchTagsZipHandler := &SearchTagsZipHandler{s}
+	r.Handle(s.Config.Route+"/1.0/search_tags/zip", instrument("search_tags_zip", searchTagsZipHandler))
 
-	return values, err
-}
+	authCheckHandler := &AuthCheckHandler{s}
+	r.Handle(s.Config.Route+"/1.0/auth_check", instrument("auth_check", authCheckHandler))
 
-func (s *Server) SetLastUploaded(lastUploaded []string) error {
-	return s.Database.Update(func(tx *bolt.Tx) error {
-		d, err := json.Marshal(lastUploaded)
-		if err != nil {
-			return err
-		}
+	eventsHandler := &EventsHandler{s}
+	r.Handle(s.Config.Route+"/1.0/events", instrument("events", eventsHandler))
 
-		bucket := tx.Bucket([]byte("Runtime"))
-		return bucket.Put([]byte(LAST_UPLOADED_KEY), d)
-	})
-}
+	auditHandler := &AuditHandler{s}
+	r.Handle(s.Config.Route+"/1.0/audit", instrument("audit", auditHandler))
 
-// Prepares the route
-func (s *Server) prepareRouter() http.Handler {
-	r := mux.NewRouter()
+	backupHandler := &BackupHandler{s}
+	r.Handle(s.Config.Route+"/1.0/backup", instrument("backup", backupHandler))
 
-	println(s.Config.Route)
-	sendHandler := &SendHandler{s}
-	r.Handle(s.Config.Route+"/1.0/send", sendHandler)
+	fsckHandler := &FsckHandler{s}
+	r.Handle(s.Config.Route+"/1.0/fsck", instrument("fsck", fsckHandler))
 
-	lastUploadeHandler := &LastUploadedHandler{s}
-	r.Handle(s.Config.Route+"/1.0/list", lastUploadeHandler)
+	createCollectionHandler := &CreateCollectionHandler{s}
+	r.Handle(s.Config.Route+"/1.0/collection", instrument("collection_create", createCollectionHandler))
 
-	searchTagsHandler := &SearchTagsHandler{s}
-	r.Handle(s.Config.Route+"/1.0/search_tags", searchTagsHandler)
+	editCollectionHandler := &EditCollectionHandler{s}
+	r.Handle(s.Config.Route+"/1.0/collection/{collection}/{action}", instrument("collection_edit", editCollectionHandler))
 
-	authCheckHandler := &AuthCheckHandler{s}
-	r.Handle(s.Config.Route+"/1.0/auth_check", authCheckHandler)
+	collectionIndexHandler := &CollectionIndexHandler{s}
+	r.Handle(s.Config.Route+"/collection/{collection}", instrument("collection_index", collectionIndexHandler))
+
+	collectionZipHandler := &CollectionZipHandler{s}
+	r.Handle(s.Config.Route+"/collection/{collection}/zip", instrument("collection_zip", collectionZipHandler))
+
+	if s.oidc != nil {
+		r.Handle(s.Config.Route+"/oidc/login", instrument("oidc_login", &OIDCLoginHandler{s}))
+		r.Handle(s.Config.Route+"/oidc/callback", instrument("oidc_callback", &OIDCCallbackHandler{s}))
+		r.Handle(s.Config.Route+"/oidc/logout", instrument("oidc_logout", &OIDCLogoutHandler{s}))
+	}
 
 	deleteHandler := &DeleteHandler{s}
-	r.Handle(s.Config.Route+"/{file}/{key}", deleteHandler)
+	r.Handle(s.Config.Route+"/{file}/{key}", instrument("delete", deleteHandler))
 
 	sh := &ServingHandler{s}
-	r.Handle(s.Config.Route+"/{file}", sh) // Serving route.
+	r.Handle(s.Config.Route+"/{file}", instrument("serve", sh)) // Serving route.
 
 	// Wrap it into a CORS handler, so we can use AJAX with UPD
-	return &CorsHandler{r}
+	var h http.Handler = &CorsHandler{r}
+
+	if len(s.Config.AccessLog) > 0 {
+		accessLog, err := NewAccessLogHandler(h, s.Config.AccessLog, s.Config.AccessLogFile)
+		if err != nil {
+			s.Log.Error("Can't open the access log", "err", err)
+			os.Exit(1)
+		}
+		h = accessLog
+	}
+
+	return &RequestIdHandler{h}
 }
@@ -0,0 +1,162 @@
+// Helpers of the tests running a server.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestServer returns a server storing its database and its files
+// in temporary directories, the configuration being changed by
+// configure, and its router.
+func newTestServer(t *testing.T, configure func(c *Config)) (*Server, http.Handler) {
+	config := Config{
+		Route:      "/upd",
+		RuntimeDir: t.TempDir(),
+		Storage:    FS_STORAGE,
+		FSConfig:   FSConfig{OutputDirectory: t.TempDir()},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	s := NewServer(config)
+	s.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	backend, err := NewStorage(config.Storage, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backend = backend
+
+	s.openBoltDatabase()
+	s.openMetadataStore()
+	t.Cleanup(func() {
+		s.Metadata.Close()
+		s.Database.Close()
+	})
+
+	return s, s.prepareRouter()
+}
+
+// upload uploads the data under the given name, with the given
+// form values and headers, and returns the response.
+func upload(t *testing.T, h http.Handler, name string, data []byte, values map[string]string, headers map[string]string) (*httptest.ResponseRecorder, SendResponse) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("name", name)
+	for k, v := range values {
+		form.WriteField(k, v)
+	}
+	part, _ := form.CreateFormFile("data", name)
+	part.Write(data)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/upd/1.0/send", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var response SendResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, response
+}
+
+// get sends a GET request to the router.
+func get(h http.Handler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestShutdown(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	// a request still running when the server stops
+	started, release := make(chan struct{}), make(chan struct{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.httpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		h.ServeHTTP(w, r)
+	})}
+	go s.httpServer.Serve(listener)
+
+	jobStopped := false
+	s.startJob(func() {
+		<-s.stop
+		jobStopped = true
+	})
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("the running request isn't waited for")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-responses; code != http.StatusNotFound {
+		t.Errorf("the running request failed: status %d", code)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server isn't stopped")
+	}
+	if !jobStopped {
+		t.Error("the background jobs aren't stopped")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/healthz"); err == nil {
+		t.Error("the new connections are accepted")
+	}
+	if err := s.Database.View(func(*bolt.Tx) error { return nil }); err != bolt.ErrDatabaseNotOpen {
+		t.Errorf("the database isn't closed: %v", err)
+	}
+}
@@ -4,24 +4,81 @@
 package server
 
 import (
-	"bytes"
-	"image"
-	"image/jpeg"
-	"image/png"
-	"log"
+	"fmt"
+	"log/slog"
+	"mime"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/nfnt/resize"
 )
 
 const (
 	HEADER_ORIGINAL_FILENAME = "X-Upd-Orig-Filename"
 )
 
+// RFC5987_ATTR_CHARS are the characters, with the letters and
+// the digits, kept as is in an encoded file name.
+const RFC5987_ATTR_CHARS = "!#$&+-.^_`|~"
+
+// contentDisposition returns the Content-Disposition header of the
+// file, its name being encoded as specified by RFC 5987.
+func contentDisposition(disposition string, filename string) string {
+	var b strings.Builder
+	b.WriteString(disposition + "; filename*=UTF-8''")
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(RFC5987_ATTR_CHARS, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isInlineContentType returns whether a file of this content-type is
+// displayed by the browsers, the others being downloaded: an uploaded
+// document must never run scripts in the origin of upd.
+func isInlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "text/plain",
+		mediaType == "application/pdf":
+		return true
+	}
+	return false
+}
+
+// fileDisposition returns the Content-Disposition header of a
+// served file: inline if its content-type is safe to display.
+func fileDisposition(contentType string, original string) string {
+	if isInlineContentType(contentType) {
+		return contentDisposition("inline", original)
+	}
+	return contentDisposition("attachment", original)
+}
+
+// setFileHeaders sets the headers of a response sending a file. The
+// browsers must not guess another content-type than the given one.
+func setFileHeaders(w http.ResponseWriter, contentType string, original string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(HEADER_ORIGINAL_FILENAME, original)
+	w.Header().Set("Content-Disposition", fileDisposition(contentType, original))
+}
+
 type ServingHandler struct {
 	Server *Server // pointer to the started server
 }
@@ -38,10 +95,12 @@ func (s *ServingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	logger := s.Server.logger(r)
+
 	// Look for the file in BoltDB
 	entry, err := s.Server.GetEntry(id)
 	if err != nil {
-		log.Println("[err] Error while retrieving an entry:", err.Error())
+		logger.Error("Can't retrieve an entry", "file", id, "err", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -63,10 +122,11 @@ func (s *ServingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// No longer alive!
 			err := s.Server.Expire(*entry)
 			if err != nil {
-				log.Println("[warn] While deleting file:", entry.Filename)
-				log.Println(err)
+				logger.Warn("Can't delete an expired file", "file", entry.Filename, "err", err)
 			} else {
-				log.Println("[info] Deleted due to TTL:", entry.Filename)
+				logger.Info("Deleted due to TTL", "file", entry.Filename)
+				s.Server.auditEvent(AuditEvent{Action: AUDIT_EXPIRE, File: entry.Filename, Original: entry.Original, Detail: "ttl"})
+				s.Server.publish(EVENT_EXPIRE, *entry)
 			}
 
 			w.WriteHeader(404)
@@ -74,101 +134,218 @@ func (s *ServingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// read it
-	data, err := s.Server.ReadFile(entry.Filename)
+	// the original file is only read when needed
+	var data []byte
+	readOriginal := func() ([]byte, error) {
+		if data != nil {
+			return data, nil
+		}
+		var err error
+		data, err = s.Server.ReadFile(entry.Filename)
+		return data, err
+	}
 
-	if err != nil {
-		log.Println("[err] Can't read the file from the storage.")
-		log.Println(err)
-		w.WriteHeader(500)
+	// we'll see whether or not we want to generate a thumbnail
+	r.ParseForm()
+	opts, resize, ok := s.readThumbnailOptions(r)
+	if !ok {
+		w.WriteHeader(400)
 		return
 	}
 
-	// detect the content-type
-	contentType := http.DetectContentType(data)
+	// the original file can be downloaded directly from the storage,
+	// the thumbnails are generated here
+	if !resize {
+		if link, ok := s.Server.presignedDownload(logger, *entry); ok {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, link, http.StatusFound)
 
-	// we'll see whether or not we want to generate a thumbnail
-	r.ParseForm()
-	width := r.Form.Get("w")
-	height := r.Form.Get("h")
-	if len(width) != 0 && len(height) != 0 {
+			s.Server.audit(r, AUDIT_DOWNLOAD, entry, "presigned")
+			s.Server.recordDownload(logger, *entry)
 
-		iwidth, err := strconv.Atoi(width)
-		if err != nil {
-			w.WriteHeader(400)
-			return
-		}
-		iheight, err := strconv.Atoi(height)
-		if err != nil {
-			w.WriteHeader(400)
+			downloadsTotal.WithLabelValues("presigned").Inc()
 			return
 		}
+	}
+
+	if resize {
+		thumbnail, err := s.Server.Thumbnail(*entry, opts, readOriginal)
+		if err == nil {
+			setFileHeaders(w, http.DetectContentType(thumbnail), entry.Original)
+			w.Write(thumbnail)
+
+			s.Server.audit(r, AUDIT_DOWNLOAD, entry, "thumbnail")
+			s.Server.recordDownload(logger, *entry)
 
-		if iheight < 0 || iwidth < 0 {
-			w.WriteHeader(400)
+			downloadsTotal.WithLabelValues("thumbnail").Inc()
+			downloadedBytesTotal.WithLabelValues("thumbnail").Add(float64(len(thumbnail)))
 			return
 		}
 
-		// don't permit too large resize
-		if iheight > 500 || iwidth > 500 {
-			w.WriteHeader(400)
-			return
+		// serve the original file instead
+		if err != ErrNotResizable && err != ErrImageTooLarge {
+			logger.Error("Can't generate the thumbnail", "file", entry.Filename, "err", err)
 		}
+	}
+
+	// read it
+	data, err = readOriginal()
+	if err != nil {
+		logger.Error("Can't read the file from the storage", "file", entry.Filename, "err", err)
+		w.WriteHeader(500)
+		return
+	}
 
-		data = s.Resize(id, contentType, data, uint(iwidth), uint(iheight))
+	// detected on upload, except for the oldest files
+	contentType := entry.ContentType
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(data)
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set(HEADER_ORIGINAL_FILENAME, entry.Original)
-	w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+url.QueryEscape(entry.Original))
+	setFileHeaders(w, contentType, entry.Original)
 	w.Write(data)
+
+	s.Server.audit(r, AUDIT_DOWNLOAD, entry, "")
+	s.Server.recordDownload(logger, *entry)
+
+	downloadsTotal.WithLabelValues("original").Inc()
+	downloadedBytesTotal.WithLabelValues("original").Add(float64(len(data)))
 }
 
-func (s *ServingHandler) Resize(id string, contentType string, data []byte, width uint, height uint) []byte {
-	if len(data) == 0 {
-		return data
+// readThumbnailOptions reads the thumbnail parameters of the request.
+// The second value is false if no thumbnail has been asked, the third
+// one is false if the parameters are invalid.
+func (s *ServingHandler) readThumbnailOptions(r *http.Request) (ThumbnailOptions, bool, bool) {
+	var opts ThumbnailOptions
+
+	width := r.Form.Get("w")
+	height := r.Form.Get("h")
+	if len(width) == 0 && len(height) == 0 {
+		return opts, false, true
 	}
-	if contentType != "image/png" && contentType != "image/jpeg" {
-		return data
+
+	maxSize := s.Server.currentConfig().ThumbnailMaxSize
+	if maxSize == 0 {
+		maxSize = DEFAULT_THUMBNAIL_MAX_SIZE
 	}
 
-	var err error
-	var img image.Image
-	var buffer *bytes.Buffer
+	for _, v := range []struct {
+		param string
+		dst   *uint
+	}{{width, &opts.Width}, {height, &opts.Height}} {
+		if len(v.param) == 0 {
+			continue
+		}
+		size, err := strconv.ParseUint(v.param, 10, 32)
+		// don't permit too large resize
+		if err != nil || uint(size) > maxSize {
+			return opts, true, false
+		}
+		*v.dst = uint(size)
+	}
+
+	if opts.Width == 0 && opts.Height == 0 {
+		return opts, true, false
+	}
+
+	opts.Mode = r.Form.Get("mode")
+	switch opts.Mode {
+	case "":
+		opts.Mode = THUMBNAIL_MODE_FIT
+	case THUMBNAIL_MODE_FIT, THUMBNAIL_MODE_FILL, THUMBNAIL_MODE_CROP:
+	default:
+		return opts, true, false
+	}
+
+	opts.Format = r.Form.Get("f")
+	switch opts.Format {
+	case "", "png", "jpeg", "gif":
+	case "jpg":
+		opts.Format = "jpeg"
+	default:
+		return opts, true, false
+	}
+
+	return opts, true, true
+}
 
-	// create the Image instance
-	if contentType == "image/png" {
-		img, err = png.Decode(bytes.NewReader(data))
-		if err != nil {
-			log.Println("[err] Can't resize png image with id:", id)
-			return data
+// recordDownload stores the time of the first download of the file and
+// publishes it. With the tiered storage, the time of the last download is
+// stored too, for the demotion of the unused files.
+func (s *Server) recordDownload(logger *slog.Logger, entry Metadata) {
+	now := time.Now()
+	access := s.Config.Storage == TIERED_STORAGE && now.Sub(entry.LastAccessTime) >= LAST_ACCESS_RESOLUTION
+	if !entry.FirstDownloadTime.IsZero() && !access {
+		return
+	}
+
+	first := false
+	err := s.updateMetadata(entry.Filename, func(m *Metadata) bool {
+		// in the transaction, for concurrent downloads
+		first = m.FirstDownloadTime.IsZero()
+		if first {
+			m.FirstDownloadTime = now
 		}
-	} else if contentType == "image/jpeg" {
-		img, err = jpeg.Decode(bytes.NewReader(data))
-		if err != nil {
-			log.Println("[err] Can't resize jpg image with id:", id)
-			return data
+		if access {
+			m.LastAccessTime = now
 		}
+		return first || access
+	})
+	if err != nil {
+		logger.Error("Can't store the download time", "file", entry.Filename, "err", err)
+		return
+	}
+
+	if first {
+		entry.FirstDownloadTime = now
+		s.publish(EVENT_FIRST_DOWNLOAD, entry)
+	}
+}
+
+// presignedDownload returns a presigned link to download the file directly
+// from the storage, if enabled and supported by the storage. The link
+// doesn't outlive the file.
+func (s *Server) presignedDownload(logger *slog.Logger, entry Metadata) (string, bool) {
+	if !s.Config.S3Config.PresignedDownloads {
+		return "", false
 	}
 
-	// resize the image
-	img = resize.Resize(width, height, img, resize.Lanczos3)
+	storage := s.backend
+	if tiered, ok := storage.(*TieredStorage); ok {
+		storage = tiered.Tier(entry.Tier)
+	}
+
+	presigner, ok := storage.(Presigner)
+	if !ok {
+		return "", false
+	}
+
+	// not detected yet for the oldest files, the server
+	// detects it when serving them
+	if len(entry.ContentType) == 0 {
+		return "", false
+	}
 
-	// write the data
-	buffer = bytes.NewBuffer(nil)
-	if contentType == "image/png" {
-		err = png.Encode(buffer, img)
-		if err != nil {
-			log.Println("[err] Can't encode png image with id:", id)
-			return data
+	ttl := DEFAULT_PRESIGNED_TTL
+	if len(s.Config.S3Config.PresignedTTL) > 0 {
+		if d, err := time.ParseDuration(s.Config.S3Config.PresignedTTL); err == nil {
+			ttl = d
 		}
-	} else if contentType == "image/jpeg" {
-		err = jpeg.Encode(buffer, img, nil)
-		if err != nil {
-			log.Println("[err] Can't encode jpg image with id:", id)
-			return data
+	}
+	if !entry.ExpirationTime.IsZero() {
+		if left := time.Until(entry.ExpirationTime); left < ttl {
+			ttl = left
 		}
 	}
+	if ttl <= 0 {
+		return "", false
+	}
+
+	link, err := presigner.PresignGet(entry.Filename, entry.ContentType, fileDisposition(entry.ContentType, entry.Original), ttl)
+	if err != nil {
+		logger.Warn("Can't presign the download, serving the file", "file", entry.Filename, "err", err)
+		return "", false
+	}
 
-	return buffer.Bytes()
+	return link, true
 }
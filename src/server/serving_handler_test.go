@@ -0,0 +1,82 @@
+// Tests of the route serving the files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	names := map[string]string{
+		"photo.png":           "inline; filename*=UTF-8''photo.png",
+		"été.png":             "inline; filename*=UTF-8''%C3%A9t%C3%A9.png",
+		"my file+1.txt":       "inline; filename*=UTF-8''my%20file+1.txt",
+		`a;b="c",d/e\f?g=h'i`: "inline; filename*=UTF-8''a%3Bb%3D%22c%22%2Cd%2Fe%5Cf%3Fg%3Dh%27i",
+	}
+
+	for name, expected := range names {
+		if header := contentDisposition("inline", name); header != expected {
+			t.Errorf("%s: %s, expected %s", name, header, expected)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	files := []struct {
+		data     string
+		original string
+		expected string
+	}{
+		{"body { color: red }", "style.css", "text/css; charset=utf-8"},
+		{"plain text", "notes.txt", "text/plain; charset=utf-8"},
+		// never upgraded to an active type
+		{`<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "x.svg", "text/plain; charset=utf-8"},
+		{"alert(1)", "x.js", "text/plain; charset=utf-8"},
+		{"<note>hello</note>", "x.xml", "text/plain; charset=utf-8"},
+	}
+
+	for _, file := range files {
+		if contentType := detectContentType([]byte(file.data), file.original); contentType != file.expected {
+			t.Errorf("%s: %s, expected %s", file.original, contentType, file.expected)
+		}
+	}
+}
+
+func TestServeActiveContent(t *testing.T) {
+	_, h := newTestServer(t, nil)
+
+	files := []struct {
+		name        string
+		data        string
+		contentType string
+		disposition string
+	}{
+		{"x.html", "<html><script>alert(1)</script></html>", "text/html", "attachment"},
+		{"x.svg", `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"></svg>`, "text/plain", "inline"},
+		{"x.png.html", "\x89PNG\r\n\x1a\n", "image/png", "inline"},
+		{"notes.txt", "plain text", "text/plain", "inline"},
+	}
+
+	for _, file := range files {
+		w, response := upload(t, h, file.name, []byte(file.data), nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: upload status %d", file.name, w.Code)
+		}
+
+		w = get(h, "/upd/"+response.Name, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", file.name, w.Code)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: the browsers may sniff the content-type", file.name)
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, file.contentType) {
+			t.Errorf("%s: served as %s, expected %s", file.name, contentType, file.contentType)
+		}
+		if header := w.Header().Get("Content-Disposition"); !strings.HasPrefix(header, file.disposition+";") {
+			t.Errorf("%s: served %s, expected %s", file.name, header, file.disposition)
+		}
+	}
+}
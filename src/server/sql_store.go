@@ -0,0 +1,326 @@
+// Store of the metadata in a SQL database.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQL_UPDATE_ATTEMPTS = 10
+)
+
+// the timestamps are stored in nanoseconds, for
+// the indexes to be usable with every database
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS upd_metadata (
+		id TEXT PRIMARY KEY,
+		creation_time BIGINT NOT NULL,
+		expiration_time BIGINT,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS upd_metadata_creation_time ON upd_metadata (creation_time)`,
+	`CREATE INDEX IF NOT EXISTS upd_metadata_expiration_time ON upd_metadata (expiration_time)`,
+	`CREATE TABLE IF NOT EXISTS upd_collections (
+		id TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+}
+
+// SQLStore stores the metadata and the collections in a SQLite or PostgreSQL
+// database, as JSON with the columns needed to list the recent and the
+// expired files. With PostgreSQL, several servers can share the metadata.
+type SQLStore struct {
+	DB  *sql.DB
+	Log *slog.Logger
+}
+
+func NewSQLStore(store string, config SQLConfig, log *slog.Logger) (*SQLStore, error) {
+	driver := "postgres"
+	if store == SQLITE_STORE {
+		driver = "sqlite"
+	}
+
+	db, err := sql.Open(driver, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	// a SQLite database is written by one connection at a time
+	if store == SQLITE_STORE {
+		db.SetMaxOpenConns(1)
+	} else if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+
+	for _, query := range sqlSchema {
+		if _, err := db.Exec(query); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("can't create the tables: %v", err)
+		}
+	}
+
+	return &SQLStore{DB: db, Log: log}, nil
+}
+
+// nanos returns the timestamp stored for the time, nil if zero.
+func nanos(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+func (s *SQLStore) Get(id string) (*Metadata, error) {
+	var data string
+	err := s.DB.QueryRow(`SELECT data FROM upd_metadata WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := new(Metadata)
+	if err := json.Unmarshal([]byte(data), metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (s *SQLStore) Put(metadata Metadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(`INSERT INTO upd_metadata (id, creation_time, expiration_time, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET creation_time = excluded.creation_time, expiration_time = excluded.expiration_time, data = excluded.data`,
+		metadata.Filename, metadata.CreationTime.UnixNano(), nanos(metadata.ExpirationTime), string(data))
+	return err
+}
+
+// Update stores the modified metadata only if it hasn't been modified
+// meanwhile, by another server, otherwise it starts over.
+func (s *SQLStore) Update(id string, update func(m *Metadata) bool) error {
+	for i := 0; i < SQL_UPDATE_ATTEMPTS; i++ {
+		var previous string
+		err := s.DB.QueryRow(`SELECT data FROM upd_metadata WHERE id = $1`, id).Scan(&previous)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var metadata Metadata
+		if err := json.Unmarshal([]byte(previous), &metadata); err != nil {
+			return err
+		}
+
+		if !update(&metadata) {
+			return nil
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+
+		result, err := s.DB.Exec(`UPDATE upd_metadata SET expiration_time = $1, data = $2 WHERE id = $3 AND data = $4`,
+			nanos(metadata.ExpirationTime), string(data), id, previous)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+	}
+
+	return fmt.Errorf("the metadata of %s is modified concurrently", id)
+}
+
+func (s *SQLStore) Delete(id string) error {
+	_, err := s.DB.Exec(`DELETE FROM upd_metadata WHERE id = $1`, id)
+	return err
+}
+
+func (s *SQLStore) Query(filter func(m Metadata) bool) ([]Metadata, error) {
+	return s.query(filter, `SELECT id, data FROM upd_metadata ORDER BY id`)
+}
+
+// ListRecent returns the most recently created files.
+func (s *SQLStore) ListRecent() ([]string, error) {
+	rows, err := s.DB.Query(`SELECT id FROM upd_metadata ORDER BY creation_time DESC LIMIT $1`, MAX_LAST_UPLOADED)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLStore) ExpireDue(now time.Time) ([]Metadata, error) {
+	return s.query(nil, `SELECT id, data FROM upd_metadata WHERE expiration_time IS NOT NULL AND expiration_time < $1`, now.UnixNano())
+}
+
+// query returns the metadata of the rows (id, data)
+// matching the filter.
+func (s *SQLStore) query(filter func(m Metadata) bool, query string, args ...interface{}) ([]Metadata, error) {
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Metadata, 0)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		var metadata Metadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			s.Log.Error("Can't read a metadata", "file", id, "err", err)
+			continue
+		}
+
+		if filter == nil || filter(metadata) {
+			entries = append(entries, metadata)
+		}
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLStore) GetCollection(id string) (*Collection, error) {
+	var data string
+	err := s.DB.QueryRow(`SELECT data FROM upd_collections WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	collection := new(Collection)
+	if err := json.Unmarshal([]byte(data), collection); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func (s *SQLStore) PutCollection(c Collection) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(`INSERT INTO upd_collections (id, data) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, c.Id, string(data))
+	return err
+}
+
+// UpdateCollection stores the modified collection only if it hasn't
+// been modified meanwhile, by another server, otherwise it starts over.
+func (s *SQLStore) UpdateCollection(id string, update func(c *Collection) bool) error {
+	for i := 0; i < SQL_UPDATE_ATTEMPTS; i++ {
+		var previous string
+		err := s.DB.QueryRow(`SELECT data FROM upd_collections WHERE id = $1`, id).Scan(&previous)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var collection Collection
+		if err := json.Unmarshal([]byte(previous), &collection); err != nil {
+			return err
+		}
+
+		if !update(&collection) {
+			return nil
+		}
+
+		data, err := json.Marshal(collection)
+		if err != nil {
+			return err
+		}
+
+		result, err := s.DB.Exec(`UPDATE upd_collections SET data = $1 WHERE id = $2 AND data = $3`, string(data), id, previous)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+	}
+
+	return fmt.Errorf("the collection %s is modified concurrently", id)
+}
+
+func (s *SQLStore) DeleteCollection(id string) (bool, error) {
+	result, err := s.DB.Exec(`DELETE FROM upd_collections WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLStore) QueryCollections(filter func(c Collection) bool) ([]Collection, error) {
+	rows, err := s.DB.Query(`SELECT id, data FROM upd_collections ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := make([]Collection, 0)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		var collection Collection
+		if err := json.Unmarshal([]byte(data), &collection); err != nil {
+			s.Log.Error("Can't read a collection", "collection", id, "err", err)
+			continue
+		}
+
+		if filter == nil || filter(collection) {
+			collections = append(collections, collection)
+		}
+	}
+	return collections, rows.Err()
+}
+
+func (s *SQLStore) Check() error {
+	var id string
+	err := s.DB.QueryRow(`SELECT id FROM upd_metadata LIMIT 1`).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (s *SQLStore) Close() error {
+	return s.DB.Close()
+}
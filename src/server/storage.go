@@ -0,0 +1,143 @@
+// Storage backends of the hosted files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// storedNamePattern matches the names given by upd to the stored
+// files: the generated ids and the names of their thumbnails.
+var storedNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]{8}(\.thumb\.[0-9]+x[0-9]+\.[a-z]+\.[a-z]+)?$`)
+
+// isStoredName returns whether the file could have been stored by upd,
+// the other files found in a storage are never listed.
+func isStoredName(name string) bool {
+	return storedNamePattern.MatchString(name)
+}
+
+// Storage stores the content of the files, by name. Reading a file
+// which doesn't exist returns an error matching os.ErrNotExist.
+type Storage interface {
+	// Write stores the data under the given name.
+	Write(name string, data []byte) error
+	// Read reads the whole file.
+	Read(name string) ([]byte, error)
+	// Open opens the file to stream it. The caller must close it.
+	Open(name string) (io.ReadCloser, error)
+	// Delete deletes the file.
+	Delete(name string) error
+	// List returns the names of the stored files, only the
+	// ones which could have been stored by upd.
+	List() ([]string, error)
+	// Check checks that the storage is usable.
+	Check(ctx context.Context) error
+}
+
+// Cleaner is implemented by the storages leaving temporary
+// files when the server is abruptly stopped.
+type Cleaner interface {
+	// Clean deletes the temporary files. It is called on
+	// startup, before using the storage.
+	Clean() error
+}
+
+// cleanAll cleans the storages implementing Cleaner.
+func cleanAll(storages []Storage) error {
+	for _, storage := range storages {
+		if cleaner, ok := storage.(Cleaner); ok {
+			if err := cleaner.Clean(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Presigner is implemented by the storages able to give a temporary
+// link to download a file directly from them.
+type Presigner interface {
+	// PresignGet returns a link valid for the given duration, the file being
+	// answered with the given Content-Type and Content-Disposition headers.
+	PresignGet(name string, contentType string, disposition string, ttl time.Duration) (string, error)
+}
+
+// ModTimer is implemented by the storages able to tell
+// when a file was last written.
+type ModTimer interface {
+	// ModTime returns the time of the last write of the file, an
+	// error matching os.ErrNotExist if it isn't stored.
+	ModTime(name string) (time.Time, error)
+}
+
+// latestModTime returns the time of the last write of the file
+// in any of the storages, which must all implement ModTimer.
+func latestModTime(storages []Storage, name string) (time.Time, error) {
+	var latest time.Time
+	found := false
+
+	for _, storage := range storages {
+		modTimer, ok := storage.(ModTimer)
+		if !ok {
+			return latest, fmt.Errorf("the storage can't tell when %s was written", name)
+		}
+
+		t, err := modTimer.ModTime(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return latest, err
+		}
+		if !found || t.After(latest) {
+			latest = t
+		}
+		found = true
+	}
+
+	if !found {
+		return latest, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return latest, nil
+}
+
+// NewStorage creates the storage backend of the given type (fs, s3, tiered or replicated).
+func NewStorage(storage string, config Config) (Storage, error) {
+	switch storage {
+	case FS_STORAGE:
+		return NewFSStorage(config.FSConfig), nil
+	case S3_STORAGE:
+		return NewS3Storage(config.S3Config)
+	case TIERED_STORAGE:
+		return NewTieredStorage(config)
+	case REPLICATED_STORAGE:
+		return NewReplicatedStorage(config)
+	}
+	return nil, fmt.Errorf("unsupported storage: %s", storage)
+}
+
+// listAll lists the files of all the storages, without duplicates.
+func listAll(storages []Storage) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, storage := range storages {
+		list, err := storage.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
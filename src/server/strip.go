@@ -0,0 +1,245 @@
+// Stripping of the metadata (EXIF, XMP, ...) of the uploaded images.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	iccSignature = []byte("ICC_PROFILE\x00")
+)
+
+// stripMetadata removes from JPEG and PNG images the metadata irrelevant
+// to their rendering (EXIF, XMP, IPTC, comments, texts, ...). The ICC profile
+// is kept. When the EXIF orientation isn't the normal one, it is applied on the
+// image before, so it is still correctly displayed: the image is re-encoded,
+// which is lossy for a JPEG image. The second value returned is whether the
+// data has been stripped.
+func stripMetadata(data []byte) ([]byte, bool, error) {
+	var stripped []byte
+	var err error
+
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		stripped, err = stripJpeg(data)
+	case "image/png":
+		stripped, err = stripPng(data)
+	default:
+		return data, false, nil
+	}
+
+	if err != nil {
+		return data, false, err
+	}
+
+	return stripped, true, nil
+}
+
+// stripJpeg removes the APP1 (EXIF, XMP), APP3 to APP13 (IPTC, ...), APP15
+// and comment segments of the JPEG image. The JFIF (APP0), ICC (APP2) and
+// Adobe (APP14) segments, needed to correctly render it, are kept.
+func stripJpeg(data []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the metadata containing the orientation will be lost,
+	// the image must be rotated.
+	if orientation := jpegOrientation(data); orientation != 1 {
+		return rotateJpeg(data, segments, orientation)
+	}
+
+	result := bytes.NewBuffer(make([]byte, 0, len(data)))
+	result.Write(data[:2])
+
+	for _, segment := range segments {
+		switch marker := segment[1]; {
+		case marker == 0xE1, marker >= 0xE3 && marker <= 0xED, marker == 0xEF, marker == 0xFE:
+		default:
+			result.Write(segment)
+		}
+	}
+
+	result.Write(data[scan:])
+	return result.Bytes(), nil
+}
+
+// jpegSegments returns the segments of the JPEG image, marker included,
+// before its start of scan or end of image, and the index of the latter.
+func jpegSegments(data []byte) ([][]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, fmt.Errorf("invalid jpeg image")
+	}
+
+	var segments [][]byte
+
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, 0, fmt.Errorf("invalid jpeg segment at %d", i)
+		}
+
+		marker := data[i+1]
+
+		// fill byte
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		// markers without any payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			segments = append(segments, data[i:i+2])
+			i += 2
+			continue
+		}
+
+		// start of scan or end of image: the rest is the image itself
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, i, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, 0, fmt.Errorf("invalid jpeg segment length at %d", i)
+		}
+
+		segments = append(segments, data[i:i+2+length])
+		i += 2 + length
+	}
+}
+
+// rotateJpeg applies the orientation on the image and re-encodes it. The
+// encoder doesn't write any metadata: the ICC profile is written back if
+// it describes the colors of the encoded image, gray or YCbCr.
+func rotateJpeg(data []byte, segments [][]byte, orientation int) ([]byte, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(encoded, applyOrientation(img, orientation), &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+
+	colorSpace := "RGB "
+	if _, gray := img.(*image.Gray); gray {
+		colorSpace = "GRAY"
+	}
+
+	var icc [][]byte
+	for _, segment := range segments {
+		if segment[1] == 0xE2 && len(segment) > 4+len(iccSignature)+2 && bytes.HasPrefix(segment[4:], iccSignature) {
+			icc = append(icc, segment)
+		}
+	}
+	if len(icc) == 0 || iccColorSpace(icc) != colorSpace {
+		return encoded.Bytes(), nil
+	}
+
+	result := bytes.NewBuffer(make([]byte, 0, encoded.Len()))
+	result.Write(encoded.Bytes()[:2])
+	for _, segment := range icc {
+		result.Write(segment)
+	}
+	result.Write(encoded.Bytes()[2:])
+	return result.Bytes(), nil
+}
+
+// iccColorSpace returns the color space of the ICC profile stored in the
+// APP2 segments, from its header in the first one.
+func iccColorSpace(segments [][]byte) string {
+	for _, segment := range segments {
+		// signature, sequence number and count of the segments
+		profile := segment[4+len(iccSignature)+2:]
+		if segment[4+len(iccSignature)] == 1 && len(profile) >= 20 {
+			return string(profile[16:20])
+		}
+	}
+	return ""
+}
+
+// stripPng removes the textual, EXIF and time chunks of the PNG image.
+// When the image is rotated, the encoder only writes its pixels: the
+// chunks describing its colors are written back.
+func stripPng(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("invalid png image")
+	}
+
+	result := bytes.NewBuffer(make([]byte, 0, len(data)))
+	result.Write(pngSignature)
+
+	orientation := 1
+	var colorChunks [][]byte
+
+	i := len(pngSignature)
+	for i < len(data) {
+		if i+12 > len(data) {
+			return nil, fmt.Errorf("invalid png chunk at %d", i)
+		}
+
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("invalid png chunk length at %d", i)
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			orientation = exifOrientation(data[i+8 : i+8+length])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		case "iCCP", "sRGB", "gAMA", "cHRM":
+			colorChunks = append(colorChunks, data[i:end])
+			result.Write(data[i:end])
+		default:
+			result.Write(data[i:end])
+		}
+
+		i = end
+	}
+
+	if orientation == 1 {
+		return result.Bytes(), nil
+	}
+
+	// the metadata containing the orientation has been
+	// removed, the image must be rotated.
+	if err := checkImageSize(result.Bytes()); err != nil {
+		return nil, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := bytes.NewBuffer(nil)
+	if err := png.Encode(encoded, applyOrientation(img, orientation)); err != nil {
+		return nil, err
+	}
+
+	// they must precede the pixels, after the header chunk
+	header := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded.Bytes()[len(pngSignature):]))
+	rotated := bytes.NewBuffer(make([]byte, 0, encoded.Len()))
+	rotated.Write(encoded.Bytes()[:header])
+	for _, chunk := range colorChunks {
+		rotated.Write(chunk)
+	}
+	rotated.Write(encoded.Bytes()[header:])
+	return rotated.Bytes(), nil
+}
@@ -0,0 +1,315 @@
+// Tests of the stripping of the metadata of the images.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// testQuadrantImage returns a white 64x32 image whose top left quadrant is red.
+func testQuadrantImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{255, 255, 255, 255}
+			if x < 32 && y < 16 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// testExif returns an EXIF block (big endian TIFF) with the given
+// orientation and a GPS IFD containing a latitude reference.
+func testExif(orientation int) []byte {
+	tiff := bytes.NewBuffer(nil)
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(tiff, binary.BigEndian, uint32(8))
+
+	// IFD0: orientation and GPS IFD pointer
+	binary.Write(tiff, binary.BigEndian, uint16(2))
+	binary.Write(tiff, binary.BigEndian, []uint16{EXIF_ORIENTATION_TAG, 3})
+	binary.Write(tiff, binary.BigEndian, uint32(1))
+	binary.Write(tiff, binary.BigEndian, []uint16{uint16(orientation), 0})
+	binary.Write(tiff, binary.BigEndian, []uint16{0x8825, 4})
+	binary.Write(tiff, binary.BigEndian, []uint32{1, 38})
+	binary.Write(tiff, binary.BigEndian, uint32(0))
+
+	// GPS IFD: GPSLatitudeRef
+	binary.Write(tiff, binary.BigEndian, uint16(1))
+	binary.Write(tiff, binary.BigEndian, []uint16{1, 2})
+	binary.Write(tiff, binary.BigEndian, uint32(2))
+	tiff.WriteString("N\x00\x00\x00")
+	binary.Write(tiff, binary.BigEndian, uint32(0))
+
+	return tiff.Bytes()
+}
+
+// testJpegSegment returns a JPEG segment with the given marker and payload.
+func testJpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testIccSegment returns an APP2 segment containing
+// a whole ICC profile of the given color space.
+func testIccSegment(colorSpace string) []byte {
+	profile := make([]byte, 128)
+	copy(profile[16:], colorSpace)
+	payload := append(append([]byte{}, iccSignature...), 1, 1)
+	return testJpegSegment(0xE2, append(payload, profile...))
+}
+
+// testJpeg encodes the image in JPEG, with the
+// given segments written after its start.
+func testJpeg(t *testing.T, img image.Image, segments ...[]byte) []byte {
+	encoded := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := append([]byte{}, encoded.Bytes()[:2]...)
+	for _, segment := range segments {
+		data = append(data, segment...)
+	}
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+// testPngChunk returns a PNG chunk of the given type and data.
+func testPngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPngWithChunks encodes the image in PNG, with the
+// given chunks written after its header chunk.
+func testPngWithChunks(t *testing.T, img image.Image, chunks ...[]byte) []byte {
+	encoded := bytes.NewBuffer(nil)
+	if err := png.Encode(encoded, img); err != nil {
+		t.Fatal(err)
+	}
+
+	header := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded.Bytes()[len(pngSignature):]))
+	data := append([]byte{}, encoded.Bytes()[:header]...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return append(data, encoded.Bytes()[header:]...)
+}
+
+// jpegMarkers returns the markers of the segments of the JPEG image.
+func jpegMarkers(t *testing.T, data []byte) []byte {
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var markers []byte
+	for _, segment := range segments {
+		markers = append(markers, segment[1])
+	}
+	return markers
+}
+
+// checkRedQuadrant checks the size of the image and that
+// only its given quadrant (0 top left, 1 top right, 2 bottom
+// left, 3 bottom right) is red.
+func checkRedQuadrant(t *testing.T, img image.Image, width, height, quadrant int) {
+	t.Helper()
+
+	if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+		t.Fatalf("unexpected size %dx%d, expected %dx%d", b.Dx(), b.Dy(), width, height)
+	}
+
+	for q := 0; q < 4; q++ {
+		x, y := width/4+(q%2)*width/2, height/4+(q/2)*height/2
+		r, g, b, _ := img.At(x, y).RGBA()
+		red := r>>8 > 200 && g>>8 < 60 && b>>8 < 60
+		if red != (q == quadrant) {
+			t.Errorf("quadrant %d: unexpected color %d,%d,%d", q, r>>8, g>>8, b>>8)
+		}
+	}
+}
+
+// testOrientations are the size and red quadrant of testQuadrantImage,
+// the EXIF orientation being applied.
+var testOrientations = map[int][3]int{
+	1: {64, 32, 0},
+	2: {64, 32, 1},
+	3: {64, 32, 3},
+	4: {64, 32, 2},
+	5: {32, 64, 0},
+	6: {32, 64, 1},
+	7: {32, 64, 3},
+	8: {32, 64, 2},
+}
+
+func TestStripJpegGPS(t *testing.T) {
+	exif := testJpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif(1)...))
+	comment := testJpegSegment(0xFE, []byte("taken at home"))
+	data := testJpeg(t, testQuadrantImage(), exif, testIccSegment("RGB "), comment)
+
+	stripped, ok, err := stripMetadata(data)
+	if err != nil || !ok {
+		t.Fatalf("not stripped: %v", err)
+	}
+
+	markers := jpegMarkers(t, stripped)
+	if bytes.IndexByte(markers, 0xE1) >= 0 || bytes.IndexByte(markers, 0xFE) >= 0 {
+		t.Errorf("the EXIF or the comment is kept: % x", markers)
+	}
+	if bytes.IndexByte(markers, 0xE2) < 0 {
+		t.Errorf("the ICC profile is removed: % x", markers)
+	}
+
+	// normal orientation: the image isn't re-encoded
+	if len(data)-len(stripped) != len(exif)+len(comment) {
+		t.Errorf("unexpected size %d, %d before", len(stripped), len(data))
+	}
+}
+
+func TestStripJpegOrientation(t *testing.T) {
+	for orientation, expected := range testOrientations {
+		exif := testJpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif(orientation)...))
+		data := testJpeg(t, testQuadrantImage(), exif, testIccSegment("RGB "))
+
+		stripped, _, err := stripMetadata(data)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+
+		markers := jpegMarkers(t, stripped)
+		if bytes.IndexByte(markers, 0xE1) >= 0 {
+			t.Errorf("orientation %d: the EXIF is kept", orientation)
+		}
+		if bytes.IndexByte(markers, 0xE2) < 0 {
+			t.Errorf("orientation %d: the ICC profile is removed", orientation)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		checkRedQuadrant(t, img, expected[0], expected[1], expected[2])
+	}
+}
+
+func TestStripJpegICCColorSpace(t *testing.T) {
+	// a CMYK profile doesn't describe the re-encoded image
+	exif := testJpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif(6)...))
+	data := testJpeg(t, testQuadrantImage(), exif, testIccSegment("CMYK"))
+
+	stripped, _, err := stripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if markers := jpegMarkers(t, stripped); bytes.IndexByte(markers, 0xE2) >= 0 {
+		t.Errorf("a mismatching ICC profile is kept: % x", markers)
+	}
+}
+
+func TestStripJpegMalformed(t *testing.T) {
+	exif := testJpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif(1)...))
+	data := testJpeg(t, testQuadrantImage(), exif)
+
+	badLength := append([]byte{}, data...)
+	binary.BigEndian.PutUint16(badLength[4:], 1)
+
+	noMarker := append([]byte{}, data...)
+	noMarker[2+len(exif)] = 0x00
+
+	tests := map[string][]byte{
+		"truncated segment":      data[:2+len(exif)/2],
+		"truncated before scan":  data[:2+len(exif)+1],
+		"invalid segment length": badLength,
+		"segment without marker": noMarker,
+	}
+
+	for name, data := range tests {
+		if stripped, ok, err := stripMetadata(data); err == nil || ok || !bytes.Equal(stripped, data) {
+			t.Errorf("%s: accepted (%v, %v)", name, ok, err)
+		}
+	}
+}
+
+func TestStripPng(t *testing.T) {
+	for orientation, expected := range testOrientations {
+		data := testPngWithChunks(t, testQuadrantImage(),
+			testPngChunk("sRGB", []byte{0}),
+			testPngChunk("tEXt", []byte("Location\x00home")),
+			testPngChunk("eXIf", testExif(orientation)),
+		)
+
+		stripped, ok, err := stripMetadata(data)
+		if err != nil || !ok {
+			t.Fatalf("orientation %d: not stripped: %v", orientation, err)
+		}
+
+		for _, kind := range []string{"tEXt", "eXIf"} {
+			if bytes.Contains(stripped, []byte(kind)) {
+				t.Errorf("orientation %d: the %s chunk is kept", orientation, kind)
+			}
+		}
+		if !bytes.Contains(stripped, []byte("sRGB")) {
+			t.Errorf("orientation %d: the sRGB chunk is removed", orientation)
+		}
+
+		img, err := png.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		checkRedQuadrant(t, img, expected[0], expected[1], expected[2])
+	}
+}
+
+func TestStripPngMalformed(t *testing.T) {
+	data := testPngWithChunks(t, testQuadrantImage(), testPngChunk("tEXt", []byte("Location\x00home")))
+
+	badLength := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(badLength[len(pngSignature):], 1<<30)
+
+	tests := map[string][]byte{
+		"truncated chunk":  data[:len(data)-5],
+		"invalid length":   badLength,
+		"truncated header": data[:len(pngSignature)+6],
+	}
+
+	for name, data := range tests {
+		if _, ok, err := stripMetadata(data); err == nil || ok {
+			t.Errorf("%s: accepted (%v, %v)", name, ok, err)
+		}
+	}
+}
+
+func TestSendStripRefused(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	exif := testJpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif(1)...))
+	data := testJpeg(t, testQuadrantImage(), exif)
+
+	// the location would be stored with the image
+	w, _ := upload(t, h, "photo.jpg", data[:2+len(exif)/2], map[string]string{"strip_metadata": "true"}, nil)
+	if w.Code != 422 {
+		t.Fatalf("malformed image: status %d", w.Code)
+	}
+	if names, err := s.backend.List(); err != nil || len(names) != 0 {
+		t.Fatalf("the image is stored: %v, %v", names, err)
+	}
+
+	w, response := upload(t, h, "photo.jpg", data, map[string]string{"strip_metadata": "true"}, nil)
+	if w.Code != http.StatusOK || !response.MetadataStripped {
+		t.Fatalf("status %d, %+v", w.Code, response)
+	}
+}
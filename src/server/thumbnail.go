@@ -0,0 +1,276 @@
+// Generation and caching of the thumbnails of the images.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/nfnt/resize"
+	_ "golang.org/x/image/webp" // registers the webp decoder
+)
+
+const (
+	THUMBNAIL_MODE_FIT  = "fit"  // fits in the box, preserving the aspect ratio
+	THUMBNAIL_MODE_FILL = "fill" // fills the box, preserving the aspect ratio and cropping the overflow
+	THUMBNAIL_MODE_CROP = "crop" // crops the center of the image, without resizing it
+
+	DEFAULT_THUMBNAIL_MAX_SIZE = 500
+
+	// max amount of pixels of a decoded image, 4 bytes each in RGBA
+	MAX_DECODED_PIXELS = 50 * 1000 * 1000
+
+	// max amount of thumbnails stored per file, the other
+	// variants being generated on each download
+	MAX_CACHED_THUMBNAILS = 10
+)
+
+var (
+	ErrNotResizable  = errors.New("the file is not a resizable image")
+	ErrImageTooLarge = errors.New("the image is too large to be decoded")
+)
+
+// ThumbnailOptions describes a resized variant of an image.
+type ThumbnailOptions struct {
+	Width  uint   // 0 to compute it from the height
+	Height uint   // 0 to compute it from the width
+	Mode   string // fit, fill or crop
+	Format string // png, jpeg or gif, empty to keep the format of the image
+}
+
+// cacheName returns the name under which this variant of
+// the given file is stored.
+func (o ThumbnailOptions) cacheName(filename string) string {
+	format := o.Format
+	if len(format) == 0 {
+		format = "auto"
+	}
+	return fmt.Sprintf("%s.thumb.%dx%d.%s.%s", filename, o.Width, o.Height, o.Mode, format)
+}
+
+// isResizable returns whether thumbnails can be generated
+// for the given content-type.
+func isResizable(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// thumbnailFormat returns the format in which the thumbnail of an image
+// decoded from the given format is encoded, if none has been asked.
+func thumbnailFormat(format string) string {
+	switch format {
+	case "jpeg", "gif":
+		return format
+	}
+	// there is no webp encoder
+	return "png"
+}
+
+// Thumbnail returns the thumbnail of the given entry, reading it from the
+// storage if it has already been generated, generating and storing it otherwise.
+// Only MAX_CACHED_THUMBNAILS variants are stored per file, anyone being able to
+// ask for any size. The original data is read with the given function only
+// when needed.
+func (s *Server) Thumbnail(entry Metadata, opts ThumbnailOptions, readOriginal func() ([]byte, error)) ([]byte, error) {
+	name := opts.cacheName(entry.Filename)
+
+	for _, t := range entry.Thumbnails {
+		if t != name {
+			continue
+		}
+		data, err := s.ReadFile(name)
+		if err == nil {
+			return data, nil
+		}
+		// regenerate it
+		break
+	}
+
+	data, err := readOriginal()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isResizable(http.DetectContentType(data)) {
+		return nil, ErrNotResizable
+	}
+
+	// don't let a burst of thumbnails use every CPU
+	s.thumbnailSlots <- struct{}{}
+	start := time.Now()
+	thumbnail, err := generateThumbnail(data, opts)
+	thumbnailDuration.Observe(time.Since(start).Seconds())
+	<-s.thumbnailSlots
+	if err != nil {
+		return nil, err
+	}
+
+	if !canCacheThumbnail(entry, name) {
+		return thumbnail, nil
+	}
+
+	if err := s.WriteFile(name, thumbnail); err != nil {
+		return nil, err
+	}
+
+	cached, err := s.addThumbnail(entry.Filename, name)
+	if err != nil {
+		return nil, err
+	}
+	// the other variants generated meanwhile took the last places
+	if !cached {
+		if err := s.deleteFile(name); err != nil {
+			s.Log.Warn("Can't delete the thumbnail", "file", entry.Filename, "thumbnail", name, "err", err)
+		}
+	}
+
+	return thumbnail, nil
+}
+
+// canCacheThumbnail returns whether the thumbnail is already
+// listed in the metadata or there is room to store it.
+func canCacheThumbnail(entry Metadata, name string) bool {
+	for _, t := range entry.Thumbnails {
+		if t == name {
+			return true
+		}
+	}
+	return len(entry.Thumbnails) < MAX_CACHED_THUMBNAILS
+}
+
+// addThumbnail stores in the metadata of the file that the given
+// thumbnail has been generated. It returns false if the file has
+// already MAX_CACHED_THUMBNAILS other thumbnails.
+func (s *Server) addThumbnail(filename string, name string) (bool, error) {
+	var cached bool
+	err := s.updateMetadata(filename, func(m *Metadata) bool {
+		cached = canCacheThumbnail(*m, name)
+		for _, t := range m.Thumbnails {
+			if t == name {
+				return false
+			}
+		}
+		if cached {
+			m.Thumbnails = append(m.Thumbnails, name)
+		}
+		return cached
+	})
+	return cached, err
+}
+
+// checkImageSize reads the dimensions of the image in its header and
+// refuses to decode an image which would use too much memory: a small
+// file can declare huge dimensions.
+func checkImageSize(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if uint64(config.Width)*uint64(config.Height) > MAX_DECODED_PIXELS {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// generateThumbnail decodes the image, resizes it following
+// the options and encodes it in the asked format.
+func generateThumbnail(data []byte, opts ThumbnailOptions) ([]byte, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// the thumbnail is resized in the orientation of the stored image
+	// and the orientation is applied on the smaller result.
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	if orientationSwapsSides(orientation) {
+		opts.Width, opts.Height = opts.Height, opts.Width
+	}
+
+	img = resizeImage(img, opts)
+	img = applyOrientation(img, orientation)
+
+	if len(opts.Format) == 0 {
+		opts.Format = thumbnailFormat(format)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	switch opts.Format {
+	case "png":
+		err = png.Encode(buffer, img)
+	case "jpeg":
+		err = jpeg.Encode(buffer, img, &jpeg.Options{Quality: 85})
+	case "gif":
+		err = gif.Encode(buffer, img, nil)
+	default:
+		err = fmt.Errorf("unsupported thumbnail format: %s", opts.Format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// resizeImage resizes the image following the mode of the options.
+func resizeImage(img image.Image, opts ThumbnailOptions) image.Image {
+	b := img.Bounds()
+
+	// every mode but fit needs both sides
+	if opts.Width == 0 || opts.Height == 0 {
+		return resize.Resize(opts.Width, opts.Height, img, resize.Lanczos3)
+	}
+
+	switch opts.Mode {
+	case THUMBNAIL_MODE_FILL:
+		ratio := math.Max(float64(opts.Width)/float64(b.Dx()), float64(opts.Height)/float64(b.Dy()))
+		width := uint(math.Ceil(float64(b.Dx()) * ratio))
+		height := uint(math.Ceil(float64(b.Dy()) * ratio))
+		img = resize.Resize(width, height, img, resize.Lanczos3)
+		return cropCenter(img, int(opts.Width), int(opts.Height))
+	case THUMBNAIL_MODE_CROP:
+		return cropCenter(img, int(opts.Width), int(opts.Height))
+	}
+
+	return resize.Thumbnail(opts.Width, opts.Height, img, resize.Lanczos3)
+}
+
+// cropCenter returns the center of the image of the given size, or
+// smaller if the image is smaller.
+func cropCenter(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	if height > b.Dy() {
+		height = b.Dy()
+	}
+
+	x := b.Min.X + (b.Dx()-width)/2
+	y := b.Min.Y + (b.Dy()-height)/2
+	rect := image.Rect(x, y, x+width, y+height)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,57 @@
+// Tests of the thumbnails of the images.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// testPNG returns a PNG image of the given size.
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnailCacheLimit(t *testing.T) {
+	s, h := newTestServer(t, nil)
+
+	_, file := upload(t, h, "a.png", testPNG(t, 64, 64), nil, nil)
+
+	for width := 1; width <= MAX_CACHED_THUMBNAILS+5; width++ {
+		w := get(h, fmt.Sprintf("/upd/%s?w=%d", file.Name, width), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("w=%d: status %d", width, w.Code)
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != width {
+			t.Fatalf("w=%d: width %d", width, img.Bounds().Dx())
+		}
+	}
+
+	entry, err := s.GetEntry(file.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Thumbnails) != MAX_CACHED_THUMBNAILS {
+		t.Errorf("%d thumbnails in the metadata", len(entry.Thumbnails))
+	}
+
+	names, err := s.backend.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != MAX_CACHED_THUMBNAILS+1 {
+		t.Errorf("%d files stored", len(names))
+	}
+}
@@ -0,0 +1,121 @@
+// Job regularly executed to demote the files of the
+// tiered storage to the cold storage.
+// Copyright © 2015 - Rémy MATHIEU
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+type TierJob struct {
+	server  *Server
+	storage *TieredStorage
+	policy  tierPolicy
+}
+
+// StartTierJob starts the tier job if the tiered storage is used.
+func (s *Server) StartTierJob() {
+	tiered, ok := s.backend.(*TieredStorage)
+	if !ok {
+		return
+	}
+
+	// validated on startup
+	policy, _ := s.Config.TieredConfig.policy()
+	interval := DEFAULT_TIER_INTERVAL
+	if len(s.Config.TieredConfig.Interval) > 0 {
+		interval, _ = time.ParseDuration(s.Config.TieredConfig.Interval)
+	}
+
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			job := TierJob{server: s, storage: tiered, policy: policy}
+			job.Run()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Run moves the files matching the policy
+// to the cold storage.
+func (j TierJob) Run() {
+	tierJobRunsTotal.Inc()
+
+	now := time.Now()
+	entries, err := j.server.Metadata.Query(func(entry Metadata) bool {
+		// the expired files are deleted by the clean job
+		if !entry.ExpirationTime.IsZero() && entry.ExpirationTime.Before(now) {
+			return false
+		}
+		return j.policy.demote(entry, now)
+	})
+	if err != nil {
+		j.server.Log.Error("Can't list the files to demote", "err", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if j.server.stopping() {
+			return
+		}
+
+		if err := j.demote(entry); err != nil {
+			j.server.Log.Warn("Can't demote a file", "file", entry.Filename, "err", err)
+			continue
+		}
+
+		j.server.Log.Info("Demoted to the cold storage", "file", entry.Filename)
+		tierJobDemotionsTotal.Inc()
+	}
+}
+
+// demote copies the file and its thumbnails to the cold storage,
+// records it in the metadata then deletes them from the hot storage.
+func (j TierJob) demote(entry Metadata) error {
+	if err := j.storage.Demote(entry.Filename); err != nil {
+		return err
+	}
+
+	demoted := []string{entry.Filename}
+	for _, thumbnail := range entry.Thumbnails {
+		// kept in the hot storage, still readable
+		if err := j.storage.Demote(thumbnail); err != nil {
+			j.server.Log.Warn("Can't demote the thumbnail", "file", entry.Filename, "thumbnail", thumbnail, "err", err)
+			continue
+		}
+		demoted = append(demoted, thumbnail)
+	}
+
+	found := false
+	err := j.server.updateMetadata(entry.Filename, func(m *Metadata) bool {
+		found = true
+		m.Tier = TIER_COLD
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		// deleted in the meantime
+		for _, name := range demoted {
+			j.storage.Cold.Delete(name)
+		}
+		return fmt.Errorf("deleted during its demotion")
+	}
+
+	for _, name := range demoted {
+		if err := j.storage.Release(name); err != nil {
+			j.server.Log.Warn("Can't delete the demoted file from the hot storage", "file", name, "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+// Tiered storage: the new files in a hot storage, the
+// older or unused ones demoted to a cold storage.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	TIER_HOT  = "hot"
+	TIER_COLD = "cold"
+
+	// LAST_ACCESS_RESOLUTION is the precision of the last access time
+	// of the files, to not write the metadata on every download.
+	LAST_ACCESS_RESOLUTION = time.Hour
+)
+
+// TieredStorage writes the files in the hot storage, the tier job
+// moving them to the cold storage. The files are read from the hot
+// storage then, if not there, from the cold one.
+type TieredStorage struct {
+	Hot  Storage
+	Cold Storage
+}
+
+func NewTieredStorage(config Config) (*TieredStorage, error) {
+	if err := validateTieredConfig(config.TieredConfig); err != nil {
+		return nil, err
+	}
+
+	hot, err := NewStorage(config.TieredConfig.Hot, config)
+	if err != nil {
+		return nil, fmt.Errorf("hot storage: %v", err)
+	}
+	cold, err := NewStorage(config.TieredConfig.Cold, config)
+	if err != nil {
+		return nil, fmt.Errorf("cold storage: %v", err)
+	}
+
+	return &TieredStorage{Hot: hot, Cold: cold}, nil
+}
+
+func (t *TieredStorage) Write(name string, data []byte) error {
+	return t.Hot.Write(name, data)
+}
+
+func (t *TieredStorage) Read(name string) ([]byte, error) {
+	data, err := t.Hot.Read(name)
+	if err == nil {
+		return data, nil
+	}
+
+	data, coldErr := t.Cold.Read(name)
+	if coldErr == nil {
+		return data, nil
+	}
+	return nil, tiersError(err, coldErr)
+}
+
+func (t *TieredStorage) Open(name string) (io.ReadCloser, error) {
+	file, err := t.Hot.Open(name)
+	if err == nil {
+		return file, nil
+	}
+
+	file, coldErr := t.Cold.Open(name)
+	if coldErr == nil {
+		return file, nil
+	}
+	return nil, tiersError(err, coldErr)
+}
+
+// Delete deletes the file from both storages, it must
+// have been deleted from one of them at least.
+func (t *TieredStorage) Delete(name string) error {
+	err := t.Hot.Delete(name)
+	coldErr := t.Cold.Delete(name)
+	if err != nil && coldErr != nil {
+		return tiersError(err, coldErr)
+	}
+	return nil
+}
+
+func (t *TieredStorage) Check(ctx context.Context) error {
+	if err := t.Hot.Check(ctx); err != nil {
+		return fmt.Errorf("hot storage: %v", err)
+	}
+	if err := t.Cold.Check(ctx); err != nil {
+		return fmt.Errorf("cold storage: %v", err)
+	}
+	return nil
+}
+
+// List lists the files of both storages.
+func (t *TieredStorage) List() ([]string, error) {
+	return listAll([]Storage{t.Hot, t.Cold})
+}
+
+// ModTime returns the time of the last write of the file in any storage.
+func (t *TieredStorage) ModTime(name string) (time.Time, error) {
+	return latestModTime([]Storage{t.Hot, t.Cold}, name)
+}
+
+// Clean cleans both storages.
+func (t *TieredStorage) Clean() error {
+	return cleanAll([]Storage{t.Hot, t.Cold})
+}
+
+// Tier returns the storage of the given tier.
+func (t *TieredStorage) Tier(tier string) Storage {
+	if tier == TIER_COLD {
+		return t.Cold
+	}
+	return t.Hot
+}
+
+// Demote copies the file from the hot storage to the cold one.
+func (t *TieredStorage) Demote(name string) error {
+	data, err := t.Hot.Read(name)
+	if err != nil {
+		return err
+	}
+	return t.Cold.Write(name, data)
+}
+
+// Release deletes a demoted file from the hot storage.
+func (t *TieredStorage) Release(name string) error {
+	return t.Hot.Delete(name)
+}
+
+func tiersError(hotErr, coldErr error) error {
+	if errors.Is(hotErr, os.ErrNotExist) && errors.Is(coldErr, os.ErrNotExist) {
+		return coldErr
+	}
+	return fmt.Errorf("hot storage: %v, cold storage: %v", hotErr, coldErr)
+}
+
+// tierPolicy decides which files are demoted.
+type tierPolicy struct {
+	demoteAfter       time.Duration // age of the file, 0 if disabled
+	demoteUnusedAfter time.Duration // duration without download, 0 if disabled
+	minSize           int64
+}
+
+func (c TieredConfig) policy() (tierPolicy, error) {
+	var policy tierPolicy
+	var err error
+
+	if len(c.DemoteAfter) > 0 {
+		if policy.demoteAfter, err = time.ParseDuration(c.DemoteAfter); err != nil {
+			return policy, fmt.Errorf("invalid demote_after: %v", err)
+		}
+	}
+	if len(c.DemoteUnusedAfter) > 0 {
+		if policy.demoteUnusedAfter, err = time.ParseDuration(c.DemoteUnusedAfter); err != nil {
+			return policy, fmt.Errorf("invalid demote_unused_after: %v", err)
+		}
+	}
+	policy.minSize = c.DemoteMinSize
+
+	return policy, nil
+}
+
+// demote returns whether the file must be moved to the cold storage.
+func (p tierPolicy) demote(m Metadata, now time.Time) bool {
+	if m.Tier == TIER_COLD || m.Size < p.minSize {
+		return false
+	}
+
+	if p.demoteAfter > 0 && now.Sub(m.CreationTime) >= p.demoteAfter {
+		return true
+	}
+
+	if p.demoteUnusedAfter > 0 {
+		last := m.CreationTime
+		if m.FirstDownloadTime.After(last) {
+			last = m.FirstDownloadTime
+		}
+		if m.LastAccessTime.After(last) {
+			last = m.LastAccessTime
+		}
+		return now.Sub(last) >= p.demoteUnusedAfter
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+// Tests of the tiered storage and of the demotion of the files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTierJobDemote(t *testing.T) {
+	s, h := newTestServer(t, nil)
+	tiered := &TieredStorage{
+		Hot:  NewFSStorage(FSConfig{OutputDirectory: t.TempDir()}),
+		Cold: NewFSStorage(FSConfig{OutputDirectory: t.TempDir()}),
+	}
+	s.backend = tiered
+
+	w, response := upload(t, h, "notes.txt", []byte("some notes"), nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	job := TierJob{server: s, storage: tiered, policy: tierPolicy{demoteAfter: time.Nanosecond}}
+	job.Run()
+
+	entry, err := s.GetEntry(response.Name)
+	if err != nil || entry == nil || entry.Tier != TIER_COLD {
+		t.Fatalf("the file isn't demoted: %+v, %v", entry, err)
+	}
+	if _, err := tiered.Hot.Read(response.Name); !os.IsNotExist(err) {
+		t.Errorf("the file is kept in the hot storage: %v", err)
+	}
+	if data, err := tiered.Cold.Read(response.Name); err != nil || string(data) != "some notes" {
+		t.Errorf("the file isn't in the cold storage: %q, %v", data, err)
+	}
+
+	// still downloadable
+	w = get(h, "/upd/"+response.Name, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "some notes" {
+		t.Fatalf("status %d, %q", w.Code, w.Body.String())
+	}
+
+	// deleted from the cold storage
+	if err := s.Expire(*entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tiered.Cold.Read(response.Name); !os.IsNotExist(err) {
+		t.Errorf("the demoted file isn't deleted: %v", err)
+	}
+}
+
+func TestTierJobDeletedDuringDemotion(t *testing.T) {
+	s, h := newTestServer(t, nil)
+	tiered := &TieredStorage{
+		Hot:  NewFSStorage(FSConfig{OutputDirectory: t.TempDir()}),
+		Cold: NewFSStorage(FSConfig{OutputDirectory: t.TempDir()}),
+	}
+	s.backend = tiered
+
+	_, response := upload(t, h, "notes.txt", []byte("some notes"), nil, nil)
+	entry, err := s.GetEntry(response.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.deleteMetadata(response.Name)
+
+	job := TierJob{server: s, storage: tiered, policy: tierPolicy{demoteAfter: time.Nanosecond}}
+	if err := job.demote(*entry); err == nil {
+		t.Fatal("a deleted file is demoted")
+	}
+	if _, err := tiered.Cold.Read(response.Name); !os.IsNotExist(err) {
+		t.Errorf("the copy in the cold storage is kept: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+// Delivery of the events to the webhooks, through an outbox
+// stored in BoltDB to not lose them on restart.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	OUTBOX_BUCKET = "Outbox"
+
+	WEBHOOK_EVENT_HEADER     = "X-upd-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-upd-Delivery"
+	WEBHOOK_SIGNATURE_HEADER = "X-upd-Signature"
+	WEBHOOK_TIMESTAMP_HEADER = "X-upd-Timestamp"
+
+	DEFAULT_WEBHOOK_MAX_ATTEMPTS = 10
+	WEBHOOK_TIMEOUT              = 10 * time.Second
+	WEBHOOK_MIN_BACKOFF          = 5 * time.Second
+	WEBHOOK_MAX_BACKOFF          = time.Hour
+)
+
+// delivery is an event waiting in the outbox to be sent to a webhook.
+type delivery struct {
+	URL         string          `json:"url"`     // url of the webhook, its secret is read in the configuration
+	Payload     json.RawMessage `json:"payload"` // the event
+	EventType   string          `json:"event_type"`
+	EventId     string          `json:"event_id"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+// enqueueWebhooks stores the event in the outbox for every
+// webhook subscribed to it.
+func (s *Server) enqueueWebhooks(event Event) {
+	if len(s.Config.Webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		s.Log.Error("Can't marshal an event", "err", err)
+		return
+	}
+
+	err = s.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(OUTBOX_BUCKET))
+		for _, webhook := range s.Config.Webhooks {
+			if !webhook.subscribed(event.Type) {
+				continue
+			}
+
+			data, err := json.Marshal(delivery{
+				URL:         webhook.URL,
+				Payload:     payload,
+				EventType:   event.Type,
+				EventId:     event.Id,
+				NextAttempt: event.Time,
+			})
+			if err != nil {
+				return err
+			}
+
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(auditKey(event.Time, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.Log.Error("Can't store an event in the outbox", "event", event.Type, "file", event.File.Filename, "err", err)
+		return
+	}
+
+	// wakes up the delivery job
+	select {
+	case s.outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+// subscribed returns whether the webhook receives the given event.
+func (w WebhookConfig) subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// StartWebhookJob delivers the events of the outbox, when new events are
+// stored and regularly to retry the failed deliveries.
+func (s *Server) StartWebhookJob() {
+	timer := time.NewTicker(time.Second)
+	defer timer.Stop()
+
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	senders := &webhookSenders{busy: make(map[string]bool)}
+
+	for {
+		select {
+		case <-timer.C:
+		case <-s.outboxNotify:
+		case <-s.stop:
+			return
+		}
+
+		s.deliverOutbox(client, senders)
+	}
+}
+
+// webhookSenders are the webhooks to which deliveries are being sent.
+type webhookSenders struct {
+	sync.Mutex
+	busy map[string]bool
+}
+
+// acquire marks the webhook as busy, it returns false if it already is.
+func (w *webhookSenders) acquire(url string) bool {
+	w.Lock()
+	defer w.Unlock()
+	if w.busy[url] {
+		return false
+	}
+	w.busy[url] = true
+	return true
+}
+
+func (w *webhookSenders) release(url string) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.busy, url)
+}
+
+// outboxEntry is a delivery read from the outbox, with its key.
+type outboxEntry struct {
+	key      []byte
+	delivery delivery
+}
+
+// deliverOutbox sends the deliveries which are due. Every webhook has its
+// own sender, a slow or unreachable one doesn't delay the others: the
+// webhooks still busy with the previous deliveries are skipped.
+func (s *Server) deliverOutbox(client *http.Client, senders *webhookSenders) {
+	for url := range s.dueDeliveries() {
+		if !senders.acquire(url) {
+			continue
+		}
+		s.startJob(func() {
+			defer senders.release(url)
+			// read again once the webhook acquired, the deliveries
+			// read before may have been sent by the previous sender
+			s.deliverWebhook(client, s.dueDeliveries()[url])
+		})
+	}
+}
+
+// dueDeliveries returns the deliveries of the outbox which
+// are due, by webhook, in the order they have been stored.
+func (s *Server) dueDeliveries() map[string][]outboxEntry {
+	due := make(map[string][]outboxEntry)
+	now := time.Now()
+
+	s.Database.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(OUTBOX_BUCKET)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				s.Log.Error("Can't read a delivery of the outbox", "err", err)
+				continue
+			}
+			if !d.NextAttempt.After(now) {
+				due[d.URL] = append(due[d.URL], outboxEntry{append([]byte(nil), k...), d})
+			}
+		}
+		return nil
+	})
+
+	return due
+}
+
+// deliverWebhook sends, in order, the deliveries due to a webhook. On a
+// failure, the next attempt of the delivery is delayed and the following
+// ones wait the next round, not to wait for the webhook once per delivery.
+func (s *Server) deliverWebhook(client *http.Client, entries []outboxEntry) {
+	for _, entry := range entries {
+		if s.stopping() {
+			return
+		}
+
+		d := entry.delivery
+		webhook, found := s.webhook(d.URL)
+
+		var err error
+		if found {
+			err = s.sendWebhook(client, webhook, d)
+		}
+
+		if !found || err == nil {
+			s.removeDelivery(entry.key)
+			continue
+		}
+
+		d.Attempts++
+		if d.Attempts >= webhook.maxAttempts() {
+			s.Log.Error("Webhook delivery abandoned", "url", d.URL, "event", d.EventType, "event_id", d.EventId, "attempts", d.Attempts, "err", err)
+			s.removeDelivery(entry.key)
+			continue
+		}
+
+		d.NextAttempt = time.Now().Add(webhookBackoff(d.Attempts))
+		s.Log.Warn("Webhook delivery failed, will retry", "url", d.URL, "event", d.EventType, "event_id", d.EventId, "attempts", d.Attempts, "next_attempt", d.NextAttempt, "err", err)
+		s.putDelivery(entry.key, d)
+		return
+	}
+}
+
+// webhook returns the configuration of the webhook having the given url.
+func (s *Server) webhook(url string) (WebhookConfig, bool) {
+	for _, webhook := range s.Config.Webhooks {
+		if webhook.URL == url {
+			return webhook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// sendWebhook posts the event to the webhook, signed with its secret. The
+// time of the sending is signed with the payload, for the webhook to refuse
+// a payload replayed later.
+func (s *Server) sendWebhook(client *http.Client, webhook WebhookConfig, d delivery) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, d.EventType)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, d.EventId)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	if len(webhook.Secret) > 0 {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+signPayload(webhook.Secret, timestamp, d.Payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256
+// of the timestamp, a dot and the payload.
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns the delay before the next attempt: exponential,
+// from WEBHOOK_MIN_BACKOFF up to WEBHOOK_MAX_BACKOFF.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WEBHOOK_MIN_BACKOFF
+	for i := 1; i < attempts && backoff < WEBHOOK_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_MAX_BACKOFF {
+		backoff = WEBHOOK_MAX_BACKOFF
+	}
+	return backoff
+}
+
+func (w WebhookConfig) maxAttempts() int {
+	if w.MaxAttempts > 0 {
+		return w.MaxAttempts
+	}
+	return DEFAULT_WEBHOOK_MAX_ATTEMPTS
+}
+
+func (s *Server) putDelivery(key []byte, d delivery) {
+	data, err := json.Marshal(d)
+	if err == nil {
+		err = s.Database.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(OUTBOX_BUCKET)).Put(key, data)
+		})
+	}
+	if err != nil {
+		s.Log.Error("Can't update a delivery of the outbox", "err", err)
+	}
+}
+
+func (s *Server) removeDelivery(key []byte) {
+	err := s.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(OUTBOX_BUCKET)).Delete(key)
+	})
+	if err != nil {
+		s.Log.Error("Can't remove a delivery from the outbox", "err", err)
+	}
+}
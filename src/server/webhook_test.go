@@ -0,0 +1,181 @@
+// Tests of the delivery of the events to the webhooks.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// outbox returns the deliveries waiting in the outbox.
+func outbox(t *testing.T, s *Server) []delivery {
+	var deliveries []delivery
+	err := s.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(OUTBOX_BUCKET)).ForEach(func(k, v []byte) error {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// testEvent returns an upload event of the given file.
+func testEvent(id string) Event {
+	return Event{Id: id, Type: "upload", Time: time.Now(), File: EventFile{Filename: id}}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	s, _ := newTestServer(t, func(c *Config) {
+		c.Webhooks = []WebhookConfig{{URL: hook.URL, Secret: "secret"}}
+	})
+
+	s.enqueueWebhooks(testEvent("event001"))
+	s.deliverOutbox(hook.Client(), &webhookSenders{busy: make(map[string]bool)})
+	s.jobs.Wait()
+
+	r, body := <-received, <-bodies
+	timestamp := r.Header.Get(WEBHOOK_TIMESTAMP_HEADER)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Fatalf("unexpected timestamp %q", timestamp)
+	}
+	if r.Header.Get(WEBHOOK_SIGNATURE_HEADER) != "sha256="+signPayload("secret", timestamp, body) {
+		t.Errorf("unexpected signature %s", r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+	}
+	// the same body sent at another time has another signature
+	if signPayload("secret", strconv.FormatInt(sent+1, 10), body) == signPayload("secret", timestamp, body) {
+		t.Errorf("the timestamp isn't signed")
+	}
+
+	if deliveries := outbox(t, s); len(deliveries) != 0 {
+		t.Errorf("the delivery isn't removed: %+v", deliveries)
+	}
+}
+
+func TestWebhookSlowEndpoint(t *testing.T) {
+	released := make(chan struct{})
+	release := sync.OnceFunc(func() { close(released) })
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-released
+	}))
+	defer slow.Close()
+	defer release()
+
+	fast := make(chan string, 2)
+	fastHook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast <- r.Header.Get(WEBHOOK_DELIVERY_HEADER)
+	}))
+	defer fastHook.Close()
+
+	s, _ := newTestServer(t, func(c *Config) {
+		c.Webhooks = []WebhookConfig{{URL: slow.URL}, {URL: fastHook.URL}}
+	})
+
+	senders := &webhookSenders{busy: make(map[string]bool)}
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+	s.enqueueWebhooks(testEvent("event001"))
+	s.deliverOutbox(client, senders)
+
+	select {
+	case id := <-fast:
+		if id != "event001" {
+			t.Fatalf("unexpected delivery %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the delivery waits for the slow webhook")
+	}
+
+	// the slow webhook is still busy, only the other one receives
+	// the new event, once done with the previous one
+	s.enqueueWebhooks(testEvent("event002"))
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		s.deliverOutbox(client, senders)
+		select {
+		case id := <-fast:
+			if id != "event002" {
+				t.Fatalf("unexpected delivery %s", id)
+			}
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("the delivery waits for the slow webhook")
+		}
+	}
+
+	release()
+	s.jobs.Wait()
+
+	deliveries := outbox(t, s)
+	if len(deliveries) != 1 || deliveries[0].URL != slow.URL || deliveries[0].EventId != "event002" {
+		t.Errorf("unexpected outbox %+v", deliveries)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	calls := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- r.Header.Get(WEBHOOK_DELIVERY_HEADER)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+
+	s, _ := newTestServer(t, func(c *Config) {
+		c.Webhooks = []WebhookConfig{{URL: hook.URL, MaxAttempts: 2}}
+	})
+
+	s.enqueueWebhooks(testEvent("event001"))
+	s.enqueueWebhooks(testEvent("event002"))
+
+	senders := &webhookSenders{busy: make(map[string]bool)}
+	s.deliverOutbox(hook.Client(), senders)
+	s.jobs.Wait()
+
+	// the following delivery isn't sent to the failing webhook
+	if len(calls) != 1 || <-calls != "event001" {
+		t.Fatalf("unexpected calls %d", len(calls))
+	}
+
+	deliveries := outbox(t, s)
+	if len(deliveries) != 2 {
+		t.Fatalf("unexpected outbox %+v", deliveries)
+	}
+	if d := deliveries[0]; d.Attempts != 1 || time.Until(d.NextAttempt) < WEBHOOK_MIN_BACKOFF-time.Second {
+		t.Errorf("the failed delivery isn't delayed: %+v", d)
+	}
+	if d := deliveries[1]; d.Attempts != 0 || d.NextAttempt.After(time.Now()) {
+		t.Errorf("the following delivery is modified: %+v", d)
+	}
+
+	// not due yet: only the following one is sent
+	s.deliverOutbox(hook.Client(), senders)
+	s.jobs.Wait()
+	if len(calls) != 1 || <-calls != "event002" {
+		t.Fatalf("unexpected calls %d", len(calls))
+	}
+}
@@ -0,0 +1,74 @@
+// Streaming of zip archives of hosted files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// writeZip streams a zip archive containing the given entries, reading
+// them one by one from the storage, to the given writer. The archive
+// is never buffered in memory.
+func (s *Server) writeZip(w io.Writer, entries []Metadata) error {
+	archive := zip.NewWriter(w)
+	names := make(map[string]bool)
+
+	for _, entry := range entries {
+		file, err := s.OpenFile(entry.Filename)
+		if err != nil {
+			s.Log.Error("Can't read the file to add it to a zip archive", "file", entry.Filename, "err", err)
+			continue
+		}
+
+		header := &zip.FileHeader{
+			Name:     zipEntryName(names, entry),
+			Method:   zip.Deflate,
+			Modified: entry.CreationTime,
+		}
+
+		f, err := archive.CreateHeader(header)
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		_, err = io.Copy(f, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// zipEntryName returns the name to use in the archive for the given entry:
+// its original name, suffixed with a counter when already used in the archive.
+func zipEntryName(names map[string]bool, entry Metadata) string {
+	name := entry.Original
+	if len(name) == 0 {
+		name = entry.Filename
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; names[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+
+	names[candidate] = true
+	return candidate
+}
+
+// setZipHeaders sets the headers of a response sending a zip archive.
+func setZipHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+}
@@ -0,0 +1,71 @@
+// Tests of the zip archives of the hosted files.
+// Copyright © 2015 - Rémy MATHIEU
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSearchTagsZip(t *testing.T) {
+	_, h := newTestServer(t, func(c *Config) {
+		c.SecretKey = "secret"
+	})
+	headers := map[string]string{SECRET_KEY_HEADER: "secret"}
+
+	for _, file := range []struct{ name, content, tags string }{
+		{"notes.txt", "first notes", "work"},
+		{"notes.txt", "second notes", "home,misc"},
+		{"photo.txt", "not matching", "other"},
+	} {
+		if w, _ := upload(t, h, file.name, []byte(file.content), map[string]string{"tags": file.tags}, headers); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	if w := get(h, "/upd/1.0/search_tags/zip?tags=work", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("without the key: status %d", w.Code)
+	}
+	if w := get(h, "/upd/1.0/search_tags/zip", headers); w.Code != http.StatusBadRequest {
+		t.Fatalf("without tags: status %d", w.Code)
+	}
+
+	w := get(h, "/upd/1.0/search_tags/zip?tags=work,%20home", headers)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, "work-home.zip") {
+		t.Errorf("unexpected disposition %s", disposition)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the duplicate names are suffixed
+	var files []string
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+		files = append(files, f.Name+": "+string(content))
+	}
+	sort.Strings(files)
+
+	if len(files) != 2 || !strings.HasPrefix(files[0], "notes (1).txt: ") || !strings.HasPrefix(files[1], "notes.txt: ") {
+		t.Fatalf("unexpected files %v", files)
+	}
+	contents := strings.TrimPrefix(files[0], "notes (1).txt: ") + "," + strings.TrimPrefix(files[1], "notes.txt: ")
+	if contents != "first notes,second notes" && contents != "second notes,first notes" {
+		t.Errorf("unexpected contents %v", files)
+	}
+}